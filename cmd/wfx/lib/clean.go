@@ -0,0 +1,28 @@
+package mainlib
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// clean answers `wfx clean [TARGETS...]` (when make.fx doesn't have a target of its own named "clean"):
+// it removes the paths the targets own (all targets' paths, if none are named), and says what it removed;
+// or with dryrun, only what it would remove.
+// Returns the exit code: 12 if something can't be removed (or a name isn't a target).
+func clean(stdout, stderr io.Writer, proj *wfx.Project, targets []string, dryrun bool) (exitcode int) {
+	paths, err := proj.Clean(targets, dryrun)
+	verb := "removed"
+	if dryrun {
+		verb = "would remove"
+	}
+	for _, path := range paths {
+		fmt.Fprintf(stdout, "%s %s\n", verb, path)
+	}
+	if err != nil {
+		reportError(stderr, err, false)
+		return 12
+	}
+	return 0
+}
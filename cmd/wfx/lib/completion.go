@@ -0,0 +1,160 @@
+package mainlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// completionFlags lists the options offered when completing a word that starts with a dash.
+// Keep this in sync with the options declared on the app in Main.
+var completionFlags = []string{
+	"--dryrun",
+	"--watch",
+	"--verify-reproducible",
+	"--hermetic",
+	"--deterministic",
+	"--events",
+	"--events-fd",
+	"--timings",
+	"--trace",
+	"--listtargets",
+	"--describe",
+	"--completion",
+}
+
+var completionShells = []string{"bash", "zsh", "fish"}
+
+// completionScripts are emitted by `wfx --completion SHELL`.
+// Each of them calls back into `wfx __complete -- WORDS...`, where WORDS are the args typed so far
+// (not including the program name), and the last word is the (possibly empty) prefix being completed.
+// The `__complete` command answers with one candidate per line, optionally followed by a tab and a description.
+var completionScripts = map[string]string{
+	"bash": `# bash completion for wfx.  Load with: source <(wfx --completion bash)
+_wfx_complete() {
+	local IFS=$'\n'
+	COMPREPLY=($(wfx __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null | cut -f1))
+}
+complete -o default -F _wfx_complete wfx
+`,
+	"zsh": `#compdef wfx
+# zsh completion for wfx.  Load with: source <(wfx --completion zsh)
+_wfx() {
+	local -a candidates
+	local line name desc
+	for line in "${(@f)$(wfx __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}"; do
+		[[ -z "$line" ]] && continue
+		name="${line%%$'\t'*}"
+		desc="${line#*$'\t'}"
+		candidates+=("${name//:/\\:}:${desc}")
+	done
+	_describe 'wfx' candidates
+}
+compdef _wfx wfx
+`,
+	"fish": `# fish completion for wfx.  Load with: wfx --completion fish | source
+function __wfx_complete
+	set -l tokens (commandline -opc) (commandline -ct)
+	wfx __complete -- $tokens[2..-1] 2>/dev/null
+end
+complete -c wfx -f -a '(__wfx_complete)'
+`,
+}
+
+// emitCompletionScript writes the completion script for the named shell.
+// It returns false if the shell isn't one we know.
+func emitCompletionScript(w io.Writer, shell string) bool {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return false
+	}
+	fmt.Fprint(w, script)
+	return true
+}
+
+// complete answers a `wfx __complete` request: words are the args typed so far, and the last one is the prefix to complete.
+//
+// This only parses the nearest make.fx file; it never evaluates it.
+// That keeps it fast (this runs on every tab press) and free of side effects.
+// Any problem finding or parsing the file simply results in offering fewer candidates.
+func complete(w io.Writer, words []string) {
+	prefix := ""
+	if len(words) > 0 {
+		prefix = words[len(words)-1]
+	}
+	offer := func(candidate, desc string) {
+		if !strings.HasPrefix(candidate, prefix) {
+			return
+		}
+		fmt.Fprintf(w, "%s\t%s\n", candidate, desc)
+	}
+
+	// The value for --completion is a shell name, and nothing else.
+	if len(words) > 1 && words[len(words)-2] == "--completion" {
+		for _, shell := range completionShells {
+			offer(shell, "shell")
+		}
+		return
+	}
+	if strings.HasPrefix(prefix, "-") {
+		for _, flag := range completionFlags {
+			offer(flag, "option")
+		}
+		return
+	}
+
+	mfxFile := parseNearestFxFile()
+	if mfxFile == nil {
+		return
+	}
+	for _, target := range mfxFile.ListTargets() {
+		offer(target.Name(), describeTarget(target))
+	}
+	if mfxFile.TargetByName("clean") == nil {
+		offer("clean", "remove what targets own (their fx_files)")
+	}
+	for _, target := range mfxFile.ListTargets() {
+		for _, file := range target.Files() {
+			offer(file, "file owned by "+target.Name())
+		}
+	}
+}
+
+func describeTarget(target *wfx.Target) string {
+	desc := "target"
+	if params := target.Params(); len(params) > 0 {
+		desc += " (" + strings.Join(params, ", ") + ")"
+	}
+	if deps := target.DependsOn(); len(deps) > 0 {
+		desc += "; depends on " + strings.Join(deps, ", ")
+	}
+	return desc
+}
+
+// parseNearestFxFile looks for a make.fx file in the working directory or any of its parents, and parses it.
+// Returns nil if there's no such file or it doesn't parse.
+func parseNearestFxFile() *wfx.FxFile {
+	dir, err := os.Getwd()
+	if err != nil {
+		return nil
+	}
+	for {
+		bs, err := os.ReadFile(filepath.Join(dir, "make.fx"))
+		if err == nil {
+			mfxFile, err := wfx.ParseFxFile("make.fx", string(bs))
+			if err != nil {
+				return nil
+			}
+			return mfxFile
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return nil
+		}
+		dir = parent
+	}
+}
@@ -0,0 +1,34 @@
+package mainlib
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// describe prints what the project sets up for its actions: for now, that's the environment variables, and where they come from.
+// In hermetic mode, that's everything they get.
+func describe(w io.Writer, prog *wfx.Program, hermetic bool) {
+	precedence := wfx.EnvPrecedence
+	if hermetic {
+		precedence = wfx.HermeticEnvPrecedence
+	}
+	fmt.Fprintf(w, "environment variables (later layers override earlier ones: %s):\n", strings.Join(precedence, " < "))
+	settings := prog.Env()
+	if len(settings) == 0 {
+		fmt.Fprintf(w, "\t(none set by the project; actions get the process environment)\n")
+		return
+	}
+	for _, s := range settings {
+		notes := []string{s.Source}
+		if s.Sensitive {
+			notes = append(notes, "sensitive")
+		}
+		if s.Overridden {
+			notes = append(notes, "overridden")
+		}
+		fmt.Fprintf(w, "\t%s=%s\t(%s)\n", s.Name, s.Value, strings.Join(notes, ", "))
+	}
+}
@@ -0,0 +1,60 @@
+package mainlib
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/warptools/wfx/pkg/timings"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// timingsSummaryLength is how many of the slowest targets (and actions) `--timings` lists.
+const timingsSummaryLength = 10
+
+// openEventSink sets up the sink for `--events`.
+// File descriptors 1 and 2 mean the stdout and stderr we were given (which may not be the process's own, e.g. in tests);
+// any other number is opened as-is, and is expected to have been set up by whoever launched us.
+func openEventSink(format string, fd int, stdout, stderr io.Writer) (wfxapi.EventSink, error) {
+	if format != "jsonl" {
+		return nil, fmt.Errorf("unknown format %q for --events; only \"jsonl\" is supported", format)
+	}
+	var w io.Writer
+	switch fd {
+	case 1:
+		w = stdout
+	case 2:
+		w = stderr
+	default:
+		f := os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd))
+		if f == nil {
+			return nil, fmt.Errorf("invalid file descriptor %d for --events-fd", fd)
+		}
+		w = f
+	}
+	return wfxapi.NewJSONLEventSink(w), nil
+}
+
+// emitErrorEvent reports an error that happened outside of any target (e.g. while loading the script), if events are enabled.
+func emitErrorEvent(events wfxapi.EventSink, err error) {
+	if events == nil {
+		return
+	}
+	events.Emit(wfxapi.Event{
+		Type:  wfxapi.EventError,
+		Error: wfxapi.NewEventErrorInfo(err),
+	})
+}
+
+// writeTrace writes the recorder's Chrome trace to a file.
+func writeTrace(recorder *timings.Recorder, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := recorder.WriteChromeTrace(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,132 @@
+package mainlib
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// runMain runs wfx, with the given make.fx, in a fresh directory, and returns what it wrote.
+func runMain(t *testing.T, makeFx string, args ...string) (stdout, stderr string, exitcode int) {
+	t.Helper()
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "make.fx"), []byte(makeFx), 0644), qt.IsNil)
+	wd, err := os.Getwd()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.Chdir(dir), qt.IsNil)
+	defer os.Chdir(wd)
+	var out, errOut bytes.Buffer
+	exitcode = Main(append([]string{"wfx"}, args...), strings.NewReader(""), &out, &errOut)
+	return out.String(), errOut.String(), exitcode
+}
+
+// parseEvents parses a JSONL event stream.
+func parseEvents(t *testing.T, stream string) []wfxapi.Event {
+	t.Helper()
+	var res []wfxapi.Event
+	scanner := bufio.NewScanner(strings.NewReader(stream))
+	for scanner.Scan() {
+		var ev wfxapi.Event
+		qt.Assert(t, json.Unmarshal(scanner.Bytes(), &ev), qt.IsNil, qt.Commentf("line: %s", scanner.Text()))
+		res = append(res, ev)
+	}
+	return res
+}
+
+func TestEventsRedactSecrets(t *testing.T) {
+	stdout, _, code := runMain(t, `
+ENV = {"TOKEN": "s3cr3t"}
+SENSITIVE_ENV = ["TOKEN"]
+
+def deploy(fx):
+	cmd("echo deploying with `+"s3cr3t"+` >&2; exit 3")
+`, "--events=jsonl", "deploy")
+	qt.Assert(t, code, qt.Equals, 12)
+	qt.Check(t, stdout, qt.Not(qt.Contains), "s3cr3t")
+	events := parseEvents(t, stdout)
+	var cmds []string
+	var failed *wfxapi.EventErrorInfo
+	for _, ev := range events {
+		if ev.Type == wfxapi.EventActionStart {
+			cmds = append(cmds, ev.Cmd)
+		}
+		if ev.Type == wfxapi.EventTargetFinish {
+			failed = ev.Error
+		}
+	}
+	qt.Check(t, cmds, qt.DeepEquals, []string{"echo deploying with [redacted] >&2; exit 3"})
+	qt.Assert(t, failed, qt.IsNotNil)
+	qt.Check(t, failed.Details["stderr"], qt.Contains, "deploying with [redacted]")
+}
+
+func TestEventsLifecycle(t *testing.T) {
+	stdout, stderr, code := runMain(t, `
+def gen(fx):
+	cmd("echo generated")
+	print("hello")
+
+def build(fx, depends_on=["gen"]):
+	cmd("exit 3")
+
+def ship(fx, depends_on=["build"]):
+	pass
+`, "-v", "--events=jsonl", "ship")
+	qt.Assert(t, code, qt.Equals, 12)
+	// With the events on stdout, what the actions wrote went to stderr.
+	qt.Check(t, stderr, qt.Contains, "[gen] cmd(echo generated): generated\n")
+	qt.Check(t, stderr, qt.Contains, "during target invokation (target=gen): hello\n")
+
+	type summary struct {
+		Type, Target, Action, Cmd string
+		ExitCode                  int
+		Error                     string
+		Reason                    string
+	}
+	var got []summary
+	for _, ev := range parseEvents(t, stdout) {
+		qt.Check(t, ev.Time.IsZero(), qt.IsFalse)
+		s := summary{Type: ev.Type, Target: ev.Target, Action: ev.Action, Cmd: ev.Cmd, ExitCode: -1, Reason: ev.Reason}
+		if ev.ExitCode != nil {
+			s.ExitCode = *ev.ExitCode
+		}
+		if ev.Error != nil {
+			s.Error = ev.Error.Code
+		}
+		if ev.Type == wfxapi.EventActionFinish || ev.Type == wfxapi.EventTargetFinish {
+			qt.Check(t, ev.Duration, qt.IsNotNil)
+		}
+		got = append(got, s)
+	}
+	qt.Assert(t, got, qt.DeepEquals, []summary{
+		{Type: "target.start", Target: "gen", ExitCode: -1},
+		{Type: "action.start", Target: "gen", Action: "Cmd", Cmd: "echo generated", ExitCode: -1},
+		{Type: "action.finish", Target: "gen", Action: "Cmd", Cmd: "echo generated", ExitCode: 0},
+		{Type: "target.finish", Target: "gen", ExitCode: -1},
+		{Type: "target.start", Target: "build", ExitCode: -1},
+		{Type: "action.start", Target: "build", Action: "Cmd", Cmd: "exit 3", ExitCode: -1},
+		{Type: "action.finish", Target: "build", Action: "Cmd", Cmd: "exit 3", ExitCode: 3, Error: wfxapi.EcodeActionCmdExit},
+		{Type: "target.finish", Target: "build", ExitCode: -1, Error: wfxapi.EcodeActionCmdExit},
+		{Type: "target.skip", Target: "ship", ExitCode: -1, Reason: "halted after target build failed"},
+	})
+}
+
+func TestEventsError(t *testing.T) {
+	stdout, _, code := runMain(t, `
+def build(fx):
+	cmd("true"
+`, "--events=jsonl", "build")
+	qt.Assert(t, code, qt.Equals, 17)
+	events := parseEvents(t, stdout)
+	qt.Assert(t, events, qt.HasLen, 1)
+	qt.Check(t, events[0].Type, qt.Equals, wfxapi.EventError)
+	qt.Assert(t, events[0].Error, qt.IsNotNil)
+	qt.Check(t, events[0].Error.Code, qt.Equals, wfxapi.EcodeScriptParsefail)
+}
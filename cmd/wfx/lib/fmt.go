@@ -0,0 +1,38 @@
+package mainlib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// format answers `wfx fmt`: it rewrites the make.fx file in the working directory in the canonical layout (see wfx.Format),
+// or with check, only says whether it would.
+// Returns the exit code: 16 if check finds the file isn't formatted, 17 if it can't be parsed, 19 if there's no make.fx (or it can't be written).
+func format(stderr io.Writer, check bool) (exitcode int) {
+	bs, err := os.ReadFile("make.fx")
+	if err != nil {
+		fmt.Fprintf(stderr, "wfx: cannot read make.fx: %s\n", err)
+		return 19
+	}
+	formatted, err := wfx.Format("make.fx", string(bs))
+	if err != nil {
+		reportError(stderr, err, false)
+		return 17
+	}
+	if bytes.Equal(formatted, bs) {
+		return 0
+	}
+	if check {
+		fmt.Fprintf(stderr, "make.fx is not formatted; run `wfx fmt` to fix it\n")
+		return 16
+	}
+	if err := os.WriteFile("make.fx", formatted, 0644); err != nil {
+		fmt.Fprintf(stderr, "wfx: cannot write make.fx: %s\n", err)
+		return 19
+	}
+	return 0
+}
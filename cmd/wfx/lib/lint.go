@@ -0,0 +1,40 @@
+package mainlib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// lint answers `wfx lint`: it checks the make.fx file in the working directory, and prints what it finds,
+// either one per line (like a compiler's errors), or as a JSON array.
+// Returns the exit code: 15 if anything found is an error (warnings alone don't fail), 19 if there's no make.fx.
+func lint(stdout, stderr io.Writer, asJSON bool) (exitcode int) {
+	bs, err := os.ReadFile("make.fx")
+	if err != nil {
+		fmt.Fprintf(stderr, "wfx: cannot read make.fx: %s\n", err)
+		return 19
+	}
+	findings := wfx.Lint("make.fx", string(bs), nil)
+	if asJSON {
+		if findings == nil {
+			findings = []wfx.LintFinding{}
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "\t")
+		enc.Encode(findings)
+	} else {
+		for _, f := range findings {
+			fmt.Fprintf(stdout, "%s\n", f)
+		}
+	}
+	for _, f := range findings {
+		if f.Severity == wfx.LintError {
+			return 15
+		}
+	}
+	return 0
+}
@@ -5,67 +5,209 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strings"
 
 	cli "github.com/jawher/mow.cli"
+	"github.com/serum-errors/go-serum"
 
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/lsp"
+	"github.com/warptools/wfx/pkg/timings"
 	"github.com/warptools/wfx/pkg/wfx"
+	"github.com/warptools/wfx/pkg/wfxapi"
 )
 
 // Main runs the complete interpreter exactly as if the full program.
 func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) (exitcode int) {
 	// Large TODO: this CLI library ignores our stdout and stderr params, and also tries to control rather than return exitcode.  We can't test anything off the happy path for args parsing until it does.
+	// (Past args parsing, we're in control: our actions set the exitcode and return, rather than using cli.Exit, so those paths are testable.)
 	app := cli.App("wfx", "the effect system for warpforge")
-	app.Spec = "[[--dryrun] TARGETS... | --listtargets]"
+	app.Spec = "[[--dryrun | --watch | --verify-reproducible] [-v | -q] [--hermetic] [--events [--events-fd]] [--timings] [--trace] TARGETS... | --listtargets | --describe | --completion]"
 	var (
 		targets     = app.StringsArg("TARGETS", []string{}, "targets to refresh")
 		dryrun      = app.BoolOpt("dryrun", false, "instead of acting, print names of targets that would be run, given the other arguments.")
+		watchmode   = app.BoolOpt("watch", false, "after running the targets, keep watching their declared inputs (and make.fx itself), and re-run affected targets when they change.")
+		verbose     = app.BoolOpt("v verbose", false, "show the output of every action as it happens, with each line decorated by the target and action it came from.  (By default, stdout is discarded, and stderr is only shown, along with the error, if the action fails.)")
+		quiet       = app.BoolOpt("q quiet", false, "hide the output of actions entirely: even when an action fails, only the error is shown, without the end of its stderr.")
+		hermetic    = app.BoolOpt("hermetic deterministic", false, "run actions in the same environment on every machine: a fixed PATH, locale, timezone, and SOURCE_DATE_EPOCH, plus only the host variables make.fx names in HOST_ENV (and no .env file).")
+		verifyRepro = app.BoolOpt("verify-reproducible", false, "after running the targets, remove their declared outputs, run them again, and fail if the outputs differ.")
+		eventsFmt   = app.StringOpt("events", "", "emit a machine-readable stream of lifecycle events, in the given format (only \"jsonl\" is supported).")
+		eventsFd    = app.IntOpt("events-fd", 1, "the file descriptor to write the --events stream to (1 for stdout, 2 for stderr, or any other descriptor the caller has opened).  If it's stdout, what actions write there goes to stderr instead.")
+		timingsOpt  = app.BoolOpt("timings", false, "after running, print a summary of the slowest targets and actions (wall, user, and sys time) to stderr.  With --watch, after each run.")
+		traceFile   = app.StringOpt("trace", "", "after running, write a Chrome Trace Event JSON file of all targets and actions to the given path.  With --watch, it's rewritten after each run, with just that run.")
 		listtargets = app.BoolOpt("listtargets", false, "instead of acting, only list the available targets (one per line).")
+		describeOpt = app.BoolOpt("describe", false, "instead of acting, describe the environment the project's actions will get: each variable it sets, where from, and in what order of precedence (sensitive values are redacted).")
+		completion  = app.StringOpt("completion", "", "instead of acting, print a shell completion script for the named shell (bash, zsh, or fish).")
 	)
+	app.Command("__complete", "answer a shell completion request (used by the scripts from --completion)", func(cmd *cli.Cmd) {
+		cmd.Hidden = true
+		cmd.Spec = "[WORDS...]"
+		words := cmd.StringsArg("WORDS", []string{}, "the words typed so far; the last one is the prefix to complete")
+		cmd.Action = func() {
+			complete(stdout, *words)
+		}
+	})
+	app.Command("lint", "check make.fx for mistakes, without running anything", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--json]"
+		asJSON := cmd.BoolOpt("json", false, "print the findings as a JSON array, rather than one per line.")
+		cmd.Action = func() {
+			exitcode = lint(stdout, stderr, *asJSON)
+		}
+	})
+	app.Command("fmt", "rewrite make.fx in the canonical layout", func(cmd *cli.Cmd) {
+		cmd.Spec = "[--check]"
+		check := cmd.BoolOpt("check", false, "don't rewrite anything; just fail if make.fx isn't already formatted.")
+		cmd.Action = func() {
+			exitcode = format(stderr, *check)
+		}
+	})
+	app.Command("lsp", "serve the Language Server Protocol on stdin and stdout, for editors", func(cmd *cli.Cmd) {
+		cmd.Action = func() {
+			if err := lsp.Serve(stdin, stdout); err != nil {
+				fmt.Fprintf(stderr, "%s\n", err)
+				exitcode = 1
+			}
+		}
+	})
 	app.Action = func() {
+		if *completion != "" {
+			if !emitCompletionScript(stdout, *completion) {
+				fmt.Fprintf(stderr, "unknown shell %q for --completion; try one of: bash, zsh, fish\n", *completion)
+				exitcode = 9
+				return
+			}
+			return
+		}
+		verbosity := action.VerbosityNormal
+		switch {
+		case *verbose:
+			verbosity = action.VerbosityVerbose
+		case *quiet:
+			verbosity = action.VerbosityQuiet
+		}
+		var events wfxapi.EventSink
+		if *eventsFmt != "" {
+			var err error
+			events, err = openEventSink(*eventsFmt, *eventsFd, stdout, stderr)
+			if err != nil {
+				fmt.Fprintf(stderr, "%s\n", err)
+				exitcode = 9
+				return
+			}
+		}
+		// What actions (and print) write goes to stdout, unless the event stream does:
+		// then it goes to stderr instead, so that stdout stays parseable.
+		actionStdout := stdout
+		if *eventsFmt != "" && *eventsFd == 1 {
+			actionStdout = stderr
+		}
+		var recorder *timings.Recorder
+		if *timingsOpt || *traceFile != "" {
+			recorder = &timings.Recorder{}
+			events = wfxapi.TeeEventSink(events, recorder)
+		}
+		// report writes what --timings and --trace ask for, about everything that's run since the last report.
+		report := func() {
+			if recorder == nil {
+				return
+			}
+			if *timingsOpt {
+				recorder.WriteSummary(stderr, timingsSummaryLength)
+			}
+			if *traceFile != "" {
+				if err := writeTrace(recorder, *traceFile); err != nil {
+					fmt.Fprintf(stderr, "wfx: writing trace: %s\n", err)
+				}
+			}
+			recorder.Reset()
+		}
+		ctx, stopSignals := interruptible(stderr)
+		defer stopSignals()
+
+		if *watchmode {
+			if err := watch(ctx, *targets, actionStdout, stderr, verbosity, *hermetic, events, report); err != nil {
+				fmt.Fprintf(stderr, "%s\n", err)
+				exitcode = 13
+				return
+			}
+			return
+		}
+
 		fsys := os.DirFS(".")
 		f, err := fsys.Open("make.fx")
 		if err != nil {
-			cli.Exit(19)
+			exitcode = 19
+			return
 		}
 		defer f.Close()
 		bs, err := ioutil.ReadAll(f)
 		if err != nil {
-			cli.Exit(18)
+			exitcode = 18
+			return
 		}
 
 		// Evaluation happens in roughly three passes, each with their own opportunities to discover deeper kinds of errors:
 		//  Pass 1: The syntax is parsed, and very high-level issues may be found -- then we attempt to discover all the targets.
 		//  Pass 2: The syntax is interpreted more completely -- undefined references will now be noticed, if possible; but evaluation itself still does not yet occur (e.g. dynamic references won't be checked).
 		//  Pass 3: Full evaluation -- now any remaining errors that are within the flow of execution will be found.
-		mfxFile, err := wfx.ParseFxFile("make.fx", string(bs))
+		proj, err := wfx.LoadSource("make.fx", string(bs), wfx.Options{
+			Stdout: actionStdout,
+			Stderr: stderr,
+			Events: events,
+
+			Verbosity: verbosity,
+			Hermetic:  *hermetic,
+		})
 		if err != nil {
-			cli.Exit(17)
+			emitErrorEvent(events, err)
+			reportError(stderr, err, false)
+			exitcode = 17
+			return
 		}
 
 		if *listtargets {
-			for _, target := range mfxFile.ListTargets() {
+			for _, target := range proj.Targets() {
 				fmt.Fprintf(stdout, "%s\n", target.Name())
 			}
+		} else if len(*targets) > 0 && (*targets)[0] == "clean" && proj.FxFile().TargetByName("clean") == nil {
+			// "clean" is built in, unless the project has its own.
+			exitcode = clean(actionStdout, stderr, proj, (*targets)[1:], *dryrun)
 		} else {
 			_ = dryrun // TODO support dryrun mode
 			_ = targets
 
-			evalCtx := wfx.EvalCtx{
-				FxFile: mfxFile,
-				Stdout: stdout,
-				Stderr: stderr,
+			prog, err := proj.Compile()
+			if err != nil {
+				emitErrorEvent(events, err)
+				reportError(stderr, err, false)
+				exitcode = 14
+				return
 			}
 
-			err := evalCtx.FirstPass()
-			if err != nil {
-				fmt.Fprintf(stderr, "%s\n", err)
-				cli.Exit(14)
+			if *describeOpt {
+				describe(stdout, prog, *hermetic)
+				return
 			}
 
-			err = evalCtx.InvokeTargets(*targets)
+			if *verifyRepro {
+				err = prog.VerifyReproducible(ctx, *targets)
+			} else {
+				err = prog.Run(ctx, *targets)
+			}
+			report()
 			if err != nil {
-				fmt.Fprintf(stderr, "%s\n", err)
-				cli.Exit(12)
+				reportError(stderr, err, verbosity == action.VerbosityNormal)
+				exitcode = 12
+				switch serum.Code(err) {
+				case wfxapi.EcodeInterrupted:
+					exitcode = 130
+				case wfxapi.EcodeNotReproducible:
+					exitcode = 20
+				}
+				return
+			}
+			if *verifyRepro {
+				fmt.Fprintf(stderr, "wfx: outputs were the same both times: %s\n", strings.Join(*targets, ", "))
 			}
 
 		}
@@ -74,5 +216,5 @@ func Main(args []string, stdin io.Reader, stdout, stderr io.Writer) (exitcode in
 		panic(err)
 	}
 
-	return 0
+	return exitcode
 }
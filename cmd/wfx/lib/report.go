@@ -0,0 +1,103 @@
+package mainlib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// reportError prints an error for the user.
+//
+// If the error says where in make.fx it came from (see wfxapi.WithScriptPosition), that's printed first, like a compiler does,
+// and beneath the error, the line of source with a caret under the spot, and the call stack (if it's more than just that spot).
+//
+// If showStderr is true, and the error (or anything in its chain of causes) carries a "stderr" detail --
+// which is how failing actions hand over the end of their stderr -- that's printed too, indented beneath it.
+// (This is for the default verbosity, where that's the only place that output is ever shown.
+// In verbose mode, it's already been seen, and repeating it is just noise; in quiet mode, it's not wanted.)
+func reportError(w io.Writer, err error, showStderr bool) {
+	if serum.Code(err) == wfxapi.EcodeInterrupted {
+		reportInterrupted(w, err)
+		return
+	}
+	pos := positioned(err)
+	if pos == nil {
+		fmt.Fprintf(w, "%s\n", err)
+	} else {
+		fmt.Fprintf(w, "%s:%s:%s: %s\n", serum.Detail(pos, "file"), serum.Detail(pos, "line"), serum.Detail(pos, "col"), err)
+		reportSource(w, pos)
+	}
+	if !showStderr {
+		return
+	}
+	var se serum.ErrorInterface
+	if !errors.As(err, &se) {
+		return
+	}
+	if tail := serum.Detail(se, "stderr"); tail != "" {
+		fmt.Fprintf(w, "\tstderr:\n")
+		for _, line := range strings.SplitAfter(strings.TrimSuffix(tail, "\n"), "\n") {
+			fmt.Fprintf(w, "\t\t%s", strings.TrimSuffix(line, "\n")+"\n")
+		}
+	}
+}
+
+// positioned returns the first error in the chain that says where in the script it came from, or nil.
+func positioned(err error) error {
+	for ; err != nil; err = errors.Unwrap(err) {
+		if serum.Detail(err, "file") != "" {
+			return err
+		}
+	}
+	return nil
+}
+
+// reportSource prints the line an error came from, with a caret under the column, and then its call stack, all indented beneath it.
+// If the file can't be read (or has changed, so the line isn't there), the excerpt is skipped.
+func reportSource(w io.Writer, err error) {
+	line, _ := strconv.Atoi(serum.Detail(err, "line"))
+	col, _ := strconv.Atoi(serum.Detail(err, "col"))
+	if bs, readErr := os.ReadFile(serum.Detail(err, "file")); readErr == nil && line > 0 {
+		if lines := strings.Split(string(bs), "\n"); line <= len(lines) {
+			src := strings.TrimRight(lines[line-1], "\r")
+			// The caret is lined up by copying the whitespace of the line (so tabs stay tabs), and spaces for everything else.
+			var caret strings.Builder
+			for i, r := range []rune(src) {
+				if i >= col-1 {
+					break
+				}
+				if r == '\t' {
+					caret.WriteRune('\t')
+				} else {
+					caret.WriteRune(' ')
+				}
+			}
+			fmt.Fprintf(w, "\t%d | %s\n", line, src)
+			fmt.Fprintf(w, "\t%s | %s^\n", strings.Repeat(" ", len(strconv.Itoa(line))), caret.String())
+		}
+	}
+	if stack := serum.Detail(err, "stack"); strings.Contains(stack, "\n") {
+		fmt.Fprintf(w, "\ttraceback (most recent call last):\n")
+		for _, frame := range strings.Split(stack, "\n") {
+			fmt.Fprintf(w, "\t\t%s\n", frame)
+		}
+	}
+}
+
+// reportInterrupted prints the summary of how far things got before an interruption.
+func reportInterrupted(w io.Writer, err error) {
+	fmt.Fprintf(w, "wfx: interrupted during target %q\n", serum.Detail(err, "target"))
+	if completed := serum.Detail(err, "completed"); completed != "" {
+		fmt.Fprintf(w, "\tcompleted: %s\n", strings.ReplaceAll(completed, ",", ", "))
+	}
+	if notRun := serum.Detail(err, "notrun"); notRun != "" {
+		fmt.Fprintf(w, "\tnot run: %s\n", strings.ReplaceAll(notRun, ",", ", "))
+	}
+}
@@ -0,0 +1,48 @@
+package mainlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/warptools/wfx/pkg/action"
+)
+
+// interruptible returns a context that's cancelled when the process gets SIGINT or SIGTERM.
+//
+// The first signal cancels it, which asks every running process to stop (SIGTERM to its process group),
+// and gives them action.DefaultGracePeriod to do so before they're killed.
+// A second signal kills them right away.
+//
+// Call the returned func when done, to go back to the default signal handling.
+func interruptible(stderr io.Writer) (context.Context, func()) {
+	force := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx = action.WithStopping(ctx, action.DefaultGracePeriod, force)
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(stderr, "wfx: got %s; stopping (again to kill)...\n", sig)
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-sigs:
+			fmt.Fprintf(stderr, "wfx: got %s again; killing\n", sig)
+			close(force)
+		case <-done:
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(sigs)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,209 @@
+package mainlib
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/fswatch"
+	"github.com/warptools/wfx/pkg/wfx"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// watchDebounce is how long things have to be quiet after a change before we react to it.
+const watchDebounce = 150 * time.Millisecond
+
+// watch invokes the targets, then keeps watching their inputs (the declared ones, and whatever they were seen reading) and the make.fx file itself,
+// and re-invokes whichever targets are affected when anything changes.
+// What the top level of make.fx read while it was evaluated (see Program.GlobalInputs) is watched like make.fx itself:
+// when it changes, make.fx is reloaded, and all the targets are invoked again.
+//
+// After each run, report is called (if it's not nil); that's where --timings and --trace output comes from.
+//
+// Failures of targets, and even failures to parse the make.fx file, are reported and then we keep watching.
+// This only returns if watching itself fails, or ctx is cancelled (which also interrupts any targets in progress).
+//
+// Errors:
+//
+//   - wfx-watch-unsupported -- if this platform can't watch files.
+//   - wfx-watch-failed -- if the platform's watch mechanism fails.
+func watch(ctx context.Context, targets []string, stdout, stderr io.Writer, verbosity action.Verbosity, hermetic bool, events wfxapi.EventSink, report func()) error {
+	var (
+		prog     *wfx.Program
+		plan     []string
+		reloadOn = []string{"make.fx"} // make.fx, and what its top level read.  Kept from the last successful load, if a reload fails.
+	)
+	// load (re)reads the make.fx file, evaluates its globals, and plans the targets.
+	// On failure, it reports the problem and leaves us with nothing loaded.
+	load := func() {
+		prog, plan = nil, nil
+		proj, err := wfx.Load(wfx.Options{
+			Stdout: stdout,
+			Stderr: stderr,
+			Events: events,
+
+			Verbosity: verbosity,
+			Hermetic:  hermetic,
+		})
+		if err != nil {
+			emitErrorEvent(events, err)
+			reportError(stderr, err, false)
+			return
+		}
+		pr, err := proj.Compile()
+		if err != nil {
+			emitErrorEvent(events, err)
+			reportError(stderr, err, false)
+			return
+		}
+		p, err := proj.Plan(targets)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err)
+			return
+		}
+		prog, plan = pr, p
+		reloadOn = append([]string{"make.fx"}, pr.GlobalInputs()...)
+	}
+	invoke := func(plan []string) {
+		if err := prog.Execute(ctx, plan); err != nil {
+			reportError(stderr, err, verbosity == action.VerbosityNormal)
+		}
+		if report != nil {
+			report()
+		}
+	}
+	// watchPaths is make.fx (and what its top level read), plus the inputs of everything in the plan (declared, and recorded).
+	watchPaths := func() []string {
+		paths := append([]string(nil), reloadOn...)
+		for _, name := range plan {
+			paths = append(paths, prog.Inputs(name)...)
+		}
+		return paths
+	}
+
+	load()
+	if prog != nil {
+		invoke(plan)
+	}
+	for ctx.Err() == nil {
+		watched := watchPaths()
+		w, err := fswatch.New(watched)
+		if err != nil {
+			return err
+		}
+		// Closing the watcher is how we get a blocked Next to return, when it's time to stop.
+		stop := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.Close()
+			case <-stop:
+			}
+		}()
+		fmt.Fprintf(stderr, "wfx: watching for changes...\n")
+		// Keep this watcher until what should be watched changes: when make.fx does,
+		// or when a target, re-run, reads something new (inputs are recorded as targets run; see Program.Inputs).
+		for ctx.Err() == nil {
+			changed, err := w.Next(watchDebounce)
+			if err != nil {
+				close(stop)
+				w.Close()
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+			if p := firstWithin(changed, reloadOn); p != "" {
+				fmt.Fprintf(stderr, "wfx: %s changed; reloading\n", p)
+				load()
+				if prog != nil {
+					invoke(plan)
+				}
+				break
+			}
+			if prog == nil {
+				continue
+			}
+			// Paths our own targets produced (as far as they told us) aren't news.
+			var outputs []string
+			for _, name := range plan {
+				outputs = append(outputs, prog.Record(name).Outputs()...)
+			}
+			affected := prog.Affected(plan, withoutStrings(changed, outputs))
+			if len(affected) == 0 {
+				continue
+			}
+			if events != nil {
+				for _, name := range plan {
+					if !containsString(affected, name) {
+						events.Emit(wfxapi.Event{
+							Type:   wfxapi.EventTargetSkip,
+							Target: name,
+							Reason: "inputs unchanged",
+						})
+					}
+				}
+			}
+			fmt.Fprintf(stderr, "wfx: inputs changed; re-running: %s\n", strings.Join(affected, ", "))
+			invoke(affected)
+			if !sameStringSet(watched, watchPaths()) {
+				break
+			}
+		}
+		close(stop)
+		w.Close()
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// firstWithin returns the first of the changed paths that's one of the paths, or within one of them; or "" if there's none.
+func firstWithin(changed []string, paths []string) string {
+	for _, c := range changed {
+		c = filepath.Clean(c)
+		for _, p := range paths {
+			p = filepath.Clean(p)
+			if c == p || p == "." || strings.HasPrefix(c, p+string(filepath.Separator)) {
+				return c
+			}
+		}
+	}
+	return ""
+}
+
+// sameStringSet returns true if a and b have the same strings in them, regardless of order or repetition.
+func sameStringSet(a, b []string) bool {
+	for _, x := range a {
+		if !containsString(b, x) {
+			return false
+		}
+	}
+	for _, x := range b {
+		if !containsString(a, x) {
+			return false
+		}
+	}
+	return true
+}
+
+func withoutStrings(list []string, remove []string) []string {
+	var res []string
+	for _, x := range list {
+		if !containsString(remove, x) {
+			res = append(res, x)
+		}
+	}
+	return res
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+package mainlib
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/timings"
+)
+
+// syncBuffer is a bytes.Buffer that's safe to write and read at the same time.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits until s contains want n times.
+func waitFor(t *testing.T, what string, s func() string, want string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for strings.Count(s(), want) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s; have:\n%s", what, s())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestWatchFollowsNewReads(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) {
+		qt.Assert(t, os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755), qt.IsNil)
+		qt.Assert(t, os.WriteFile(filepath.Join(dir, name), []byte(body), 0644), qt.IsNil)
+	}
+	write("make.fx", `
+def show(fx):
+	name = read_file("which.txt").strip()
+	cmd("echo got " + read_file(name).strip())
+`)
+	write("which.txt", "a.txt\n")
+	write("a.txt", "A\n")
+	write("sub/b.txt", "B\n")
+	wd, err := os.Getwd()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.Chdir(dir), qt.IsNil)
+	defer os.Chdir(wd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout, stderr syncBuffer
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, []string{"show"}, &stdout, &stderr, action.VerbosityVerbose, false, nil, nil)
+	}()
+	defer func() {
+		cancel()
+		qt.Check(t, <-done, qt.IsNil)
+	}()
+
+	waitFor(t, "the first run", stdout.String, "got A", 1)
+	waitFor(t, "the watcher", stderr.String, "watching for changes", 1)
+	write("which.txt", "sub/b.txt\n")
+	waitFor(t, "the re-run", stdout.String, "got B", 1)
+	// Now sub/b.txt is an input, so the watcher's rebuilt to include it.
+	waitFor(t, "the new watcher", stderr.String, "watching for changes", 2)
+	write("sub/b.txt", "B2\n")
+	waitFor(t, "the re-run for the newly read file", stdout.String, "got B2", 1)
+}
+
+func TestWatchReportsEachRun(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "make.fx"), []byte(`
+def show(fx, fx_inputs=["in.txt"]):
+	cmd("cat in.txt")
+`), 0644), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "in.txt"), []byte("one\n"), 0644), qt.IsNil)
+	wd, err := os.Getwd()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.Chdir(dir), qt.IsNil)
+	defer os.Chdir(wd)
+
+	recorder := &timings.Recorder{}
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout, stderr syncBuffer
+	report := func() {
+		recorder.WriteSummary(&stderr, 5)
+		recorder.Reset()
+	}
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, []string{"show"}, &stdout, &stderr, action.VerbosityVerbose, false, recorder, report)
+	}()
+	defer func() {
+		cancel()
+		qt.Check(t, <-done, qt.IsNil)
+	}()
+
+	waitFor(t, "the first run", stdout.String, "one", 1)
+	waitFor(t, "the watcher", stderr.String, "watching for changes", 1)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "in.txt"), []byte("two\n"), 0644), qt.IsNil)
+	waitFor(t, "the re-run", stdout.String, "two", 1)
+	// Each run gets its own report, about just that run.
+	waitFor(t, "the reports", stderr.String, "targets (slowest 1 of 1)", 2)
+	qt.Check(t, stderr.String(), qt.Not(qt.Contains), "of 2")
+}
+
+func TestWatchReloadsOnGlobalInputs(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "make.fx"), []byte(`
+VERSION = read_file("VERSION").strip()
+
+def show(fx):
+	cmd("echo version " + VERSION)
+`), 0644), qt.IsNil)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.0\n"), 0644), qt.IsNil)
+	wd, err := os.Getwd()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, os.Chdir(dir), qt.IsNil)
+	defer os.Chdir(wd)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout, stderr syncBuffer
+	done := make(chan error)
+	go func() {
+		done <- watch(ctx, []string{"show"}, &stdout, &stderr, action.VerbosityVerbose, false, nil, nil)
+	}()
+	defer func() {
+		cancel()
+		qt.Check(t, <-done, qt.IsNil)
+	}()
+
+	waitFor(t, "the first run", stdout.String, "version 1.0", 1)
+	waitFor(t, "the watcher", stderr.String, "watching for changes", 1)
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "VERSION"), []byte("2.0\n"), 0644), qt.IsNil)
+	waitFor(t, "the reload", stdout.String, "version 2.0", 1)
+	qt.Check(t, stderr.String(), qt.Contains, "wfx: VERSION changed; reloading\n")
+}
@@ -3,9 +3,9 @@ module github.com/warptools/wfx
 go 1.19
 
 require (
-	github.com/dominikbraun/graph v0.12.0
 	github.com/frankban/quicktest v1.14.3
 	github.com/jawher/mow.cli v1.2.0
+	github.com/klauspost/compress v1.15.0
 	github.com/serum-errors/go-serum v0.8.0
 	github.com/warpfork/go-testmark v0.10.0
 	go.starlark.net v0.0.0-20220928063852-5fccb4daaf6d
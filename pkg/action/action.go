@@ -1,8 +1,12 @@
 package action
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/serum-errors/go-serum"
 	"go.starlark.net/starlark"
@@ -32,10 +36,11 @@ import (
 //
 // Stdout (unless rewired by a piping) goes to dev null, unless verbose mode is on; then, it's decorated and emitted to the user.
 // Stderr goes to dev null, unless the action fails; then it's likely to get included in the error message.
+// (See Verbosity for the modes that are available.)
 //
 // Most ActionPlan are produced by builtin constructors, but they can be defined in Starlark code too.
 // The main reason to consider doing so is to take advantage of the IO streaming conventions, so that the Starlark code can be composed with "pipe" and other action controllers.
-// (Not yet implemented!)
+// See ActionPlanConstructor (which is `action(fn)` in scripts).
 type ActionPlan struct {
 	// The big question is... do we make this golang-first?  Or starlark-first?
 	// Leaning towards golang-first, because... we need firstclass awareness of the IO streams, and I want them to be fast by default.
@@ -66,9 +71,10 @@ type ActionPlan struct {
 	Stdin     io.ReadCloser
 	Stdout    io.WriteCloser
 	Stderr    io.WriteCloser
-	IsExec    bool             // if two siblings in a pipe are both true for this, use MkPipe to wire them together instead of application level buffer bouncing.
-	Run       func() error     // note: do be prepared for this to be run in a goroutine; it very well might be (e.g. pipe will tend to do this); or, it might not.
-	Ignorable func(error) bool // NYI.  we'll see if this is a plausible idea or not.
+	IsExec    bool                            // if two siblings in a pipe are both true for this, use MkPipe to wire them together instead of application level buffer bouncing.
+	Run       func(ctx context.Context) error // note: do be prepared for this to be run in a goroutine; it very well might be (e.g. pipe will tend to do this); or, it might not.  If ctx is cancelled, stop promptly (see also RunCommand).
+	Process   *os.ProcessState                // set by Run, for actions backed by a process, once it has exited.  Used for reporting (e.g. CPU times).
+	Ignorable func(error) bool                // NYI.  we'll see if this is a plausible idea or not.
 }
 
 func (a *ActionPlan) Name() string { return "ActionPlan" + a.Name_ }
@@ -84,6 +90,70 @@ func (a *ActionPlan) Freeze()               {}
 func (a *ActionPlan) Truth() starlark.Bool  { return starlark.True }
 func (a *ActionPlan) Hash() (uint32, error) { return 0, nil }
 
+// InheritIO hands the IO wiring of from (an action that wraps this one, like a controller) down to this action,
+// so that the wrapper is transparent: in a pipe, the inner action reads and writes where the wrapper would have.
+// Call it in the wrapper's Run, since that's when the wiring is known.
+func (a *ActionPlan) InheritIO(from *ActionPlan) {
+	a.Stdin, a.Stdout, a.Stderr = from.Stdin, from.Stdout, from.Stderr
+}
+
+// PlanMaker is implemented by the builtins that return an *ActionPlan when they're called (which then runs only when it's executed),
+// as opposed to those that do what they do right away (like `pipe`, or `warpforge_run`).
+// Lint uses it to tell which calls make plans.
+type PlanMaker interface {
+	starlark.Callable
+	MakesPlan()
+}
+
+// Execute runs the action.
+// Controllers and `do` should use this rather than calling Run directly,
+// because this is also where events are emitted, if the thread has an event sink (in the "events" thread local).
+//
+// The ctx is handed to Run.  `do` uses the thread's Context; controllers pass on whatever they were given (or something derived from it).
+func (a *ActionPlan) Execute(ctx context.Context, thread *starlark.Thread) error {
+	sink, _ := thread.Local("events").(wfxapi.EventSink)
+	if sink == nil {
+		return a.Run(ctx)
+	}
+	ev := wfxapi.Event{
+		Target: targetName(thread),
+		Action: a.Name_,
+		Label:  a.Label,
+	}
+	if a.IsExec {
+		ev.Cmd, _ = a.Details.(string)
+	}
+	ev.Type = wfxapi.EventActionStart
+	ev.Time = time.Now()
+	sink.Emit(ev)
+
+	err := a.Run(ctx)
+
+	ev.Type = wfxapi.EventActionFinish
+	ev.Duration = wfxapi.DurationMillis(time.Since(ev.Time))
+	ev.Time = time.Now()
+	ev.Error = wfxapi.NewEventErrorInfo(err)
+	if a.Process != nil {
+		ev.UserTime = wfxapi.DurationMillis(a.Process.UserTime())
+		ev.SysTime = wfxapi.DurationMillis(a.Process.SystemTime())
+	}
+	if a.IsExec {
+		if err == nil {
+			ev.ExitCode = new(int)
+		} else if code, convErr := strconv.Atoi(serum.Detail(err, "exitcode")); convErr == nil {
+			ev.ExitCode = &code
+		}
+	}
+	sink.Emit(ev)
+	return err
+}
+
+// targetName returns the name of the target the thread is evaluating (from the "target" thread local), or empty string.
+func targetName(thread *starlark.Thread) string {
+	name, _ := thread.Local("target").(string)
+	return name
+}
+
 var _ starlark.Callable = (*Do)(nil)
 
 type Do struct{}
@@ -92,7 +162,7 @@ func (a *Do) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs [
 	switch len(args) {
 	case 1:
 		if ap, ok := args[0].(*ActionPlan); ok {
-			return starlark.None, ap.Run()
+			return starlark.None, ap.Execute(Context(thread), thread)
 		}
 		// Do nothing if we weren't invoked on an ActionPlan; important to be silent, since we get blindly decorated on many things.
 		//   FIXME: maybe break the silent chill mode into a separate function.  give the starlark code one that's loud.
@@ -1,11 +1,12 @@
 package action
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"os/exec"
 	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/serum-errors/go-serum"
 	"go.starlark.net/starlark"
@@ -13,49 +14,85 @@ import (
 	"github.com/warptools/wfx/pkg/wfxapi"
 )
 
-var _ starlark.Callable = (*CmdPlanConstructor)(nil)
+var (
+	_ starlark.Callable = (*CmdPlanConstructor)(nil)
+	_ starlark.HasAttrs = (*CmdPlanConstructor)(nil)
+)
 
+// CmdPlanConstructor is `cmd(incantation, timeout=?, sandbox=?)`: it produces an action that runs the incantation with a shell.
+//
+// With `sandbox=True`, the command runs in a sandbox where it can only write the outputs its target declares (its "fx_files"); see Sandbox.
+// (Within `sandboxed(...)`, commands are sandboxed as that says, whether they ask to be or not.)
+//
+// `cmd.customize(shell=?, timeout=?)` returns another cmd constructor, with different defaults:
+// for example, `slow_cmd = cmd.customize(timeout="10m")`.
 type CmdPlanConstructor struct {
-	interpreter string // "/bin/bash" by default.
-
-	// we'll probably put a callable field on this for a "customize" method.  future work.
+	interpreter string        // "/bin/bash" by default.
+	timeout     time.Duration // zero means no time limit.
 }
 
 func (a *CmdPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
-	a.init()
-
-	switch len(args) {
-	case 1:
-		incantation := string(args[0].(starlark.String))
-		ap := &ActionPlan{
-			Name_:   "Cmd",
-			Details: incantation,
-			IsExec:  true,
+	if len(args) != 1 {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`cmd` actions expect exactly one positional arg, which should be a string")
+	}
+	var incantation, timeoutStr string
+	var sandbox bool
+	if err := UnpackArgs("cmd", args, kwargs, "incantation", &incantation, "timeout?", &timeoutStr, "sandbox?", &sandbox); err != nil {
+		return starlark.None, err
+	}
+	timeout := a.timeout
+	if timeoutStr != "" {
+		var err error
+		if timeout, err = ParseTimeout("cmd", timeoutStr); err != nil {
+			return starlark.None, err
 		}
-		ap.Run = func() error {
-			cmd := exec.Command(a.interpreter, "-c", incantation)
-			// Copy any IO handles that have been mutated onto the ActionPlan into the exec cmd var.
-			// Otherwise get default IO handles from the thread locals (which currently means more or less "all the way to the user terminal").
-			if ap.Stdin != nil {
-				cmd.Stdin = ap.Stdin
-			}
-			if ap.Stdout != nil {
-				cmd.Stdout = ap.Stdout
-				defer ap.Stdout.Close()
-			} else {
-				cmd.Stdout = thread.Local("stdout").(io.Writer)
-			}
-			if ap.Stderr != nil {
-				cmd.Stderr = ap.Stderr
-			} else {
-				cmd.Stderr = thread.Local("stderr").(io.Writer)
+	}
+	interpreter := a.shell()
+	ap := &ActionPlan{
+		Name_:   "Cmd",
+		Details: incantation,
+		IsExec:  true,
+	}
+	ap.Run = func(ctx context.Context) error {
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		cmd := exec.Command(interpreter, "-c", incantation)
+		cmd.Dir = WorkDir(thread)
+		cmd.Env = Environ(ctx, thread)
+		// Use any IO handles that have been mutated onto the ActionPlan (e.g. by a pipe).
+		// Otherwise get default IO handles according to the thread's verbosity (which means stdout is discarded, and stderr is kept for the error, unless verbose).
+		streams := ap.Streams(thread)
+		if ap.Stdin != nil {
+			cmd.Stdin = streams.Stdin
+		}
+		cmd.Stdout = streams.Stdout
+		cmd.Stderr = streams.Stderr
+		sb := SandboxOf(ctx)
+		if sb == nil && sandbox {
+			sb = &Sandbox{RW: Outputs(thread), Network: true}
+		}
+		start := time.Now()
+		problem, err := runProcessIn(ctx, cmd, sb)
+		ap.Process = cmd.ProcessState
+		stderrTail := streams.Close()
+		shown := SecretsOf(thread).Redact(incantation) // The incantation may have had secrets interpolated into it.
+		if problem != "" {
+			return errorSandboxUnavailable(shown, problem)
+		}
+		if err != nil && TimedOut(ctx) {
+			return errorCmdTimeout(shown, time.Since(start), stderrTail)
+		}
+		if err != nil && sb != nil {
+			if err := errorSandboxViolation(shown, stderrTail); err != nil {
+				return err
 			}
-			return a.processExecError(cmd.Run(), incantation)
 		}
-		return ap, nil
-	default:
-		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`cmd` actions expect exactly one positional arg, which should be a string")
+		return a.processExecError(err, shown, stderrTail)
 	}
+	return ap, nil
 }
 
 func (a *CmdPlanConstructor) Name() string          { return "cmd()" }
@@ -64,35 +101,73 @@ func (a *CmdPlanConstructor) Type() string          { return "<actionPlanConstru
 func (a *CmdPlanConstructor) Freeze()               {}
 func (a *CmdPlanConstructor) Truth() starlark.Bool  { return starlark.True }
 func (a *CmdPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *CmdPlanConstructor) MakesPlan()            {}
+func (a *CmdPlanConstructor) AttrNames() []string   { return []string{"customize"} }
+func (a *CmdPlanConstructor) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "customize":
+		return starlark.NewBuiltin("customize", a.customize), nil
+	}
+	return nil, nil
+}
+
+func (a *CmdPlanConstructor) customize(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var shell, timeoutStr string
+	if err := UnpackArgs("cmd.customize", args, kwargs, "shell?", &shell, "timeout?", &timeoutStr); err != nil {
+		return starlark.None, err
+	}
+	res := *a
+	if shell != "" {
+		res.interpreter = shell
+	}
+	if timeoutStr != "" {
+		var err error
+		if res.timeout, err = ParseTimeout("cmd.customize", timeoutStr); err != nil {
+			return starlark.None, err
+		}
+	}
+	return &res, nil
+}
 
-func (a *CmdPlanConstructor) init() {
+func (a *CmdPlanConstructor) shell() string {
 	if a.interpreter == "" {
-		a.interpreter = "/bin/bash"
+		return "/bin/bash"
 	}
+	return a.interpreter
 }
 
-func (CmdPlanConstructor) processExecError(original error, incantation string) error {
+// processExecError turns errors from exec into our serum errors.
+// If the stderrTail is nonempty, it's attached to the error as the "stderr" detail.
+func (CmdPlanConstructor) processExecError(original error, incantation string, stderrTail string) error {
 	switch e2 := original.(type) {
 	case nil:
 		return nil
 	case *exec.ExitError:
 		if e2.Exited() { // true means code; false means signal
 			code := e2.ExitCode() // I don't think this exists on windows.  Ignoring for now; platform support can be "future work".
-			return serum.Error(wfxapi.EcodeActionCmdExit,
+			return serum.Error(wfxapi.EcodeActionCmdExit, withStderrTail(stderrTail,
 				serum.WithMessageTemplate("cmd {{cmd|q}} exited with code {{exitcode}}"),
 				serum.WithDetail("cmd", incantation),
 				serum.WithDetail("exitcode", strconv.Itoa(code)),
-			)
+			)...)
 		} else {
 			signal := int(e2.Sys().(syscall.WaitStatus).Signal())
-			return serum.Error(wfxapi.EcodeActionCmdExit,
+			return serum.Error(wfxapi.EcodeActionCmdExit, withStderrTail(stderrTail,
 				serum.WithMessageTemplate("cmd {{cmd|q}} exited due to signal {{signal}}"),
 				serum.WithDetail("cmd", incantation),
 				serum.WithDetail("signal", strconv.Itoa(signal)),
-			)
+			)...)
 		}
-		// fun fact: you can report `e2.SystemTime()` and `e2.UserTime()`, too.  Might be worth making this loggable.
+		// fun fact: `e2.SystemTime()` and `e2.UserTime()` are available here too.  (They're reported in events, via ActionPlan.Process.)
 	default:
 		panic(fmt.Errorf("wfx: unknown error from process exec library: %T %w", original, original))
 	}
 }
+
+// withStderrTail appends a "stderr" detail to the error construction params, if there's any stderr to report.
+func withStderrTail(stderrTail string, params ...serum.WithConstruction) []serum.WithConstruction {
+	if stderrTail == "" {
+		return params
+	}
+	return append(params, serum.WithDetail("stderr", stderrTail))
+}
@@ -1,6 +1,7 @@
 package action
 
 import (
+	"context"
 	"io"
 	"sync"
 
@@ -99,7 +100,7 @@ func (a *PipeControllerConstructor) CallInternal(thread *starlark.Thread, args s
 		i, arg := i, arg
 		go func() {
 			//fmt.Printf("::: launching %s\n", arg.(*ActionPlan).String())
-			results[i] = arg.(*ActionPlan).Run()
+			results[i] = arg.(*ActionPlan).Execute(Context(thread), thread)
 			// We attempt to keep the first error.
 			// This is pretty best-effort.  Fundamentally, there's a lack of synchronization at the kernel interface which lets us reliably know which process exited first.
 			// We *hope* to get it close enough, and we *hope* that the first error we see is the most meaningful one (e.g., the one that's not complaining about pipes that are broken by other commands already exiting unexpectedly!),
@@ -123,3 +124,38 @@ func (a *PipeControllerConstructor) Type() string          { return "<action:pip
 func (a *PipeControllerConstructor) Freeze()               {}
 func (a *PipeControllerConstructor) Truth() starlark.Bool  { return starlark.True }
 func (a *PipeControllerConstructor) Hash() (uint32, error) { return 0, nil }
+
+var _ starlark.Callable = (*IgnorantlyControllerConstructor)(nil)
+
+// IgnorantlyControllerConstructor is `ignorantly(act)`:
+// it produces an action that runs the given action, and succeeds regardless of whether that action did.
+// (Errors are still reported in events, if those are enabled; they just don't halt anything.)
+type IgnorantlyControllerConstructor struct{}
+
+func (a *IgnorantlyControllerConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(args) != 1 || len(kwargs) != 0 {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`ignorantly` expects exactly one positional arg, which should be an ActionPlan")
+	}
+	inner, ok := args[0].(*ActionPlan)
+	if !ok {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`ignorantly` expects exactly one positional arg, which should be an ActionPlan")
+	}
+	ap := &ActionPlan{
+		Name_:   "Ignorantly",
+		Details: inner,
+	}
+	ap.Run = func(ctx context.Context) error {
+		inner.InheritIO(ap)
+		_ = inner.Execute(ctx, thread)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *IgnorantlyControllerConstructor) Name() string          { return "ignorantly()" }
+func (a *IgnorantlyControllerConstructor) String() string        { return "ignorantly()" }
+func (a *IgnorantlyControllerConstructor) Type() string          { return "<action:ignorantly>" }
+func (a *IgnorantlyControllerConstructor) Freeze()               {}
+func (a *IgnorantlyControllerConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *IgnorantlyControllerConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *IgnorantlyControllerConstructor) MakesPlan()            {}
@@ -0,0 +1,199 @@
+package action
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// The environment actions run in -- working directory and environment variables --
+// is normally just the process's own.
+// Embedders can give each evaluation its own, with the "dir" and "env" thread locals
+// (and a context, with the "ctx" thread local, which can be cancelled to interrupt it);
+// and controllers (like `env`) can change the environment variables for the actions they control, with WithEnv.
+// Actions should use the helpers here rather than relying on the process's working directory or environment.
+
+// Context returns the context that actions started by the thread should run under (from the "ctx" thread local).
+// Cancelling it is how an evaluation is interrupted.  If there's none, it's context.Background.
+func Context(thread *starlark.Thread) context.Context {
+	if ctx, ok := thread.Local("ctx").(context.Context); ok {
+		return ctx
+	}
+	return context.Background()
+}
+
+// WorkDir returns the directory actions should work in (from the "dir" thread local).
+// Empty means the process's working directory.
+func WorkDir(thread *starlark.Thread) string {
+	dir, _ := thread.Local("dir").(string)
+	return dir
+}
+
+type envKey struct{}
+
+// WithEnv returns a context under which actions get env as their environment variables (instead of what the thread says).
+func WithEnv(ctx context.Context, env []string) context.Context {
+	return context.WithValue(ctx, envKey{}, env)
+}
+
+// Environ returns the environment variables that processes started by actions should get
+// (from the ctx, if a controller has set them there with WithEnv; otherwise from the "env" thread local),
+// in the same "KEY=value" form as os.Environ.
+// Nil means they inherit the process's environment.
+func Environ(ctx context.Context, thread *starlark.Thread) []string {
+	if env, ok := ctx.Value(envKey{}).([]string); ok {
+		return env
+	}
+	env, _ := thread.Local("env").([]string)
+	return env
+}
+
+// resolvePath returns the path to use for a path given by the script: relative paths are taken relative to WorkDir.
+// Error messages and records should still use the path as the script gave it.
+func resolvePath(thread *starlark.Thread, path string) string {
+	dir := WorkDir(thread)
+	if dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// getenv is like os.Getenv, but looks in the Environ, if there is one.
+func getenv(ctx context.Context, thread *starlark.Thread, key string) string {
+	env := Environ(ctx, thread)
+	if env == nil {
+		return os.Getenv(key)
+	}
+	return lookupEnv(env, key)
+}
+
+// lookupEnv returns the value of key in env (in "KEY=value" form), or empty string if it's not there.
+func lookupEnv(env []string, key string) string {
+	for i := len(env) - 1; i >= 0; i-- { // Last one wins, as with exec.Cmd.Env.
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// EditEnv returns a copy of env (in "KEY=value" form, where nil means the process's environment),
+// with the variables in set set, and the ones named in unset removed.
+// Variables keep their place; new ones are added at the end, in sorted order.
+func EditEnv(env []string, set map[string]string, unset []string) []string {
+	if env == nil {
+		env = os.Environ()
+	}
+	res := make([]string, 0, len(env)+len(set))
+	done := make(map[string]bool, len(set))
+	for _, kv := range env {
+		k, _, _ := strings.Cut(kv, "=")
+		if containsString(unset, k) || done[k] {
+			continue
+		}
+		if v, ok := set[k]; ok {
+			kv = k + "=" + v
+			done[k] = true
+		}
+		res = append(res, kv)
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		if !done[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		res = append(res, k+"="+set[k])
+	}
+	return res
+}
+
+var _ starlark.Callable = (*EnvControllerConstructor)(nil)
+
+// EnvControllerConstructor is `env(act, vars={}, unset=[], sensitive=[])`:
+// it produces an action that runs the given action with some environment variables set (vars), and others removed (unset).
+// This is the most specific way to set environment variables, so it overrides everything else (the project's `ENV`, `.env`, etc).
+//
+// The values of variables named in sensitive are secrets: they're redacted from output and errors from then on (see Secrets).
+// (They may be set here, or anywhere else.)
+type EnvControllerConstructor struct{}
+
+func (a *EnvControllerConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var inner *ActionPlan
+	var vars *starlark.Dict
+	var unset, sensitive *starlark.List
+	if err := UnpackArgs("env", args, kwargs, "act", &inner, "vars?", &vars, "unset?", &unset, "sensitive?", &sensitive); err != nil {
+		return starlark.None, err
+	}
+	set := map[string]string{}
+	if vars != nil {
+		for _, item := range vars.Items() {
+			k, ok1 := item[0].(starlark.String)
+			v, ok2 := item[1].(starlark.String)
+			if !ok1 || !ok2 {
+				return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`env` expects vars to be a dict of strings to strings, but found %s: %s", item[0].Type(), item[1].Type())
+			}
+			set[string(k)] = string(v)
+		}
+	}
+	unsetNames, err := stringList("env", "unset", unset)
+	if err != nil {
+		return starlark.None, err
+	}
+	sensitiveNames, err := stringList("env", "sensitive", sensitive)
+	if err != nil {
+		return starlark.None, err
+	}
+	ap := &ActionPlan{
+		Name_:   "Env",
+		Details: inner,
+	}
+	ap.Run = func(ctx context.Context) error {
+		env := EditEnv(Environ(ctx, thread), set, unsetNames)
+		for _, name := range sensitiveNames {
+			if v := lookupEnv(env, name); v != "" {
+				SecretsOf(thread).Add(v)
+			}
+		}
+		inner.InheritIO(ap)
+		return inner.Execute(WithEnv(ctx, env), thread)
+	}
+	return ap, nil
+}
+
+func (a *EnvControllerConstructor) Name() string          { return "env()" }
+func (a *EnvControllerConstructor) String() string        { return "env()" }
+func (a *EnvControllerConstructor) Type() string          { return "<action:env>" }
+func (a *EnvControllerConstructor) Freeze()               {}
+func (a *EnvControllerConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *EnvControllerConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *EnvControllerConstructor) MakesPlan()            {}
+
+// stringList converts an optional list of strings given to fnName as its param.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if anything in the list isn't a string.
+func stringList(fnName, param string, list *starlark.List) ([]string, error) {
+	if list == nil {
+		return nil, nil
+	}
+	res := make([]string, list.Len())
+	for i := range res {
+		s, ok := list.Index(i).(starlark.String)
+		if !ok {
+			return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "`%s` expects %s to be a list of strings, but found a %s", fnName, param, list.Index(i).Type())
+		}
+		res[i] = string(s)
+	}
+	return res, nil
+}
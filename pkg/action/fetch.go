@@ -0,0 +1,309 @@
+package action
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Fetching is content-addressed: the caller says what hash they expect, and that's what identifies the content.
+The URLs are just places to try getting it from.
+
+Everything fetched is kept in a cache, keyed by hash, so once something has been fetched once, it's never fetched again
+(and a fetch whose content is already cached doesn't need the network at all).
+The cache is in "wfx/sha256/" under the user's cache dir (see os.UserCacheDir), unless the WFX_CACHE_DIR environment variable says otherwise.
+Content only enters the cache after its hash has been verified, so the cache can be trusted.
+*/
+
+var _ starlark.Callable = (*FetchPlanConstructor)(nil)
+
+// FetchPlanConstructor is `fetch(url, sha256, dest, mirrors=[], mode=0o644)`.
+//
+// The url, and then each of the mirrors in order, are tried until one of them yields content with the expected hash.
+// URLs may be "http:", "https:", or "file:" URLs.
+// File URLs may be absolute ("file:///srv/thing.tgz") or relative to the working directory ("file:thing.tgz").
+//
+// The dest file is only touched if it doesn't already have the expected content.
+// It's recorded as an output of the target.
+type FetchPlanConstructor struct {
+	// Client is used for http and https URLs.  If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// CacheDir overrides where the cache is.  If empty, the default described above is used.
+	CacheDir string
+}
+
+func (a *FetchPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var rawURL, hash, dest string
+	var mirrors *starlark.List
+	mode := 0644
+	if err := starlark.UnpackArgs("fetch", args, kwargs, "url", &rawURL, "sha256", &hash, "dest", &dest, "mirrors?", &mirrors, "mode?", &mode); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	if _, err := hex.DecodeString(hash); err != nil || len(hash) != sha256.Size*2 {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`fetch` expects sha256 to be a hash in hex (64 characters), not %q", hash)
+	}
+	hash = strings.ToLower(hash)
+	urls := []string{rawURL}
+	if mirrors != nil {
+		for i := 0; i < mirrors.Len(); i++ {
+			s, ok := mirrors.Index(i).(starlark.String)
+			if !ok {
+				return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`fetch` expects mirrors to be a list of strings, but found a %s", mirrors.Index(i).Type())
+			}
+			urls = append(urls, string(s))
+		}
+	}
+	for _, u := range urls {
+		if _, err := parseFetchURL(u); err != nil {
+			return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`fetch` cannot use url %q: %s", u, err)
+		}
+	}
+
+	ap := &ActionPlan{
+		Name_:   "Fetch",
+		Details: rawURL + " -> " + dest,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		cacheDir, err := a.cacheDir(ctx, thread)
+		if err != nil {
+			return Error(wfxapi.EcodeActionFetch, "fetch", err, "sha256", hash, "dest", dest)
+		}
+		cached, err := fetchToCache(ctx, a.client(), cacheDir, WorkDir(thread), urls, hash)
+		if err != nil {
+			return err
+		}
+		if err := installFile(cached, resolvePath(thread, dest), hash, fs.FileMode(mode)); err != nil {
+			return Error(wfxapi.EcodeActionFetch, "fetch", err, "sha256", hash, "dest", dest)
+		}
+		RecordOf(thread).AddOutput(dest)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *FetchPlanConstructor) Name() string          { return "fetch()" }
+func (a *FetchPlanConstructor) String() string        { return "fetch()" }
+func (a *FetchPlanConstructor) Type() string          { return "<actionPlanConstructor:fetch>" }
+func (a *FetchPlanConstructor) Freeze()               {}
+func (a *FetchPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *FetchPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *FetchPlanConstructor) MakesPlan()            {}
+
+func (a *FetchPlanConstructor) client() *http.Client {
+	if a.Client != nil {
+		return a.Client
+	}
+	return http.DefaultClient
+}
+
+func (a *FetchPlanConstructor) cacheDir(ctx context.Context, thread *starlark.Thread) (string, error) {
+	if a.CacheDir != "" {
+		return a.CacheDir, nil
+	}
+	if dir := getenv(ctx, thread, "WFX_CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "wfx"), nil
+}
+
+// fetchToCache makes sure the content with the given hash is in the cache, trying each of the urls in turn if it's not,
+// and returns the path to it in the cache.
+// Relative file URLs are relative to workDir (or the process's working directory, if that's empty).
+// If ctx is cancelled, the download in progress is abandoned, and no more urls are tried.
+//
+// Errors:
+//
+//   - wfx-action-error-fetch -- if none of the urls could be fetched, or the cache couldn't be written.
+//   - wfx-action-error-fetch-hashmismatch -- if any of the urls yielded content with the wrong hash (and none yielded the right content).
+func fetchToCache(ctx context.Context, client *http.Client, cacheDir string, workDir string, urls []string, hash string) (string, error) {
+	cached := filepath.Join(cacheDir, "sha256", hash)
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return "", Error(wfxapi.EcodeActionFetch, "fetch", err, "sha256", hash)
+	}
+	var failures []string
+	var mismatch bool
+	for _, u := range urls {
+		if ctx.Err() != nil {
+			return "", Error(wfxapi.EcodeActionFetch, "fetch", ctx.Err(), "sha256", hash)
+		}
+		actual, err := fetchOne(ctx, client, workDir, u, cached)
+		switch {
+		case err != nil:
+			failures = append(failures, u+": "+err.Error())
+		case actual != hash:
+			failures = append(failures, u+": got content with sha256 "+actual)
+			mismatch = true
+		default:
+			return cached, nil
+		}
+	}
+	ecode := wfxapi.EcodeActionFetch
+	if mismatch {
+		ecode = wfxapi.EcodeActionFetchHashMismatch
+	}
+	return "", serum.Error(ecode,
+		serum.WithMessageTemplate("fetch sha256={{sha256|q}} failed: {{reason}}"),
+		serum.WithDetail("sha256", hash),
+		serum.WithDetail("reason", strings.Join(failures, "; ")),
+	)
+}
+
+// fetchOne downloads one url into a temp file next to the cache path, and returns the sha256 of what it got.
+// Only if that's the hash the cache path is named for does it move the content into place.
+func fetchOne(ctx context.Context, client *http.Client, workDir string, rawURL string, cached string) (string, error) {
+	u, err := parseFetchURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+	var body io.ReadCloser
+	switch u.Scheme {
+	case "file":
+		p := u.Path
+		if u.Opaque != "" {
+			p = u.Opaque
+			if workDir != "" {
+				p = filepath.Join(workDir, p)
+			}
+		}
+		body, err = os.Open(p)
+		if err != nil {
+			return "", unwrapPathError(err)
+		}
+	default:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return "", fmt.Errorf("http status %s", resp.Status)
+		}
+		body = resp.Body
+	}
+	defer body.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(cached), ".fetch-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name()) // No-op if it's been renamed into place.
+	hasher := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hasher), body); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	actual := hex.EncodeToString(hasher.Sum(nil))
+	if actual != filepath.Base(cached) {
+		return actual, nil
+	}
+	if err := os.Chmod(tmp.Name(), 0444); err != nil {
+		return "", err
+	}
+	return actual, os.Rename(tmp.Name(), cached)
+}
+
+func parseFetchURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "file":
+		return u, nil
+	default:
+		return nil, errors.New("only http, https, and file URLs are supported")
+	}
+}
+
+// installFile copies src to dst, unless dst already has the expected hash (in which case, at most its mode is changed).
+// The copy is written to a temp file next to dst, and renamed into place.
+func installFile(src, dst string, hash string, mode fs.FileMode) error {
+	if fi, err := os.Stat(dst); err == nil && fi.Mode().IsRegular() {
+		if actual, err := hashFile(dst); err == nil && actual == hash {
+			if fi.Mode().Perm() == mode.Perm() {
+				return nil
+			}
+			return os.Chmod(dst, mode.Perm())
+		}
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(dst)+".wfx-tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op if it's been renamed into place.
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// hashFile returns the sha256 of a file's content, in hex.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// unwrapPathError returns just the underlying error of a *fs.PathError (e.g. "no such file or directory"), if it is one.
+// Useful when the path is already going to be mentioned by whatever reports the error.
+func unwrapPathError(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
@@ -0,0 +1,91 @@
+package action
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+func TestFetch(t *testing.T) {
+	content := []byte("some content worth fetching\n")
+	sum := sha256.Sum256(content)
+	hash := hex.EncodeToString(sum[:])
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		switch r.URL.Path {
+		case "/good":
+			w.Write(content)
+		case "/wrong":
+			w.Write([]byte("not the content you're looking for\n"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	fetcher := &FetchPlanConstructor{Client: srv.Client(), CacheDir: filepath.Join(dir, "cache")}
+	fetch := func(t *testing.T, dest string, url string, mirrors ...string) error {
+		t.Helper()
+		mirrorList := starlark.NewList(nil)
+		for _, m := range mirrors {
+			mirrorList.Append(starlark.String(m))
+		}
+		ap, err := fetcher.CallInternal(&starlark.Thread{}, nil, []starlark.Tuple{
+			{starlark.String("url"), starlark.String(url)},
+			{starlark.String("sha256"), starlark.String(hash)},
+			{starlark.String("dest"), starlark.String(filepath.Join(dir, dest))},
+			{starlark.String("mirrors"), mirrorList},
+		})
+		qt.Assert(t, err, qt.IsNil)
+		return ap.(*ActionPlan).Run(context.Background())
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		err := fetch(t, "nope", srv.URL+"/wrong")
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionFetchHashMismatch)
+		_, statErr := os.Stat(filepath.Join(dir, "cache", "sha256", hash))
+		qt.Assert(t, os.IsNotExist(statErr), qt.IsTrue)
+	})
+	t.Run("notfound", func(t *testing.T) {
+		err := fetch(t, "nope", srv.URL+"/missing")
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionFetch)
+	})
+	t.Run("mirrors", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		err := fetch(t, "a", srv.URL+"/missing", srv.URL+"/wrong", srv.URL+"/good")
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, atomic.LoadInt32(&hits), qt.Equals, int32(3))
+		got, _ := os.ReadFile(filepath.Join(dir, "a"))
+		qt.Assert(t, got, qt.DeepEquals, content)
+	})
+	t.Run("cached", func(t *testing.T) {
+		atomic.StoreInt32(&hits, 0)
+		err := fetch(t, "b", srv.URL+"/good")
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, atomic.LoadInt32(&hits), qt.Equals, int32(0))
+		got, _ := os.ReadFile(filepath.Join(dir, "b"))
+		qt.Assert(t, got, qt.DeepEquals, content)
+	})
+	t.Run("file", func(t *testing.T) {
+		fetcher.CacheDir = filepath.Join(dir, "cache2")
+		err := fetch(t, "c", "file://"+filepath.Join(dir, "a"))
+		qt.Assert(t, err, qt.IsNil)
+		got, _ := os.ReadFile(filepath.Join(dir, "c"))
+		qt.Assert(t, got, qt.DeepEquals, content)
+	})
+}
@@ -0,0 +1,247 @@
+package action
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/template"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+The file-generating actions only touch the destination file if its content (or mode) would actually change.
+That keeps mtimes stable, which keeps anything downstream that looks at mtimes from doing needless work.
+
+When they do write, they write to a temporary file and rename it into place,
+so nothing ever sees a half-written file.
+
+The paths they write are recorded as outputs of the target (see Record).
+*/
+
+var _ starlark.Callable = (*WriteFilePlanConstructor)(nil)
+
+// WriteFilePlanConstructor is `write_file(path, content, mode=0o644)`.
+//
+// If content is omitted, the action's stdin is used instead -- so it can be the last stage of a pipe:
+// `pipe(cmd("ls"), write_file("listing.txt"))`.
+// Parent directories are created as needed.
+type WriteFilePlanConstructor struct{}
+
+func (a *WriteFilePlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	var content starlark.Value
+	mode := 0644
+	if err := starlark.UnpackArgs("write_file", args, kwargs, "path", &path, "content?", &content, "mode?", &mode); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	var body []byte
+	switch c := content.(type) {
+	case nil:
+		// Read from stdin, when we run.
+	case starlark.String:
+		body = []byte(c)
+	case starlark.Bytes:
+		body = []byte(c)
+	default:
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`write_file` expects content to be a string or bytes, not %s", content.Type())
+	}
+	ap := &ActionPlan{
+		Name_:   "WriteFile",
+		Details: path,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		if content == nil {
+			if ap.Stdin == nil {
+				return serum.Errorf(wfxapi.EcodeScriptInvalid, "`write_file` with no content must be given stdin (e.g. by being in a pipe)")
+			}
+			var err error
+			body, err = io.ReadAll(ap.Stdin)
+			if err != nil {
+				return Error(wfxapi.EcodeActionWriteFile, "write_file", err, "path", path)
+			}
+		}
+		if err := writeFileIfChanged(resolvePath(thread, path), body, fs.FileMode(mode)); err != nil {
+			return Error(wfxapi.EcodeActionWriteFile, "write_file", err, "path", path)
+		}
+		RecordOf(thread).AddOutput(path)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *WriteFilePlanConstructor) Name() string          { return "write_file()" }
+func (a *WriteFilePlanConstructor) String() string        { return "write_file()" }
+func (a *WriteFilePlanConstructor) Type() string          { return "<actionPlanConstructor:write_file>" }
+func (a *WriteFilePlanConstructor) Freeze()               {}
+func (a *WriteFilePlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *WriteFilePlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *WriteFilePlanConstructor) MakesPlan()            {}
+
+var _ starlark.Callable = (*TemplatePlanConstructor)(nil)
+
+// TemplatePlanConstructor is `template(src, dst, vars={}, mode=0o644)`.
+//
+// The src file is a Go text/template (see https://pkg.go.dev/text/template),
+// and the vars are what it's executed on: so `{{ .name }}` in the template refers to `vars["name"]`.
+// Referring to a var that doesn't exist is an error (rather than silently producing "<no value>").
+//
+// The src file is recorded as an input of the target, and dst as an output.
+type TemplatePlanConstructor struct{}
+
+func (a *TemplatePlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var src, dst string
+	vars := &starlark.Dict{}
+	mode := 0644
+	if err := starlark.UnpackArgs("template", args, kwargs, "src", &src, "dst", &dst, "vars?", &vars, "mode?", &mode); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	data, err := toGo(vars)
+	if err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`template` vars: %s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Template",
+		Details: src + " -> " + dst,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		RecordOf(thread).AddInput(src)
+		tmplBody, err := os.ReadFile(resolvePath(thread, src))
+		if err != nil {
+			return Error(wfxapi.EcodeActionTemplate, "template", err, "src", src, "dst", dst)
+		}
+		tmpl, err := template.New(filepath.Base(src)).Option("missingkey=error").Parse(string(tmplBody))
+		if err != nil {
+			return Error(wfxapi.EcodeActionTemplate, "template", err, "src", src, "dst", dst)
+		}
+		var buf bytes.Buffer
+		if err := tmpl.Execute(&buf, data); err != nil {
+			return Error(wfxapi.EcodeActionTemplate, "template", err, "src", src, "dst", dst)
+		}
+		if err := writeFileIfChanged(resolvePath(thread, dst), buf.Bytes(), fs.FileMode(mode)); err != nil {
+			return Error(wfxapi.EcodeActionTemplate, "template", err, "src", src, "dst", dst)
+		}
+		RecordOf(thread).AddOutput(dst)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *TemplatePlanConstructor) Name() string          { return "template()" }
+func (a *TemplatePlanConstructor) String() string        { return "template()" }
+func (a *TemplatePlanConstructor) Type() string          { return "<actionPlanConstructor:template>" }
+func (a *TemplatePlanConstructor) Freeze()               {}
+func (a *TemplatePlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *TemplatePlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *TemplatePlanConstructor) MakesPlan()            {}
+
+// writeFileIfChanged makes sure the file at path has exactly the given content and permission bits,
+// touching it only if it doesn't already.
+// If only the mode differs, only the mode is changed.
+// Otherwise, the content is written to a temp file next to it, which is then renamed into place.
+func writeFileIfChanged(path string, content []byte, mode fs.FileMode) error {
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() && fi.Size() == int64(len(content)) {
+		existing, err := os.ReadFile(path)
+		if err == nil && bytes.Equal(existing, content) {
+			if fi.Mode().Perm() == mode.Perm() {
+				return nil
+			}
+			return os.Chmod(path, mode.Perm())
+		}
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".wfx-tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode.Perm()); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// toGo converts a starlark value into plain golang values
+// (maps with string keys, slices, strings, int64 or big ints, float64, bools, and nil),
+// suitable for handing to things like text/template or encoding/json.
+func toGo(v starlark.Value) (interface{}, error) {
+	switch v := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(v), nil
+	case starlark.Int:
+		if i, ok := v.Int64(); ok {
+			return i, nil
+		}
+		return v.BigInt(), nil
+	case starlark.Float:
+		return float64(v), nil
+	case starlark.String:
+		return string(v), nil
+	case starlark.Bytes:
+		return string(v), nil
+	case *starlark.List:
+		res := make([]interface{}, v.Len())
+		for i := range res {
+			x, err := toGo(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			res[i] = x
+		}
+		return res, nil
+	case starlark.Tuple:
+		res := make([]interface{}, len(v))
+		for i := range res {
+			x, err := toGo(v[i])
+			if err != nil {
+				return nil, err
+			}
+			res[i] = x
+		}
+		return res, nil
+	case *starlark.Dict:
+		res := make(map[string]interface{}, v.Len())
+		for _, item := range v.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return nil, fmt.Errorf("dict keys must be strings, not %s", item[0].Type())
+			}
+			x, err := toGo(item[1])
+			if err != nil {
+				return nil, err
+			}
+			res[string(k)] = x
+		}
+		return res, nil
+	default:
+		return nil, errors.New("cannot convert a " + v.Type() + " (only None, bool, int, float, string, bytes, list, tuple, and dict are supported)")
+	}
+}
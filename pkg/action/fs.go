@@ -0,0 +1,367 @@
+package action
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+The filesystem actions are implemented natively -- no shell or coreutils involved --
+so they behave the same everywhere, including on minimal container images that have no `cp` or `rm` at all.
+
+They produce no output.  If they're wired into a pipe, they simply close their stdout when done.
+
+Paths are relative to the working directory, which is where the make.fx file is.
+Destination paths are always exactly the destination:
+unlike `cp` and `mv`, copying or moving onto an existing directory does *not* put the source inside it.
+*/
+
+var _ starlark.Callable = (*MkdirPlanConstructor)(nil)
+
+// MkdirPlanConstructor is `mkdir(path, parents=True)`.
+// With parents (the default), parent directories are created as needed, and it's not an error if the directory already exists.
+type MkdirPlanConstructor struct{}
+
+func (a *MkdirPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	parents := true
+	if err := starlark.UnpackArgs("mkdir", args, kwargs, "path", &path, "parents?", &parents); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Mkdir",
+		Details: path,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		var err error
+		if parents {
+			err = os.MkdirAll(resolvePath(thread, path), 0755)
+		} else {
+			err = os.Mkdir(resolvePath(thread, path), 0755)
+		}
+		if err != nil {
+			return Error(wfxapi.EcodeActionMkdir, "mkdir", err, "path", path)
+		}
+		RecordOf(thread).AddOutput(path)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *MkdirPlanConstructor) Name() string          { return "mkdir()" }
+func (a *MkdirPlanConstructor) String() string        { return "mkdir()" }
+func (a *MkdirPlanConstructor) Type() string          { return "<actionPlanConstructor:mkdir>" }
+func (a *MkdirPlanConstructor) Freeze()               {}
+func (a *MkdirPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *MkdirPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *MkdirPlanConstructor) MakesPlan()            {}
+
+var _ starlark.Callable = (*CopyPlanConstructor)(nil)
+
+// CopyPlanConstructor is `copy(src, dst)`.
+// Files are copied with their permission bits; directories are copied recursively; symlinks are copied as symlinks.
+// An existing file at dst is replaced, and so is a symlink (rather than written through).
+// Copying something onto itself (dst is the same file as src, even by way of a symlink or a hardlink),
+// or into itself (dst is inside of src), is an error, and nothing is copied.
+type CopyPlanConstructor struct{}
+
+func (a *CopyPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var src, dst string
+	if err := starlark.UnpackArgs("copy", args, kwargs, "src", &src, "dst", &dst); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Copy",
+		Details: src + " -> " + dst,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		if err := checkNotSame(resolvePath(thread, src), resolvePath(thread, dst)); err != nil {
+			return Error(wfxapi.EcodeActionCopy, "copy", err, "src", src, "dst", dst)
+		}
+		if err := checkNotWithin(resolvePath(thread, src), resolvePath(thread, dst)); err != nil {
+			return Error(wfxapi.EcodeActionCopy, "copy", err, "src", src, "dst", dst)
+		}
+		if err := copyTree(resolvePath(thread, src), resolvePath(thread, dst)); err != nil {
+			return Error(wfxapi.EcodeActionCopy, "copy", err, "src", src, "dst", dst)
+		}
+		RecordOf(thread).AddInput(src)
+		RecordOf(thread).AddOutput(dst)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *CopyPlanConstructor) Name() string          { return "copy()" }
+func (a *CopyPlanConstructor) String() string        { return "copy()" }
+func (a *CopyPlanConstructor) Type() string          { return "<actionPlanConstructor:copy>" }
+func (a *CopyPlanConstructor) Freeze()               {}
+func (a *CopyPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *CopyPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *CopyPlanConstructor) MakesPlan()            {}
+
+var _ starlark.Callable = (*MovePlanConstructor)(nil)
+
+// MovePlanConstructor is `move(src, dst)`.
+// It's a rename if possible; across filesystems, it falls back to copying and then removing the source.
+type MovePlanConstructor struct{}
+
+func (a *MovePlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var src, dst string
+	if err := starlark.UnpackArgs("move", args, kwargs, "src", &src, "dst", &dst); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Move",
+		Details: src + " -> " + dst,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		realSrc, realDst := resolvePath(thread, src), resolvePath(thread, dst)
+		err := os.Rename(realSrc, realDst)
+		if errors.Is(err, syscall.EXDEV) {
+			err = copyTree(realSrc, realDst)
+			if err == nil {
+				err = os.RemoveAll(realSrc)
+			}
+		}
+		if err != nil {
+			return Error(wfxapi.EcodeActionMove, "move", err, "src", src, "dst", dst)
+		}
+		RecordOf(thread).AddOutput(dst)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *MovePlanConstructor) Name() string          { return "move()" }
+func (a *MovePlanConstructor) String() string        { return "move()" }
+func (a *MovePlanConstructor) Type() string          { return "<actionPlanConstructor:move>" }
+func (a *MovePlanConstructor) Freeze()               {}
+func (a *MovePlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *MovePlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *MovePlanConstructor) MakesPlan()            {}
+
+var _ starlark.Callable = (*RemovePlanConstructor)(nil)
+
+// RemovePlanConstructor is `remove(path, recursive=False)`.
+// Without recursive, it removes a file or an empty directory, and it's an error if the path doesn't exist.
+// With recursive, it removes everything, and it's not an error if the path doesn't exist (like `rm -rf`).
+type RemovePlanConstructor struct{}
+
+func (a *RemovePlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var path string
+	recursive := false
+	if err := starlark.UnpackArgs("remove", args, kwargs, "path", &path, "recursive?", &recursive); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Remove",
+		Details: path,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		var err error
+		if recursive {
+			err = os.RemoveAll(resolvePath(thread, path))
+		} else {
+			err = os.Remove(resolvePath(thread, path))
+		}
+		if err != nil {
+			return Error(wfxapi.EcodeActionRemove, "remove", err, "path", path)
+		}
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *RemovePlanConstructor) Name() string          { return "remove()" }
+func (a *RemovePlanConstructor) String() string        { return "remove()" }
+func (a *RemovePlanConstructor) Type() string          { return "<actionPlanConstructor:remove>" }
+func (a *RemovePlanConstructor) Freeze()               {}
+func (a *RemovePlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *RemovePlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *RemovePlanConstructor) MakesPlan()            {}
+
+var _ starlark.Callable = (*SymlinkPlanConstructor)(nil)
+
+// SymlinkPlanConstructor is `symlink(target, link)`: it makes a symlink at the path link, pointing to target.
+// The target is used verbatim (so a relative target is relative to the link's directory, as usual for symlinks).
+type SymlinkPlanConstructor struct{}
+
+func (a *SymlinkPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var target, link string
+	if err := starlark.UnpackArgs("symlink", args, kwargs, "target", &target, "link", &link); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	ap := &ActionPlan{
+		Name_:   "Symlink",
+		Details: link + " -> " + target,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		if err := os.Symlink(target, resolvePath(thread, link)); err != nil {
+			return Error(wfxapi.EcodeActionSymlink, "symlink", err, "target", target, "link", link)
+		}
+		RecordOf(thread).AddOutput(link)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *SymlinkPlanConstructor) Name() string          { return "symlink()" }
+func (a *SymlinkPlanConstructor) String() string        { return "symlink()" }
+func (a *SymlinkPlanConstructor) Type() string          { return "<actionPlanConstructor:symlink>" }
+func (a *SymlinkPlanConstructor) Freeze()               {}
+func (a *SymlinkPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *SymlinkPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *SymlinkPlanConstructor) MakesPlan()            {}
+
+// closeStdout closes the action's stdout, if something (like a pipe) wired one up; that's how the next thing learns we're done.
+func closeStdout(ap *ActionPlan) {
+	if ap.Stdout != nil {
+		ap.Stdout.Close()
+	}
+}
+
+// checkNotSame returns an error if dst is the same file as src: copying it would truncate it (or, for a symlink, remove what it points to).
+// Both are compared as they are, and as what they point to, if they're symlinks.
+func checkNotSame(src, dst string) error {
+	for _, stat := range []func(string) (fs.FileInfo, error){os.Lstat, os.Stat} {
+		srcFi, err := stat(src)
+		if err != nil {
+			continue
+		}
+		if dstFi, err := stat(dst); err == nil && os.SameFile(srcFi, dstFi) {
+			return errors.New("destination is the same file as the source")
+		}
+	}
+	return nil
+}
+
+// removeSymlink removes whatever's at p, if it's a symlink, so that writing there doesn't write through it.
+func removeSymlink(p string) error {
+	fi, err := os.Lstat(p)
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		return nil
+	}
+	return os.Remove(p)
+}
+
+// checkNotWithin returns an error if dst is inside of src: copying there would never finish.
+// Paths are compared once symlinks along the way are resolved (see resolveParents),
+// so a dst that reaches into src by way of a symlink counts as inside of it.
+func checkNotWithin(src, dst string) error {
+	srcReal, err := resolveParents(src)
+	if err != nil {
+		return err
+	}
+	dstReal, err := resolveParents(dst)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(srcReal, dstReal)
+	if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errors.New("destination is inside the source")
+	}
+	return nil
+}
+
+// resolveParents returns p, made absolute, with symlinks resolved in the deepest of its parent directories that exists;
+// the rest (which doesn't exist yet), and the last element (which copy doesn't follow, if it's a symlink), are kept as they are.
+func resolveParents(p string) (string, error) {
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", err
+	}
+	dir, rest := filepath.Dir(abs), filepath.Base(abs)
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return abs, nil
+		}
+		dir, rest = parent, filepath.Join(filepath.Base(dir), rest)
+	}
+}
+
+// copyTree copies src to dst.
+// Regular files keep their permission bits; directories are recursed into; symlinks are recreated as symlinks (not followed).
+// Symlinks already at dst (or within it) are replaced, not followed.
+// Anything else (devices, sockets, etc) is an error.
+func copyTree(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	if err := removeSymlink(dst); err != nil {
+		return err
+	}
+	switch {
+	case fi.Mode().IsRegular():
+		return copyFile(src, dst, fi.Mode().Perm())
+	case fi.Mode()&fs.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(dst); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return os.Symlink(target, dst)
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()|0700); err != nil {
+			return err
+		}
+		entries, err := os.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, ent := range entries {
+			if err := copyTree(filepath.Join(src, ent.Name()), filepath.Join(dst, ent.Name())); err != nil {
+				return err
+			}
+		}
+		return os.Chmod(dst, fi.Mode().Perm())
+	default:
+		return &fs.PathError{Op: "copy", Path: src, Err: errors.New("not a regular file, directory, or symlink")}
+	}
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, perm) // OpenFile only applies perm when creating, and then only through the umask.
+}
@@ -0,0 +1,284 @@
+package action
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+
+	"github.com/serum-errors/go-serum"
+	starlarkjson "go.starlark.net/lib/json"
+	starlarktime "go.starlark.net/lib/time"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Besides actions, make.fx gets a few modules of plain functions, for the kind of fiddling with strings and paths that deciding what to do involves:
+
+  - json -- encode, decode, and indent (from go.starlark.net/lib/json).
+  - path -- join, dirname, basename, and rel, for slash-separated paths.
+  - re -- match, findall, and sub, with Go's regular expression syntax (see regexp/syntax).
+  - hashing -- sha256 of strings (or bytes), and of files.
+  - time -- parse_duration, and the units (second, minute, etc), from go.starlark.net/lib/time.
+    Only those: nothing that tells the time, since a make.fx that depends on when it runs isn't deterministic.
+
+These all happen right away, when they're called; none of them are actions.
+(hashing.sha256_file reads a file, so, like read_file, it records the file as an input of the target.)
+It's not called "hash", so that Starlark's own hash function is still there.
+*/
+
+// JSONModule is the "json" module: go.starlark.net/lib/json's, as is.
+var JSONModule = starlarkjson.Module
+
+// TimeModule is the "time" module: the deterministic parts of go.starlark.net/lib/time's.
+var TimeModule = &starlarkstruct.Module{
+	Name: "time",
+	Members: starlark.StringDict{
+		"parse_duration": starlarktime.Module.Members["parse_duration"],
+
+		"nanosecond":  starlarktime.Module.Members["nanosecond"],
+		"microsecond": starlarktime.Module.Members["microsecond"],
+		"millisecond": starlarktime.Module.Members["millisecond"],
+		"second":      starlarktime.Module.Members["second"],
+		"minute":      starlarktime.Module.Members["minute"],
+		"hour":        starlarktime.Module.Members["hour"],
+	},
+}
+
+// PathModule is the "path" module, for slash-separated paths (as make.fx uses everywhere):
+//
+//   - `path.join(*parts)` -- the parts joined with slashes, and cleaned.
+//   - `path.dirname(p)` -- everything but the last element (or "." if there's only one).
+//   - `path.basename(p)` -- the last element.
+//   - `path.rel(p, start=".")` -- p, relative to start.  Relative paths are relative to the project directory.
+var PathModule = &starlarkstruct.Module{
+	Name: "path",
+	Members: starlark.StringDict{
+		"join":     starlark.NewBuiltin("path.join", pathJoin),
+		"dirname":  starlark.NewBuiltin("path.dirname", pathDirname),
+		"basename": starlark.NewBuiltin("path.basename", pathBasename),
+		"rel":      starlark.NewBuiltin("path.rel", pathRel),
+	},
+}
+
+func pathJoin(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`path.join` takes no keyword arguments")
+	}
+	parts := make([]string, len(args))
+	for i, arg := range args {
+		s, ok := starlark.AsString(arg)
+		if !ok {
+			return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`path.join` expects strings, but argument %d is a %s", i+1, arg.Type())
+		}
+		parts[i] = s
+	}
+	return starlark.String(path.Join(parts...)), nil
+}
+
+func pathDirname(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("path.dirname", args, kwargs, "p", &p); err != nil {
+		return starlark.None, err
+	}
+	return starlark.String(path.Dir(p)), nil
+}
+
+func pathBasename(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("path.basename", args, kwargs, "p", &p); err != nil {
+		return starlark.None, err
+	}
+	return starlark.String(path.Base(p)), nil
+}
+
+func pathRel(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	start := "."
+	if err := UnpackArgs("path.rel", args, kwargs, "p", &p, "start?", &start); err != nil {
+		return starlark.None, err
+	}
+	target, base := filepath.FromSlash(p), filepath.FromSlash(start)
+	if filepath.IsAbs(target) != filepath.IsAbs(base) {
+		// One's absolute, so they can only be compared if the other is too.
+		var err error
+		if target, err = filepath.Abs(resolvePath(thread, target)); err == nil {
+			base, err = filepath.Abs(resolvePath(thread, base))
+		}
+		if err != nil {
+			return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`path.rel` can't make %q relative to %q: %s", p, start, err)
+		}
+	}
+	rel, err := filepath.Rel(base, target)
+	if err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`path.rel` can't make %q relative to %q: %s", p, start, err)
+	}
+	return starlark.String(filepath.ToSlash(rel)), nil
+}
+
+// ReModule is the "re" module, for regular expressions (in Go's syntax; see regexp/syntax):
+//
+//   - `re.match(pattern, s)` -- None if the pattern doesn't match anywhere in s (anchor it with ^ and $ if need be);
+//     otherwise a tuple of the match, followed by its groups (None for groups that didn't take part).
+//   - `re.findall(pattern, s)` -- a list of every match; or of each match's group, if the pattern has one; or of tuples of the groups, if it has more.
+//   - `re.sub(pattern, repl, s, count=0)` -- s, with matches replaced by repl (in which $1, ${name}, etc, refer to groups; see regexp.Regexp.Expand).
+//     If count is more than zero, only that many are replaced.
+var ReModule = &starlarkstruct.Module{
+	Name: "re",
+	Members: starlark.StringDict{
+		"match":   starlark.NewBuiltin("re.match", reMatch),
+		"findall": starlark.NewBuiltin("re.findall", reFindall),
+		"sub":     starlark.NewBuiltin("re.sub", reSub),
+	},
+}
+
+// compileRegexp is regexp.Compile, with the error in our terms.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if the pattern isn't a valid regular expression.
+func compileRegexp(fnName, pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "`%s` has an invalid pattern %q: %s", fnName, pattern, err)
+	}
+	return re, nil
+}
+
+// groups returns the match, and the groups, at the indexes loc (from one of the Regexp.Find*SubmatchIndex methods), in s.
+// Groups that didn't take part in the match are None.
+func groups(s string, loc []int) starlark.Tuple {
+	res := make(starlark.Tuple, len(loc)/2)
+	for i := range res {
+		if loc[2*i] < 0 {
+			res[i] = starlark.None
+			continue
+		}
+		res[i] = starlark.String(s[loc[2*i]:loc[2*i+1]])
+	}
+	return res
+}
+
+func reMatch(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := UnpackArgs("re.match", args, kwargs, "pattern", &pattern, "s", &s); err != nil {
+		return starlark.None, err
+	}
+	re, err := compileRegexp("re.match", pattern)
+	if err != nil {
+		return starlark.None, err
+	}
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return starlark.None, nil
+	}
+	return groups(s, loc), nil
+}
+
+func reFindall(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, s string
+	if err := UnpackArgs("re.findall", args, kwargs, "pattern", &pattern, "s", &s); err != nil {
+		return starlark.None, err
+	}
+	re, err := compileRegexp("re.findall", pattern)
+	if err != nil {
+		return starlark.None, err
+	}
+	var res []starlark.Value
+	for _, loc := range re.FindAllStringSubmatchIndex(s, -1) {
+		g := groups(s, loc)
+		switch len(g) {
+		case 1:
+			res = append(res, g[0])
+		case 2:
+			res = append(res, g[1])
+		default:
+			res = append(res, g[1:])
+		}
+	}
+	return starlark.NewList(res), nil
+}
+
+func reSub(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern, repl, s string
+	count := 0
+	if err := UnpackArgs("re.sub", args, kwargs, "pattern", &pattern, "repl", &repl, "s", &s, "count?", &count); err != nil {
+		return starlark.None, err
+	}
+	re, err := compileRegexp("re.sub", pattern)
+	if err != nil {
+		return starlark.None, err
+	}
+	n := -1
+	if count > 0 {
+		n = count
+	}
+	var res []byte
+	last := 0
+	for _, loc := range re.FindAllStringSubmatchIndex(s, n) {
+		res = append(res, s[last:loc[0]]...)
+		res = re.ExpandString(res, repl, s, loc)
+		last = loc[1]
+	}
+	res = append(res, s[last:]...)
+	return starlark.String(res), nil
+}
+
+// HashingModule is the "hashing" module:
+//
+//   - `hashing.sha256(data)` -- the SHA-256 of a string (or bytes), in hex.
+//   - `hashing.sha256_file(path)` -- the SHA-256 of a file's content, in hex.  The file is recorded as an input of the target.
+var HashingModule = &starlarkstruct.Module{
+	Name: "hashing",
+	Members: starlark.StringDict{
+		"sha256":      starlark.NewBuiltin("hashing.sha256", hashSHA256),
+		"sha256_file": starlark.NewBuiltin("hashing.sha256_file", hashSHA256File),
+	},
+}
+
+func hashSHA256(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var data starlark.Value
+	if err := UnpackArgs("hashing.sha256", args, kwargs, "data", &data); err != nil {
+		return starlark.None, err
+	}
+	var s string
+	switch data := data.(type) {
+	case starlark.String:
+		s = string(data)
+	case starlark.Bytes:
+		s = string(data)
+	default:
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`hashing.sha256` expects a string or bytes, not %s", data.Type())
+	}
+	sum := sha256.Sum256([]byte(s))
+	return starlark.String(hex.EncodeToString(sum[:])), nil
+}
+
+// hashSHA256File is hashing.sha256_file.
+//
+// Errors:
+//
+//   - wfx-action-error-read -- if the file can't be read.
+func hashSHA256File(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("hashing.sha256_file", args, kwargs, "path", &p); err != nil {
+		return starlark.None, err
+	}
+	RecordOf(thread).AddInput(p)
+	f, err := os.Open(resolvePath(thread, p))
+	if err != nil {
+		return starlark.None, Error(wfxapi.EcodeActionRead, "hashing.sha256_file", err, "path", p)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return starlark.None, Error(wfxapi.EcodeActionRead, "hashing.sha256_file", err, "path", p)
+	}
+	return starlark.String(hex.EncodeToString(h.Sum(nil))), nil
+}
@@ -0,0 +1,58 @@
+package action
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.starlark.net/starlark"
+)
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "data.txt"), []byte("hello\n"), 0644), qt.IsNil)
+	predeclared := starlark.StringDict{
+		"json":    JSONModule,
+		"path":    PathModule,
+		"re":      ReModule,
+		"hashing": HashingModule,
+		"time":    TimeModule,
+	}
+	eval := func(expr string) (starlark.Value, *Record, error) {
+		record := &Record{}
+		thread := &starlark.Thread{Name: "test"}
+		thread.SetLocal("dir", dir)
+		thread.SetLocal("record", record)
+		v, err := starlark.Eval(thread, "test.fx", expr, predeclared)
+		return v, record, err
+	}
+	for _, tc := range []struct {
+		expr, want string
+	}{
+		{`re.findall(r"(\w+)=(\d+)?", "a=1 b= c=3")`, `[("a", "1"), ("b", None), ("c", "3")]`},
+		{`re.match(r"(x)|(y)", "y")`, `("y", None, "y")`},
+		{`re.sub(r"\s+", " ", "a  b\t\tc")`, `"a b c"`},
+		{`path.join()`, `""`},
+		{`path.rel("/abs/x", "/abs")`, `"x"`},
+		{`path.rel("sub/x", "` + dir + `")`, `"sub/x"`},
+		{`hashing.sha256(b"hello\n") == hashing.sha256("hello\n")`, `True`},
+		{`json.decode(json.encode({"a": [1, None]}))`, `{"a": [1, None]}`},
+		{`time.parse_duration("2h") // time.hour`, `2`},
+	} {
+		v, _, err := eval(tc.expr)
+		if qt.Check(t, err, qt.IsNil, qt.Commentf("%s", tc.expr)) {
+			qt.Check(t, v.String(), qt.Equals, tc.want, qt.Commentf("%s", tc.expr))
+		}
+	}
+
+	// The file hashed is an input.
+	v, record, err := eval(`hashing.sha256_file("data.txt")`)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, v, qt.Equals, starlark.String("5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"))
+	qt.Check(t, record.Inputs(), qt.DeepEquals, []string{"data.txt"})
+
+	// Only the deterministic parts of time are there.
+	_, _, err = eval(`time.now()`)
+	qt.Check(t, err, qt.ErrorMatches, `.*has no .now field.*`)
+}
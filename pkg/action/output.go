@@ -0,0 +1,170 @@
+package action
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Verbosity controls where the output of an action goes, when it hasn't been wired somewhere else (e.g. by a pipe).
+// It's read from the "verbosity" thread local; if absent, VerbosityNormal applies.
+type Verbosity int
+
+const (
+	// VerbosityNormal is the policy described on ActionPlan:
+	// stdout is discarded, and stderr is kept only to be included in the error if the action fails.
+	VerbosityNormal Verbosity = iota
+
+	// VerbosityQuiet handles action output the same way as VerbosityNormal;
+	// the difference is in how errors are reported, which leave out the end of stderr (though it's still attached to them).
+	VerbosityQuiet
+
+	// VerbosityVerbose sends stdout and stderr through to the user,
+	// with each line decorated by the name of the target and the action it came from.
+	VerbosityVerbose
+)
+
+// stderrTailSize is how much of the end of an action's stderr is kept, to be attached to its error if it fails.
+const stderrTailSize = 4096
+
+// actionOutput is the default output wiring for one execution of an action.
+// Use outputFor to set one up, and call finish when the action is done.
+type actionOutput struct {
+	stdout  io.Writer
+	stderr  io.Writer
+	tail    *tailBuffer
+	secrets *Secrets
+	flushes []func()
+}
+
+// outputFor returns the writers an action should use for stdout and stderr, if it hasn't been given any by a controller,
+// according to the verbosity in the thread.
+// Whatever the verbosity, the end of stderr is also captured, and can be retrieved from finish.
+// If the thread has Secrets, they're redacted from everything that reaches the user, and from the end of stderr.
+func outputFor(thread *starlark.Thread, ap *ActionPlan) *actionOutput {
+	userStdout := thread.Local("stdout").(io.Writer)
+	userStderr := thread.Local("stderr").(io.Writer)
+	verbosity, _ := thread.Local("verbosity").(Verbosity)
+
+	out := &actionOutput{tail: &tailBuffer{max: stderrTailSize}, secrets: SecretsOf(thread)}
+	var redactorFlushes []func()
+	if !out.secrets.Empty() {
+		rout := &redactingWriter{w: userStdout, secrets: out.secrets}
+		rerr := &redactingWriter{w: userStderr, secrets: out.secrets}
+		redactorFlushes = []func(){rout.Flush, rerr.Flush}
+		userStdout, userStderr = rout, rerr
+	}
+	switch verbosity {
+	case VerbosityVerbose:
+		prefix := "[" + targetName(thread) + "] " + describeAction(ap) + ": "
+		dout := &lineDecorator{w: userStdout, prefix: prefix}
+		derr := &lineDecorator{w: userStderr, prefix: prefix}
+		out.flushes = append(out.flushes, dout.Flush, derr.Flush)
+		out.stdout = dout
+		out.stderr = io.MultiWriter(derr, out.tail)
+	default:
+		out.stdout = io.Discard
+		out.stderr = out.tail
+	}
+	// After any decoration's flushes, since those write through the redactors.
+	out.flushes = append(out.flushes, redactorFlushes...)
+	return out
+}
+
+// finish flushes any partially written lines, and returns the captured end of stderr.
+func (out *actionOutput) finish() (stderrTail string) {
+	for _, flush := range out.flushes {
+		flush()
+	}
+	return out.secrets.Redact(out.tail.String())
+}
+
+// describeAction returns a short name for an action, for decorating its output.
+func describeAction(ap *ActionPlan) string {
+	if ap.Label != "" {
+		return ap.Label
+	}
+	if s, ok := ap.Details.(string); ok {
+		// One line, since it's going to prefix lines.
+		if i := strings.IndexByte(s, '\n'); i >= 0 {
+			s = s[:i] + "..."
+		}
+		if len(s) > 40 {
+			s = s[:37] + "..."
+		}
+		return strings.ToLower(ap.Name_) + "(" + s + ")"
+	}
+	return strings.ToLower(ap.Name_)
+}
+
+// tailBuffer is a writer that keeps only the last max bytes written to it.
+type tailBuffer struct {
+	mu        sync.Mutex
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.max:]...)
+		t.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns what was kept.  If anything was dropped from the front, the result starts at the next whole line, after a "..." marker.
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.truncated {
+		return string(t.buf)
+	}
+	kept := t.buf
+	if i := bytes.IndexByte(kept, '\n'); i >= 0 && i < len(kept)-1 {
+		kept = kept[i+1:]
+	}
+	return "...\n" + string(kept)
+}
+
+// lineDecorator is a writer that prefixes every line written through it.
+// Partial lines are held back until they're completed, or until Flush.
+type lineDecorator struct {
+	mu      sync.Mutex
+	w       io.Writer
+	prefix  string
+	partial []byte
+}
+
+func (d *lineDecorator) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.partial = append(d.partial, p...)
+	for {
+		i := bytes.IndexByte(d.partial, '\n')
+		if i < 0 {
+			break
+		}
+		if _, err := io.WriteString(d.w, d.prefix+string(d.partial[:i+1])); err != nil {
+			return len(p), err
+		}
+		d.partial = d.partial[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush writes out any partial line, terminating it.
+func (d *lineDecorator) Flush() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.partial) > 0 {
+		io.WriteString(d.w, d.prefix+string(d.partial)+"\n")
+		d.partial = nil
+	}
+}
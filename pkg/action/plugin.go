@@ -0,0 +1,265 @@
+package action
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Actions can be defined outside of this package, too.
+The helpers here take care of the conventions the built-in actions follow,
+so that an action defined elsewhere (say, a `docker_build` in some downstream tool) behaves like the built-in ones:
+
+  - NewPlanConstructor and NewControllerConstructor make the starlark callable, without needing a type with all of starlark.Value's methods.
+  - UnpackArgs parses arguments, reporting problems as script errors.
+  - ActionPlan.Streams gives the action's stdin, stdout, and stderr, according to how it's been wired (e.g. by a pipe) and the verbosity.
+  - RunCommand runs a subprocess with all of the above, in the right directory and environment, and stops it (and its children) if the action is interrupted.
+  - Error builds errors in the usual form.
+
+To make the result available in make.fx files, register it with wfx.Register (or give it to a Project in its Options.Builtins).
+*/
+
+// PlanFunc builds an ActionPlan from the arguments a script called its constructor with.
+// It shouldn't have any effects itself; those belong in the ActionPlan's Run.
+type PlanFunc func(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (*ActionPlan, error)
+
+// NewPlanConstructor makes a starlark callable, which scripts will know as name, that constructs ActionPlans using fn.
+// If fn leaves the ActionPlan's Name_ empty, it's set to name.
+func NewPlanConstructor(name string, fn PlanFunc) starlark.Callable {
+	return &planConstructor{name: name, fn: fn}
+}
+
+var _ starlark.Callable = (*planConstructor)(nil)
+
+type planConstructor struct {
+	name string
+	fn   PlanFunc
+}
+
+func (a *planConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	ap, err := a.fn(thread, args, kwargs)
+	if err != nil {
+		return starlark.None, err
+	}
+	if ap.Name_ == "" {
+		ap.Name_ = a.name
+	}
+	return ap, nil
+}
+
+func (a *planConstructor) Name() string          { return a.name + "()" }
+func (a *planConstructor) String() string        { return a.name + "()" }
+func (a *planConstructor) Type() string          { return "<actionPlanConstructor:" + a.name + ">" }
+func (a *planConstructor) Freeze()               {}
+func (a *planConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *planConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *planConstructor) MakesPlan()            {}
+
+// ControllerFunc builds an ActionPlan that controls others: the inner ActionPlans are the positional arguments the script gave.
+// Like `ignorantly`, the ActionPlan it returns usually runs the inner ones (with Execute, not Run, so they're reported in events),
+// and should hand its own IO wiring down to them (with InheritIO) if it wants to be transparent in a pipe.
+type ControllerFunc func(thread *starlark.Thread, inner []*ActionPlan, kwargs []starlark.Tuple) (*ActionPlan, error)
+
+// NewControllerConstructor makes a starlark callable, which scripts will know as name, that constructs controller ActionPlans using fn.
+// All positional arguments must be ActionPlans; that's checked before fn is called.
+// If fn leaves the ActionPlan's Name_ empty, it's set to name.
+func NewControllerConstructor(name string, fn ControllerFunc) starlark.Callable {
+	return &controllerConstructor{name: name, fn: fn}
+}
+
+var _ starlark.Callable = (*controllerConstructor)(nil)
+
+type controllerConstructor struct {
+	name string
+	fn   ControllerFunc
+}
+
+func (a *controllerConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	inner := make([]*ActionPlan, len(args))
+	for i, arg := range args {
+		ap, ok := arg.(*ActionPlan)
+		if !ok {
+			return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`%s` expects all positional args to be an ActionPlan", a.name)
+		}
+		inner[i] = ap
+	}
+	ap, err := a.fn(thread, inner, kwargs)
+	if err != nil {
+		return starlark.None, err
+	}
+	if ap.Name_ == "" {
+		ap.Name_ = a.name
+	}
+	return ap, nil
+}
+
+func (a *controllerConstructor) Name() string          { return a.name + "()" }
+func (a *controllerConstructor) String() string        { return a.name + "()" }
+func (a *controllerConstructor) Type() string          { return "<action:" + a.name + ">" }
+func (a *controllerConstructor) Freeze()               {}
+func (a *controllerConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *controllerConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *controllerConstructor) MakesPlan()            {}
+
+// UnpackArgs is starlark.UnpackArgs, except that problems are reported as wfx-script-invalid errors.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if the arguments don't match what's expected.
+func UnpackArgs(fnName string, args starlark.Tuple, kwargs []starlark.Tuple, pairs ...interface{}) error {
+	if err := starlark.UnpackArgs(fnName, args, kwargs, pairs...); err != nil {
+		return serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	return nil
+}
+
+// Streams are the IO an action should use while it runs.  Get them from ActionPlan.Streams.
+type Streams struct {
+	Stdin  io.Reader // Never nil; if nothing's wired to the action's stdin, it's empty.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	ap  *ActionPlan
+	out *actionOutput
+}
+
+// Streams returns the IO the action should use: whatever a controller (like pipe) wired to it,
+// or otherwise, the defaults for the thread's verbosity.
+// Call Close on the result when the action is done.
+func (a *ActionPlan) Streams(thread *starlark.Thread) *Streams {
+	s := &Streams{ap: a, out: outputFor(thread, a)}
+	s.Stdin = a.Stdin
+	if a.Stdin == nil {
+		s.Stdin = strings.NewReader("")
+	}
+	s.Stdout = s.out.stdout
+	if a.Stdout != nil {
+		s.Stdout = a.Stdout
+	}
+	s.Stderr = s.out.stderr
+	if a.Stderr != nil {
+		s.Stderr = a.Stderr
+	}
+	return s
+}
+
+// Close flushes any decorated output, and closes stdout if a controller wired it (that's how the next thing in a pipe learns we're done).
+// It returns the end of what was written to stderr, which should be attached to the error if the action failed
+// (RunCommand does this; WithStderrTail helps if you're building the error yourself).
+func (s *Streams) Close() (stderrTail string) {
+	closeStdout(s.ap)
+	return s.out.finish()
+}
+
+// WithStderrTail adds a "stderr" detail to an error's construction params, if there's any stderr to report.
+func WithStderrTail(stderrTail string, params ...serum.WithConstruction) []serum.WithConstruction {
+	return withStderrTail(stderrTail, params...)
+}
+
+// RunCommand runs a subprocess as (part of) an action:
+// in the thread's WorkDir and with its Environ (unless the cmd already has its own), with the action's Streams (unless the cmd already has its own),
+// and recording the process state on the ActionPlan, for reporting.
+// The ctx should be the one given to the action's Run:
+// the process runs in a process group of its own, and if ctx is cancelled, the whole group is stopped (see WithStopping).
+// If a controller has set a sandbox in ctx (see WithSandbox), the process runs in it.
+//
+// Errors:
+//
+//   - wfx-action-error-cmdexit -- if the command can't be started, or exits nonzero.
+//   - wfx-timeout -- if ctx's deadline passed, and so the command was killed.
+//   - wfx-sandbox-violation -- if the command was sandboxed, and failed because of it (see Sandbox).
+//   - wfx-sandbox-unavailable -- if the command was to be sandboxed, but the sandbox couldn't be set up.
+func RunCommand(ctx context.Context, thread *starlark.Thread, ap *ActionPlan, cmd *exec.Cmd) error {
+	if cmd.Dir == "" {
+		cmd.Dir = WorkDir(thread)
+	}
+	if cmd.Env == nil {
+		cmd.Env = Environ(ctx, thread)
+	}
+	streams := ap.Streams(thread)
+	if cmd.Stdin == nil && ap.Stdin != nil {
+		cmd.Stdin = streams.Stdin
+	}
+	if cmd.Stdout == nil {
+		cmd.Stdout = streams.Stdout
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = streams.Stderr
+	}
+	cmdline := SecretsOf(thread).Redact(quoteArgs(cmd.Args))
+	sb := SandboxOf(ctx)
+	start := time.Now()
+	problem, err := runProcessIn(ctx, cmd, sb)
+	ap.Process = cmd.ProcessState
+	stderrTail := streams.Close()
+	switch {
+	case problem != "":
+		return errorSandboxUnavailable(cmdline, problem)
+	case err == nil:
+		return nil
+	case TimedOut(ctx):
+		return errorCmdTimeout(cmdline, time.Since(start), stderrTail)
+	}
+	if sb != nil {
+		if err := errorSandboxViolation(cmdline, stderrTail); err != nil {
+			return err
+		}
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return CmdPlanConstructor{}.processExecError(exitErr, cmdline, stderrTail)
+	}
+	return serum.Error(wfxapi.EcodeActionCmdExit, withStderrTail(stderrTail,
+		serum.WithMessageTemplate("cmd {{cmd|q}} could not be started: {{reason}}"),
+		serum.WithDetail("cmd", cmdline),
+		serum.WithDetail("reason", err.Error()),
+	)...)
+}
+
+// Error builds the error for a failed action, in the usual form: `verb key="value" ... failed: reason`.
+// The pairs are detail keys and values, typically naming the things involved (paths, etc).
+// The cause becomes the "reason" detail; if it's a path error, only the underlying error is used, since the paths are already named.
+func Error(ecode string, verb string, cause error, pairs ...string) error {
+	var params []serum.WithConstruction
+	tmpl := verb
+	for i := 0; i+1 < len(pairs); i += 2 {
+		params = append(params, serum.WithDetail(pairs[i], pairs[i+1]))
+		tmpl += " " + pairs[i] + "={{" + pairs[i] + "|q}}"
+	}
+	var pe *fs.PathError
+	var le *os.LinkError
+	reason := cause.Error()
+	switch {
+	case errors.As(cause, &pe):
+		reason = pe.Err.Error()
+	case errors.As(cause, &le):
+		reason = le.Err.Error()
+	}
+	params = append(params, serum.WithDetail("reason", reason))
+	params = append(params, serum.WithMessageTemplate(tmpl+" failed: {{reason}}"))
+	return serum.Error(ecode, params...)
+}
+
+// quoteArgs is for describing a command line in a way that can be pasted into a shell (roughly).
+func quoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`|&;<>()*?[]#~") {
+			arg = strconv.Quote(arg)
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,32 @@
+package action
+
+import (
+	"context"
+	"time"
+)
+
+// DefaultGracePeriod is how long processes get to exit, after being asked to stop (with SIGTERM), before they're killed (with SIGKILL).
+const DefaultGracePeriod = 5 * time.Second
+
+type stoppingKey struct{}
+
+type stopping struct {
+	grace time.Duration
+	force <-chan struct{}
+}
+
+// WithStopping returns a context that says how processes started by actions should be stopped, when it's cancelled:
+// each process group is asked to stop (SIGTERM), then killed (SIGKILL) after the grace period,
+// or as soon as force is closed (e.g. because the user pressed Ctrl-C a second time), whichever is first.
+//
+// Without this, the grace period is DefaultGracePeriod, and there's no forcing.
+func WithStopping(ctx context.Context, grace time.Duration, force <-chan struct{}) context.Context {
+	return context.WithValue(ctx, stoppingKey{}, stopping{grace, force})
+}
+
+func stoppingOf(ctx context.Context) stopping {
+	if s, ok := ctx.Value(stoppingKey{}).(stopping); ok {
+		return s
+	}
+	return stopping{grace: DefaultGracePeriod}
+}
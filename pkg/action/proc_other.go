@@ -0,0 +1,29 @@
+//go:build !unix
+
+package action
+
+import (
+	"context"
+	"os/exec"
+)
+
+// runProcess runs cmd (which must not have been started) to completion.
+//
+// If ctx is cancelled before the process exits, it's killed.
+// (Process groups and graceful stopping are not yet supported on this platform.)
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+		case <-ctx.Done():
+			cmd.Process.Kill()
+		}
+	}()
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
@@ -0,0 +1,53 @@
+//go:build unix
+
+package action
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// runProcess runs cmd (which must not have been started) to completion, in a process group of its own,
+// so that whatever it starts in turn (e.g. the processes of a shell pipeline) can be stopped along with it.
+//
+// If ctx is cancelled before the process exits, the whole group is stopped, as described by WithStopping.
+// If ctx's deadline passes, the whole group is killed immediately.
+// (The process usually then exits due to a signal, and that's what the returned error says.)
+func runProcess(ctx context.Context, cmd *exec.Cmd) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	pgid := cmd.Process.Pid
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-exited:
+			return
+		case <-ctx.Done():
+		}
+		if TimedOut(ctx) {
+			syscall.Kill(-pgid, syscall.SIGKILL)
+			return
+		}
+		stop := stoppingOf(ctx)
+		syscall.Kill(-pgid, syscall.SIGTERM)
+		timer := time.NewTimer(stop.grace)
+		defer timer.Stop()
+		select {
+		case <-exited:
+			// The leader's gone, but stragglers in its group (say, something it backgrounded) may not be.
+		case <-timer.C:
+		case <-stop.force:
+		}
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}()
+	err := cmd.Wait()
+	close(exited)
+	return err
+}
@@ -0,0 +1,82 @@
+//go:build unix
+
+package action
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// startStubborn runs a shell that ignores SIGTERM, and has a child (which ignores it too); it returns the child's pid.
+func startStubborn(t *testing.T, ctx context.Context) (childPid int, result <-chan error) {
+	pidfile := filepath.Join(t.TempDir(), "pid")
+	cmd := exec.Command("/bin/sh", "-c", `trap "" TERM; sleep 60 & echo $! > `+pidfile+`; wait`)
+	res := make(chan error, 1)
+	go func() { res <- runProcess(ctx, cmd) }()
+	for i := 0; i < 500; i++ {
+		if bs, err := os.ReadFile(pidfile); err == nil && strings.HasSuffix(string(bs), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(bs)))
+			qt.Assert(t, err, qt.IsNil)
+			return pid, res
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("child never started")
+	return 0, nil
+}
+
+// gone returns true if the process doesn't exist (or is a zombie, which in a container might never be reaped).
+func gone(pid int) bool {
+	bs, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return syscall.Kill(pid, 0) == syscall.ESRCH
+	}
+	fields := strings.Fields(string(bs[strings.LastIndexByte(string(bs), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func waitGone(t *testing.T, pid int) {
+	for i := 0; i < 500; i++ {
+		if gone(pid) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("process %d is still around", pid)
+}
+
+func TestRunProcessStopsGroupAfterGrace(t *testing.T) {
+	ctx, cancel := context.WithCancel(WithStopping(context.Background(), 100*time.Millisecond, nil))
+	child, res := startStubborn(t, ctx)
+	start := time.Now()
+	cancel()
+	err := <-res
+	qt.Assert(t, err, qt.IsNotNil)
+	qt.Assert(t, time.Since(start) >= 100*time.Millisecond, qt.IsTrue)
+	waitGone(t, child)
+}
+
+func TestRunProcessForced(t *testing.T) {
+	force := make(chan struct{})
+	ctx, cancel := context.WithCancel(WithStopping(context.Background(), time.Hour, force))
+	child, res := startStubborn(t, ctx)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(force)
+	select {
+	case err := <-res:
+		qt.Assert(t, err, qt.IsNotNil)
+	case <-time.After(5 * time.Second):
+		t.Fatal("not killed after forcing")
+	}
+	waitGone(t, child)
+}
@@ -0,0 +1,295 @@
+package action
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Some builtins look at the filesystem, rather than change it: `glob`, `exists`, `read_file`, and `read_json`.
+They aren't actions -- they happen right away, when they're called, since their whole point is their result.
+Paths are relative to the project directory (the WorkDir), like every other path a script gives.
+
+Whatever they look at is recorded as an input of the target that's running (see Record),
+so that watch mode notices when it changes, even if the target didn't declare it (in "fx_inputs").
+For glob, that's the directory the pattern starts in (everything before the first wildcard),
+so that new files that would match count too.
+At the top level of make.fx, outside of any target, it's recorded as an input of the whole script instead (see wfx.Program.GlobalInputs),
+so that watch mode reloads make.fx when it changes.
+*/
+
+var _ starlark.Callable = (*GlobBuiltin)(nil)
+
+// GlobBuiltin is `glob(include, exclude=[])`: it returns the paths of the files that match any of the include patterns,
+// and none of the exclude patterns, sorted.
+//
+// Patterns are slash-separated paths, relative to the project directory, where each segment may use the wildcards of path.Match
+// (`*`, `?`, and `[...]`), and a segment that's exactly `**` matches any number of directories (including none).
+// So "src/**/*.go" matches "src/main.go" and "src/pkg/util.go".
+// Only files (and symlinks, which aren't followed) are matched, not directories.
+// The paths returned are cleaned, and relative to the project directory, like the patterns.
+type GlobBuiltin struct{}
+
+func (a *GlobBuiltin) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var includeList, excludeList *starlark.List
+	if err := UnpackArgs("glob", args, kwargs, "include", &includeList, "exclude?", &excludeList); err != nil {
+		return starlark.None, err
+	}
+	include, err := globPatterns("include", includeList)
+	if err != nil {
+		return starlark.None, err
+	}
+	exclude, err := globPatterns("exclude", excludeList)
+	if err != nil {
+		return starlark.None, err
+	}
+	matches := map[string]struct{}{}
+	for _, pattern := range include {
+		base := globBase(pattern)
+		RecordOf(thread).AddInput(base)
+		root := resolvePath(thread, filepath.FromSlash(base))
+		err := filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if file == root && errors.Is(err, fs.ErrNotExist) {
+					return nil // Nothing there; nothing matches.
+				}
+				return err
+			}
+			rel, err := filepath.Rel(root, file)
+			if err != nil {
+				return err
+			}
+			name := path.Join(base, filepath.ToSlash(rel))
+			if d.IsDir() {
+				if file != root && !globCouldMatchWithin(pattern, name) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if globMatch(pattern, name) && !globMatchAny(exclude, name) {
+				matches[name] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return starlark.None, Error(wfxapi.EcodeActionRead, "glob", err, "pattern", pattern)
+		}
+	}
+	res := make([]starlark.Value, 0, len(matches))
+	for _, name := range sortedSet(matches) {
+		res = append(res, starlark.String(name))
+	}
+	return starlark.NewList(res), nil
+}
+
+func (a *GlobBuiltin) Name() string          { return "glob()" }
+func (a *GlobBuiltin) String() string        { return "glob()" }
+func (a *GlobBuiltin) Type() string          { return "<builtin:glob>" }
+func (a *GlobBuiltin) Freeze()               {}
+func (a *GlobBuiltin) Truth() starlark.Bool  { return starlark.True }
+func (a *GlobBuiltin) Hash() (uint32, error) { return 0, nil }
+
+// globPatterns converts a list of patterns given to glob as its param, and checks them.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if anything in the list isn't a string, or isn't a valid pattern,
+//     or is absolute (patterns are relative to the project directory).
+func globPatterns(param string, list *starlark.List) ([]string, error) {
+	patterns, err := stringList("glob", param, list)
+	if err != nil {
+		return nil, err
+	}
+	for i, pattern := range patterns {
+		if path.IsAbs(pattern) || filepath.IsAbs(pattern) {
+			return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "`glob` patterns are relative to the project directory, but %s has %q", param, pattern)
+		}
+		pattern = path.Clean(pattern)
+		for _, seg := range strings.Split(pattern, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "`glob` %s has an invalid pattern %q: %s", param, pattern, err)
+			}
+		}
+		patterns[i] = pattern
+	}
+	return patterns, nil
+}
+
+// globBase returns the leading segments of a (clean) pattern that have no wildcards: the directory to search.
+// (Or the file to check, if the pattern has no wildcards at all.)
+func globBase(pattern string) string {
+	segs := strings.Split(pattern, "/")
+	for i, seg := range segs {
+		if seg == "**" || strings.ContainsAny(seg, `*?[\`) {
+			if i == 0 {
+				return "."
+			}
+			return path.Join(segs[:i]...)
+		}
+	}
+	return pattern
+}
+
+// globMatch returns true if name (slash-separated, and clean) matches the pattern.
+func globMatch(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func globMatchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if globMatch(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// globCouldMatchWithin returns true if something within the directory dir could match the pattern,
+// so glob knows which directories aren't worth looking in.
+func globCouldMatchWithin(pattern, dir string) bool {
+	segs, names := strings.Split(pattern, "/"), strings.Split(dir, "/")
+	for len(names) > 0 {
+		if len(segs) == 0 {
+			return false
+		}
+		if segs[0] == "**" {
+			return true
+		}
+		if ok, _ := path.Match(segs[0], names[0]); !ok {
+			return false
+		}
+		segs, names = segs[1:], names[1:]
+	}
+	return len(segs) > 0
+}
+
+var _ starlark.Callable = (*ExistsBuiltin)(nil)
+
+// ExistsBuiltin is `exists(path)`: it returns True if there's a file or directory at the path (following symlinks), and False if there isn't.
+//
+// Errors:
+//
+//   - wfx-action-error-read -- if whether the path exists can't be determined (e.g. a directory along the way can't be read).
+type ExistsBuiltin struct{}
+
+func (a *ExistsBuiltin) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("exists", args, kwargs, "path", &p); err != nil {
+		return starlark.None, err
+	}
+	RecordOf(thread).AddInput(p)
+	_, err := os.Stat(resolvePath(thread, p))
+	switch {
+	case err == nil:
+		return starlark.True, nil
+	case errors.Is(err, fs.ErrNotExist):
+		return starlark.False, nil
+	default:
+		return starlark.None, Error(wfxapi.EcodeActionRead, "exists", err, "path", p)
+	}
+}
+
+func (a *ExistsBuiltin) Name() string          { return "exists()" }
+func (a *ExistsBuiltin) String() string        { return "exists()" }
+func (a *ExistsBuiltin) Type() string          { return "<builtin:exists>" }
+func (a *ExistsBuiltin) Freeze()               {}
+func (a *ExistsBuiltin) Truth() starlark.Bool  { return starlark.True }
+func (a *ExistsBuiltin) Hash() (uint32, error) { return 0, nil }
+
+var _ starlark.Callable = (*ReadFileBuiltin)(nil)
+
+// ReadFileBuiltin is `read_file(path)`: it returns the content of the file, as a string.
+//
+// Errors:
+//
+//   - wfx-action-error-read -- if the file can't be read.
+type ReadFileBuiltin struct{}
+
+func (a *ReadFileBuiltin) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("read_file", args, kwargs, "path", &p); err != nil {
+		return starlark.None, err
+	}
+	RecordOf(thread).AddInput(p)
+	body, err := os.ReadFile(resolvePath(thread, p))
+	if err != nil {
+		return starlark.None, Error(wfxapi.EcodeActionRead, "read_file", err, "path", p)
+	}
+	return starlark.String(body), nil
+}
+
+func (a *ReadFileBuiltin) Name() string          { return "read_file()" }
+func (a *ReadFileBuiltin) String() string        { return "read_file()" }
+func (a *ReadFileBuiltin) Type() string          { return "<builtin:read_file>" }
+func (a *ReadFileBuiltin) Freeze()               {}
+func (a *ReadFileBuiltin) Truth() starlark.Bool  { return starlark.True }
+func (a *ReadFileBuiltin) Hash() (uint32, error) { return 0, nil }
+
+var _ starlark.Callable = (*ReadJSONBuiltin)(nil)
+
+// ReadJSONBuiltin is `read_json(path)`: it returns the content of the file, parsed as JSON
+// (objects become dicts, arrays become lists, and so on; as with json.decode).
+//
+// Errors:
+//
+//   - wfx-action-error-read -- if the file can't be read, or isn't valid JSON.
+type ReadJSONBuiltin struct{}
+
+func (a *ReadJSONBuiltin) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var p string
+	if err := UnpackArgs("read_json", args, kwargs, "path", &p); err != nil {
+		return starlark.None, err
+	}
+	RecordOf(thread).AddInput(p)
+	body, err := os.ReadFile(resolvePath(thread, p))
+	if err != nil {
+		return starlark.None, Error(wfxapi.EcodeActionRead, "read_json", err, "path", p)
+	}
+	v, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(body)}, nil)
+	if err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			err = errors.New(strings.TrimPrefix(evalErr.Msg, "json.decode: "))
+		}
+		return starlark.None, Error(wfxapi.EcodeActionRead, "read_json", err, "path", p)
+	}
+	return v, nil
+}
+
+func (a *ReadJSONBuiltin) Name() string          { return "read_json()" }
+func (a *ReadJSONBuiltin) String() string        { return "read_json()" }
+func (a *ReadJSONBuiltin) Type() string          { return "<builtin:read_json>" }
+func (a *ReadJSONBuiltin) Freeze()               {}
+func (a *ReadJSONBuiltin) Truth() starlark.Bool  { return starlark.True }
+func (a *ReadJSONBuiltin) Hash() (uint32, error) { return 0, nil }
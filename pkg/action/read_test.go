@@ -0,0 +1,43 @@
+package action
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestGlobMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"src/*.go", "src/main.go", true},
+		{"src/*.go", "src/pkg/util.go", false},
+		{"src/**/*.go", "src/main.go", true},
+		{"src/**/*.go", "src/pkg/deep/util.go", true},
+		{"src/**/*.go", "srcs/main.go", false},
+		{"**/*_test.go", "main_test.go", true},
+		{"**/*_test.go", "a/b/main_test.go", true},
+		{"**", "anything/at/all", true},
+		{"src/**", "src", true},
+		{"a/?/[bc].txt", "a/x/c.txt", true},
+		{"a/?/[bc].txt", "a/xy/c.txt", false},
+	} {
+		qt.Check(t, globMatch(tc.pattern, tc.name), qt.Equals, tc.match, qt.Commentf("%s vs %s", tc.pattern, tc.name))
+	}
+}
+
+func TestGlobCouldMatchWithin(t *testing.T) {
+	qt.Check(t, globCouldMatchWithin("src/*.go", "src"), qt.IsTrue)
+	qt.Check(t, globCouldMatchWithin("src/*.go", "src/pkg"), qt.IsFalse)
+	qt.Check(t, globCouldMatchWithin("src/**/*.go", "src/pkg/deep"), qt.IsTrue)
+	qt.Check(t, globCouldMatchWithin("src/**/*.go", "docs"), qt.IsFalse)
+}
+
+func TestGlobBase(t *testing.T) {
+	qt.Check(t, globBase("src/**/*.go"), qt.Equals, "src")
+	qt.Check(t, globBase("src/pkg/*.go"), qt.Equals, "src/pkg")
+	qt.Check(t, globBase("*.json"), qt.Equals, ".")
+	qt.Check(t, globBase("**/x"), qt.Equals, ".")
+	qt.Check(t, globBase("VERSION"), qt.Equals, "VERSION")
+}
@@ -0,0 +1,83 @@
+package action
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"go.starlark.net/starlark"
+)
+
+// Record accumulates what a target touched while it ran: the paths it read, and the paths it produced.
+// Declarations in the target's signature (e.g. "fx_files") say what a target is expected to touch;
+// a Record says what it actually did, as reported by the actions that know (write_file, template, etc).
+//
+// The Record for the target being evaluated is in the "record" thread local.
+// It's safe for concurrent use (actions in a pipe may report at the same time).
+type Record struct {
+	mu      sync.Mutex
+	inputs  map[string]struct{}
+	outputs map[string]struct{}
+}
+
+// RecordOf returns the Record in the thread, or nil if there isn't one.
+// All the methods on Record are safe to call on nil (and do nothing), so callers needn't check.
+func RecordOf(thread *starlark.Thread) *Record {
+	r, _ := thread.Local("record").(*Record)
+	return r
+}
+
+// AddInput notes that a path was read.
+func (r *Record) AddInput(path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inputs == nil {
+		r.inputs = map[string]struct{}{}
+	}
+	r.inputs[filepath.Clean(path)] = struct{}{}
+}
+
+// AddOutput notes that a path was produced.
+func (r *Record) AddOutput(path string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.outputs == nil {
+		r.outputs = map[string]struct{}{}
+	}
+	r.outputs[filepath.Clean(path)] = struct{}{}
+}
+
+// Inputs returns the paths that were read, sorted.
+func (r *Record) Inputs() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedSet(r.inputs)
+}
+
+// Outputs returns the paths that were produced, sorted.
+func (r *Record) Outputs() []string {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return sortedSet(r.outputs)
+}
+
+func sortedSet(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,293 @@
+package action
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Processes can be run in a sandbox, so that they can only change what they're supposed to:
+`cmd("...", sandbox=True)` lets a command write only the outputs its target declares (its "fx_files"),
+and `sandboxed(act, rw=[...], ro=[...], network=False)` runs every command within act with exactly the given permissions.
+
+In a sandbox, the whole filesystem is read-only, except for the paths that are declared writable (and everything within them).
+That includes /tmp: declare it (or some part of it) if the command needs it.
+Paths declared read-only are read-only even within a writable one (e.g. `rw=["."], ro=[".git"]`).
+A writable path that doesn't exist yet gets an empty placeholder, which is what's made writable: a directory, if the path ends with a slash
+(like "out/"), or otherwise a file.  (Placeholders that are still empty and untouched afterwards are removed again.)
+The command can write into a placeholder, but since it's mounted there, it can't remove or replace it (e.g. by renaming another file over it).
+Without network access, a process has only a loopback interface of its own.
+
+Only processes are sandboxed: actions that wfx does itself, like write_file, are not.
+
+On Linux, this uses user and mount (and network) namespaces, so it doesn't need any privileges.
+Elsewhere, or if the kernel doesn't allow unprivileged namespaces, sandboxed commands fail with wfx-sandbox-unavailable.
+
+A process that tries to write somewhere it may not just gets an error from the system ("Read-only file system"), as it would anywhere read-only,
+and what it does about that is up to it.  If it then fails, and its stderr says that was the problem, the error is wfx-sandbox-violation.
+*/
+
+// Sandbox describes what a sandboxed process may do.
+type Sandbox struct {
+	RW      []string // Paths that may be written (and everything within them).  Relative paths are relative to the WorkDir.
+	RO      []string // Paths that may not be written, even within an RW path.
+	Network bool     // Whether the process has the host's network.
+}
+
+type sandboxKey struct{}
+
+// WithSandbox returns a context under which processes run by actions are sandboxed as sb describes.
+func WithSandbox(ctx context.Context, sb *Sandbox) context.Context {
+	return context.WithValue(ctx, sandboxKey{}, sb)
+}
+
+// SandboxOf returns the sandbox that processes should run in, if a controller set one with WithSandbox; otherwise nil.
+func SandboxOf(ctx context.Context) *Sandbox {
+	sb, _ := ctx.Value(sandboxKey{}).(*Sandbox)
+	return sb
+}
+
+// Outputs returns the paths that the target being run declares it owns (its "fx_files", from the "outputs" thread local),
+// relative to the WorkDir.
+func Outputs(thread *starlark.Thread) []string {
+	outputs, _ := thread.Local("outputs").([]string)
+	return outputs
+}
+
+// resolve returns the sandbox's paths, made absolute (relative ones are taken relative to dir), with symlinks resolved:
+// mounts are listed by their real paths, so that's what they'll be compared with.
+// An RW path that doesn't exist yet gets an empty placeholder, so that exactly that path can be made writable
+// (a directory, if the path ends with a slash; otherwise a file), along with any directories it needs to be in.
+// Call cleanup after the process has finished: it removes the placeholders (and those directories) again, if they're still untouched.
+func (sb *Sandbox) resolve(dir string) (rw, ro []string, cleanup func(), err error) {
+	var created []string // In the order they were made, so parents come first.
+	var placeholders []placeholder
+	cleanup = func() {
+		for _, ph := range placeholders {
+			if ph.untouched() {
+				os.Remove(ph.path)
+			}
+		}
+		for i := len(created) - 1; i >= 0; i-- {
+			os.Remove(created[i]) // Only works if it's (still) empty, which is the point.
+		}
+	}
+	abs := func(p string) (string, error) {
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		return filepath.Abs(p)
+	}
+	real := func(p string) (string, error) {
+		r, err := filepath.EvalSymlinks(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return p, nil
+		}
+		return r, err
+	}
+	for _, p := range sb.RW {
+		isDir := strings.HasSuffix(p, "/")
+		p, err := abs(p)
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		if _, err := os.Lstat(p); errors.Is(err, fs.ErrNotExist) {
+			dirs, err := mkdirAllNoting(filepath.Dir(p))
+			created = append(created, dirs...)
+			if err == nil {
+				var ph placeholder
+				ph, err = makePlaceholder(p, isDir)
+				placeholders = append(placeholders, ph)
+			}
+			if err != nil {
+				cleanup()
+				return nil, nil, nil, err
+			}
+		}
+		if p, err = real(p); err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		rw = append(rw, p)
+	}
+	for _, p := range sb.RO {
+		p, err := abs(p)
+		if err == nil {
+			p, err = real(p)
+		}
+		if err != nil {
+			cleanup()
+			return nil, nil, nil, err
+		}
+		ro = append(ro, p)
+	}
+	return rw, ro, cleanup, nil
+}
+
+// placeholder is an empty file or directory, made to stand in for a writable path that didn't exist yet.
+type placeholder struct {
+	path string
+	made fs.FileInfo
+}
+
+func makePlaceholder(p string, isDir bool) (placeholder, error) {
+	var err error
+	if isDir {
+		err = os.Mkdir(p, 0755)
+	} else {
+		var f *os.File
+		if f, err = os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644); err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return placeholder{}, err
+	}
+	info, err := os.Lstat(p)
+	return placeholder{path: p, made: info}, err
+}
+
+// untouched returns true if the placeholder is still as it was made: an empty directory, or an empty file that hasn't been written.
+func (ph placeholder) untouched() bool {
+	if ph.made == nil {
+		return false
+	}
+	info, err := os.Lstat(ph.path)
+	if err != nil || info.Mode() != ph.made.Mode() {
+		return false
+	}
+	if info.IsDir() {
+		entries, err := os.ReadDir(ph.path)
+		return err == nil && len(entries) == 0
+	}
+	return info.Size() == 0 && info.ModTime().Equal(ph.made.ModTime())
+}
+
+// mkdirAllNoting is os.MkdirAll, but it returns the directories it made (parents first).
+func mkdirAllNoting(dir string) ([]string, error) {
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Lstat(d); err == nil || !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+		missing = append(missing, d)
+		if filepath.Dir(d) == d {
+			break
+		}
+	}
+	var made []string
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Mkdir(missing[i], 0755); err != nil {
+			return made, err
+		}
+		made = append(made, missing[i])
+	}
+	return made, nil
+}
+
+// runProcessIn is runProcess, but in the sandbox sb describes (unless it's nil).
+// If the sandbox couldn't be set up, problem says why (and err is whatever went wrong as a result).
+func runProcessIn(ctx context.Context, cmd *exec.Cmd, sb *Sandbox) (problem string, err error) {
+	if sb == nil {
+		return "", runProcess(ctx, cmd)
+	}
+	rw, ro, cleanup, err := sb.resolve(cmd.Dir)
+	if err != nil {
+		return err.Error(), err
+	}
+	defer cleanup()
+	done, err := sandboxCommand(cmd, rw, ro, sb.Network)
+	if err != nil {
+		return err.Error(), err
+	}
+	err = runProcess(ctx, cmd)
+	if problem := done(); problem != "" {
+		return problem, err
+	}
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return err.Error(), err // It couldn't even be started: the kernel may not allow namespaces, for example.
+	}
+	return "", err
+}
+
+// sandboxViolations are what processes usually say on stderr when the sandbox stops them doing something.
+var sandboxViolations = []string{
+	"Read-only file system",  // EROFS
+	"Network is unreachable", // ENETUNREACH
+}
+
+// errorSandboxViolation returns a wfx-sandbox-violation error if a sandboxed process's stderr suggests that's why it failed; otherwise nil.
+func errorSandboxViolation(incantation string, stderrTail string) error {
+	for _, s := range sandboxViolations {
+		if strings.Contains(stderrTail, s) {
+			return serum.Error(wfxapi.EcodeSandboxViolation, withStderrTail(stderrTail,
+				serum.WithMessageTemplate("cmd {{cmd|q}} failed, after trying to do something its sandbox doesn't allow ({{problem}})"),
+				serum.WithDetail("cmd", incantation),
+				serum.WithDetail("problem", s),
+			)...)
+		}
+	}
+	return nil
+}
+
+// errorSandboxUnavailable is for when a sandbox can't be set up.
+func errorSandboxUnavailable(incantation string, reason string) error {
+	return serum.Error(wfxapi.EcodeSandboxUnavailable,
+		serum.WithMessageTemplate("cmd {{cmd|q}} could not be run in a sandbox: {{reason}}"),
+		serum.WithDetail("cmd", incantation),
+		serum.WithDetail("reason", reason),
+	)
+}
+
+var _ starlark.Callable = (*SandboxedControllerConstructor)(nil)
+
+// SandboxedControllerConstructor is `sandboxed(act, rw=[], ro=[], network=True)`:
+// it produces an action that runs the given action, with every process it runs sandboxed (see Sandbox):
+// they can only write to the rw paths, and, if network is False, can't reach the network.
+type SandboxedControllerConstructor struct{}
+
+func (a *SandboxedControllerConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var inner *ActionPlan
+	var rw, ro *starlark.List
+	network := true
+	if err := UnpackArgs("sandboxed", args, kwargs, "act", &inner, "rw?", &rw, "ro?", &ro, "network?", &network); err != nil {
+		return starlark.None, err
+	}
+	sb := &Sandbox{Network: network}
+	var err error
+	if sb.RW, err = stringList("sandboxed", "rw", rw); err != nil {
+		return starlark.None, err
+	}
+	if sb.RO, err = stringList("sandboxed", "ro", ro); err != nil {
+		return starlark.None, err
+	}
+	ap := &ActionPlan{
+		Name_:   "Sandboxed",
+		Details: inner,
+	}
+	ap.Run = func(ctx context.Context) error {
+		inner.InheritIO(ap)
+		return inner.Execute(WithSandbox(ctx, sb), thread)
+	}
+	return ap, nil
+}
+
+func (a *SandboxedControllerConstructor) Name() string          { return "sandboxed()" }
+func (a *SandboxedControllerConstructor) String() string        { return "sandboxed()" }
+func (a *SandboxedControllerConstructor) Type() string          { return "<action:sandboxed>" }
+func (a *SandboxedControllerConstructor) Freeze()               {}
+func (a *SandboxedControllerConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *SandboxedControllerConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *SandboxedControllerConstructor) MakesPlan()            {}
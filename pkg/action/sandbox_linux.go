@@ -0,0 +1,298 @@
+//go:build linux
+
+package action
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+/*
+A sandboxed process is started in new user and mount (and maybe network) namespaces,
+where it can arrange its own mounts without any privileges on the host.
+But Go can't run code between forking and execing the process, so it's started as a copy of this program
+(which gets here, via init, before doing anything else), with the sandbox's settings in an environment variable.
+That sets up the mounts, drops every privilege, and then execs the real command in its place.
+If anything goes wrong before that, it says what on a pipe, which the exec closes if all's well.
+*/
+
+// sandboxEnvVar holds the sandboxConfig, for the copy of this program that sets up a sandbox.
+const sandboxEnvVar = "_WFX_SANDBOX"
+
+// sandboxConfig is what the copy of this program that sets up a sandbox needs to know.
+type sandboxConfig struct {
+	RW      []string // Absolute.
+	RO      []string // Absolute.
+	Network bool
+}
+
+// Capabilities (see capabilities(7)) that setting up a sandbox needs.
+const (
+	capSetpcap  = 8
+	capNetAdmin = 12
+	capSysAdmin = 21
+)
+
+// For prctl(2) and capget(2), which the syscall package has no constants for.
+const (
+	prCapbsetDrop           = 24
+	prSetNoNewPrivs         = 38
+	prCapAmbient            = 47
+	prCapAmbientClearAll    = 4
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+func init() {
+	if config, ok := os.LookupEnv(sandboxEnvVar); ok {
+		sandboxInit(config) // Doesn't return.
+	}
+}
+
+// sandboxCommand changes cmd (which must not have been started) so that it runs in a sandbox, where only rw is writable (except for ro).
+// After the process has finished, call done: it says why the sandbox couldn't be set up, if it couldn't (and otherwise returns "").
+func sandboxCommand(cmd *exec.Cmd, rw, ro []string, network bool) (done func() string, err error) {
+	config, err := json.Marshal(sandboxConfig{RW: rw, RO: ro, Network: network})
+	if err != nil {
+		return nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	env := cmd.Env
+	if env == nil {
+		env = os.Environ()
+	}
+	cmd.Env = append(env[:len(env):len(env)], sandboxEnvVar+"="+string(config))
+	cmd.Args = append([]string{"wfx-sandbox", cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.ExtraFiles = append(cmd.ExtraFiles, w) // fd 3, as long as there weren't any others.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	sys := cmd.SysProcAttr
+	sys.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS
+	if !network {
+		sys.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	// Inside, we're who we are outside; and only that.
+	sys.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	sys.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	sys.GidMappingsEnableSetgroups = false
+	// Keep the capabilities that come with the new user namespace through the exec, so the mounts can be set up (they're dropped after that).
+	sys.AmbientCaps = []uintptr{capSysAdmin, capNetAdmin, capSetpcap}
+	return func() string {
+		w.Close()
+		defer r.Close()
+		var msg strings.Builder
+		bufio.NewReader(r).WriteTo(&msg)
+		return msg.String()
+	}, nil
+}
+
+// sandboxInit is the start of the copy of this program that sets up a sandbox, and then execs the command (os.Args[1:]).
+func sandboxInit(config string) {
+	status := os.NewFile(3, "sandbox status")
+	fail := func(err error) {
+		status.WriteString(err.Error())
+		os.Exit(125)
+	}
+	os.Unsetenv(sandboxEnvVar)
+	syscall.CloseOnExec(3)
+	var c sandboxConfig
+	if err := json.Unmarshal([]byte(config), &c); err != nil {
+		fail(err)
+	}
+	if len(os.Args) < 2 {
+		fail(errors.New("no command"))
+	}
+	if err := c.setup(); err != nil {
+		fail(err)
+	}
+	if err := dropPrivileges(); err != nil {
+		fail(err)
+	}
+	err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	fail(fmt.Errorf("exec %s: %w", os.Args[1], err))
+}
+
+// setup arranges the mounts, and network, for the sandbox.
+func (c sandboxConfig) setup() error {
+	// Nothing we do here should be seen outside.
+	if err := syscall.Mount("none", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %w", err)
+	}
+	// Bind-mount the paths that are to be treated differently onto themselves, so each is its own mount, with its own flags.
+	for _, path := range append(c.RW, c.RO...) {
+		if err := syscall.Mount(path, path, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("bind-mounting %s: %w", path, err)
+		}
+	}
+	mounts, err := mountPoints()
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if within(mount, c.RW) && !within(mount, c.RO) {
+			continue
+		}
+		if err := remountReadonly(mount); err != nil {
+			return err
+		}
+	}
+	if !c.Network {
+		if err := loopbackUp(); err != nil {
+			return fmt.Errorf("bringing up the loopback interface: %w", err)
+		}
+	}
+	return nil
+}
+
+// within returns true if path is one of the paths, or within one of them.
+func within(path string, paths []string) bool {
+	for _, p := range paths {
+		if path == p || strings.HasPrefix(path, p+"/") || p == "/" {
+			return true
+		}
+	}
+	return false
+}
+
+// mountPoints lists where everything is mounted (parents before what's mounted within them).
+func mountPoints() ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var res []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		res = append(res, unescapeMountinfo(fields[4]))
+	}
+	return res, scanner.Err()
+}
+
+// unescapeMountinfo undoes the octal escapes (like `\040` for space) in paths in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// remountReadonly makes the mount at path read-only.
+// The mount's other flags are kept as they are, since some (like nosuid) can't be changed by us.
+// Mounts we can't reach (because they're hidden, or not accessible to us anyway) are left alone.
+func remountReadonly(path string) error {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.EACCES) {
+			return nil
+		}
+		return fmt.Errorf("inspecting mount %s: %w", path, err)
+	}
+	// The ST_ flags from statfs that we need to keep have the same values as the MS_ flags for mount.
+	flags := uintptr(st.Flags) & (syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+	if err := syscall.Mount("none", path, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, ""); err != nil {
+		return fmt.Errorf("making mount %s read-only: %w", path, err)
+	}
+	return nil
+}
+
+// loopbackUp brings up the loopback interface (which, in a new network namespace, starts down).
+func loopbackUp() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	var ifr struct {
+		name  [syscall.IFNAMSIZ]byte
+		flags uint16
+		_     [22]byte
+	}
+	copy(ifr.name[:], "lo")
+	ifr.flags = syscall.IFF_UP | syscall.IFF_RUNNING
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr))); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// dropPrivileges gives up the capabilities that setting up the sandbox needed, for good,
+// so that the command can't undo any of it.
+func dropPrivileges() error {
+	last, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return err
+	}
+	lastCap, err := strconv.Atoi(strings.TrimSpace(string(last)))
+	if err != nil {
+		return err
+	}
+	// Without these in the bounding set, not even root (as we are, inside, if we're root outside) gets them back on exec.
+	for c := 0; c <= lastCap; c++ {
+		if err := prctl(prCapbsetDrop, uintptr(c), 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("dropping capabilities: %w", err)
+		}
+	}
+	if err := prctl(prCapAmbient, prCapAmbientClearAll, 0); err != nil {
+		return fmt.Errorf("dropping capabilities: %w", err)
+	}
+	if err := clearInheritableCaps(); err != nil {
+		return fmt.Errorf("dropping capabilities: %w", err)
+	}
+	if err := prctl(prSetNoNewPrivs, 1, 0); err != nil {
+		return fmt.Errorf("setting no_new_privs: %w", err)
+	}
+	return nil
+}
+
+func prctl(option, arg2, arg3 uintptr) error {
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, option, arg2, arg3, 0, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// clearInheritableCaps empties the inheritable capability set (which the Go runtime filled, to make the ambient ones possible).
+func clearInheritableCaps() error {
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: linuxCapabilityVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0); errno != 0 {
+		return errno
+	}
+	data[0].inheritable, data[1].inheritable = 0, 0
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data)), 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+//go:build linux
+
+package action
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSandbox(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.MkdirAll(filepath.Join(dir, "rw", "ro"), 0755), qt.IsNil)
+	cwd := dir
+	run := func(script string, sb *Sandbox) (problem string, stderr string, err error) {
+		cmd := exec.Command("/bin/sh", "-c", script)
+		cmd.Dir = cwd
+		var buf strings.Builder
+		cmd.Stderr = &buf
+		problem, err = runProcessIn(context.Background(), cmd, sb)
+		return problem, buf.String(), err
+	}
+	sb := &Sandbox{RW: []string{"rw", "new/file.txt", "newdir/", "unused/file.txt"}, RO: []string{"rw/ro"}, Network: true}
+
+	problem, _, err := run("echo a > rw/a && echo b > new/file.txt && echo c > newdir/c", sb)
+	qt.Assert(t, problem, qt.Equals, "")
+	qt.Assert(t, err, qt.IsNil)
+	bs, err := os.ReadFile(filepath.Join(dir, "new", "file.txt"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, string(bs), qt.Equals, "b\n")
+	bs, err = os.ReadFile(filepath.Join(dir, "newdir", "c"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, string(bs), qt.Equals, "c\n")
+	// Placeholders for paths that didn't get written are cleaned up.
+	_, err = os.Stat(filepath.Join(dir, "unused"))
+	qt.Check(t, os.IsNotExist(err), qt.IsTrue)
+
+	// Only the declared path is writable, not what's next to it.
+	for _, path := range []string{"outside", "rw/ro/inside", "new/sibling.txt"} {
+		problem, stderr, err := run("echo x > "+path, sb)
+		qt.Check(t, problem, qt.Equals, "")
+		qt.Check(t, err, qt.IsNotNil)
+		qt.Check(t, stderr, qt.Contains, "Read-only file system")
+		qt.Check(t, errorSandboxViolation("", stderr), qt.IsNotNil)
+		_, err = os.Stat(filepath.Join(dir, path))
+		qt.Check(t, os.IsNotExist(err), qt.IsTrue, qt.Commentf("%s", path))
+	}
+
+	// The sandbox doesn't leak out: the same thing works outside of it.
+	problem, _, err = run("echo x > outside", nil)
+	qt.Check(t, problem, qt.Equals, "")
+	qt.Check(t, err, qt.IsNil)
+
+	// Reaching the directory by way of a symlink makes no difference.
+	cwd = filepath.Join(t.TempDir(), "link")
+	qt.Assert(t, os.Symlink(dir, cwd), qt.IsNil)
+	problem, stderr, err := run("echo a > rw/a && echo b > new/file.txt", sb)
+	qt.Check(t, problem, qt.Equals, "")
+	qt.Check(t, err, qt.IsNil, qt.Commentf("%s", stderr))
+	_, stderr, err = run("echo x > new/sibling.txt", sb)
+	qt.Check(t, err, qt.IsNotNil)
+	qt.Check(t, stderr, qt.Contains, "Read-only file system")
+}
+
+func TestSandboxNetwork(t *testing.T) {
+	cmd := exec.Command("/bin/sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '")
+	var out strings.Builder
+	cmd.Stdout = &out
+	problem, err := runProcessIn(context.Background(), cmd, &Sandbox{})
+	qt.Assert(t, problem, qt.Equals, "")
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, out.String(), qt.Equals, "lo\n")
+}
+
+func TestUnescapeMountinfo(t *testing.T) {
+	qt.Check(t, unescapeMountinfo(`/mnt/with\040space`), qt.Equals, "/mnt/with space")
+	qt.Check(t, unescapeMountinfo(`/plain`), qt.Equals, "/plain")
+	qt.Check(t, unescapeMountinfo(`/trailing\`), qt.Equals, `/trailing\`)
+}
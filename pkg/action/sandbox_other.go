@@ -0,0 +1,13 @@
+//go:build !linux
+
+package action
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// sandboxCommand would change cmd so that it runs in a sandbox; but that needs Linux.
+func sandboxCommand(cmd *exec.Cmd, rw, ro []string, network bool) (done func() string, err error) {
+	return nil, errors.New("sandboxes are only supported on Linux")
+}
@@ -0,0 +1,154 @@
+package action
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// Redacted is what secret values are replaced with.
+const Redacted = "[redacted]"
+
+// Secrets is a set of values that must not be shown: they're redacted from action output that goes to the user,
+// from the stderr that's attached to errors, and from events (see RedactingEventSink).
+// (Output that's wired elsewhere -- e.g. into the next action in a pipe, or into a file -- is left alone, of course.)
+//
+// It's found in the "secrets" thread local.  Values can be added at any time (e.g. by the `env` controller), and are never removed.
+// A nil *Secrets is valid, and contains nothing.
+type Secrets struct {
+	mu     sync.RWMutex
+	values []string // longest first, so that a secret that contains another is redacted whole.
+}
+
+// SecretsOf returns the Secrets of the thread (from the "secrets" thread local), or nil if it has none.
+func SecretsOf(thread *starlark.Thread) *Secrets {
+	s, _ := thread.Local("secrets").(*Secrets)
+	return s
+}
+
+// Add adds values to the set.  Empty strings are ignored.
+func (s *Secrets) Add(values ...string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		if v != "" && !containsString(s.values, v) {
+			s.values = append(s.values, v)
+		}
+	}
+	sort.SliceStable(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+// Empty returns true if there's nothing to redact.
+func (s *Secrets) Empty() bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.values) == 0
+}
+
+// Redact returns str with every secret value in it replaced by Redacted.
+func (s *Secrets) Redact(str string) string {
+	if s == nil {
+		return str
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, v := range s.values {
+		str = strings.ReplaceAll(str, v, Redacted)
+	}
+	return str
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// redactingWriter is a writer that redacts secrets from what's written through it.
+// It works a line at a time (so that a secret split across writes is still caught);
+// partial lines are held back until they're completed, or until Flush.
+type redactingWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	secrets *Secrets
+	partial []byte
+}
+
+func (r *redactingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.partial = append(r.partial, p...)
+	i := bytes.LastIndexByte(r.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := string(r.partial[:i+1])
+	r.partial = append(r.partial[:0], r.partial[i+1:]...)
+	if _, err := io.WriteString(r.w, r.secrets.Redact(lines)); err != nil {
+		return len(p), err
+	}
+	return len(p), nil
+}
+
+// Flush writes out any partial line (without terminating it).
+func (r *redactingWriter) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.partial) > 0 {
+		io.WriteString(r.w, r.secrets.Redact(string(r.partial)))
+		r.partial = nil
+	}
+}
+
+// RedactingEventSink returns an EventSink that redacts secrets from events (the command, label, reason, and error or warning),
+// then passes them along to sink.
+// Secrets added after this is called are redacted too.
+func RedactingEventSink(sink wfxapi.EventSink, secrets *Secrets) wfxapi.EventSink {
+	return &redactingEventSink{sink: sink, secrets: secrets}
+}
+
+type redactingEventSink struct {
+	sink    wfxapi.EventSink
+	secrets *Secrets
+}
+
+func (r *redactingEventSink) Emit(ev wfxapi.Event) {
+	if !r.secrets.Empty() {
+		ev.Cmd = r.secrets.Redact(ev.Cmd)
+		ev.Label = r.secrets.Redact(ev.Label)
+		ev.Reason = r.secrets.Redact(ev.Reason)
+		ev.Error = r.secrets.redactErrorInfo(ev.Error)
+		ev.Warning = r.secrets.redactErrorInfo(ev.Warning)
+	}
+	r.sink.Emit(ev)
+}
+
+// redactErrorInfo returns a copy of ei with secrets redacted from its message and details.
+func (s *Secrets) redactErrorInfo(ei *wfxapi.EventErrorInfo) *wfxapi.EventErrorInfo {
+	if ei == nil {
+		return nil
+	}
+	res := &wfxapi.EventErrorInfo{Code: ei.Code, Message: s.Redact(ei.Message)}
+	if ei.Details != nil {
+		res.Details = make(map[string]string, len(ei.Details))
+		for k, v := range ei.Details {
+			res.Details[k] = s.Redact(v)
+		}
+	}
+	return res
+}
@@ -0,0 +1,223 @@
+package action
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+var _ starlark.Callable = (*ActionPlanConstructor)(nil)
+
+// ActionPlanConstructor is `action(fn, name=?)`: it makes an ActionPlan out of a starlark function.
+//
+// When the action is run, fn is called with its IO:
+// `stdin` is an iterable of lines (without their trailing newline; `stdin.read()` gets everything that's left instead),
+// and `stdout` and `stderr` are writers, with `write(s)` and `writeln(s="")` methods.
+// fn only gets the ones it has parameters for, by name -- so `def upper(stdin, stdout):` is fine.
+// Its return value is ignored; if it fails (e.g. with `fail()`), the action fails.
+//
+// This makes it possible to write filters in starlark, and compose them with other actions, like any other action:
+//
+//	def shout(stdin, stdout):
+//		for line in stdin:
+//			stdout.writeln(line.upper())
+//
+//	def loudly(fx):
+//		pipe(cmd("ls"), action(shout), cmd("sort"))
+//
+// Since controllers like pipe run their actions concurrently, fn is called on a thread of its own.
+type ActionPlanConstructor struct{}
+
+func (a *ActionPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var fn starlark.Callable
+	var name string
+	if err := UnpackArgs("action", args, kwargs, "fn", &fn, "name?", &name); err != nil {
+		return starlark.None, err
+	}
+	if name == "" {
+		name = fn.Name()
+	}
+	ap := &ActionPlan{
+		Name_:   "Action",
+		Label:   name,
+		Details: name,
+	}
+	ap.Run = func(ctx context.Context) error {
+		streams := ap.Streams(thread)
+		fnThread := forkThread(thread, "action:"+name)
+		fnThread.SetLocal("ctx", ctx)
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				fnThread.Cancel(ctx.Err().Error())
+			case <-stop:
+			}
+		}()
+		streamValues := map[string]starlark.Value{
+			"stdin":  &lineReader{r: bufio.NewReader(streams.Stdin)},
+			"stdout": &lineWriter{name: "stdout", w: streams.Stdout},
+			"stderr": &lineWriter{name: "stderr", w: streams.Stderr},
+		}
+		var fnKwargs []starlark.Tuple
+		for _, k := range []string{"stdin", "stdout", "stderr"} {
+			if f, ok := fn.(*starlark.Function); ok && !hasParam(f, k) {
+				continue
+			}
+			fnKwargs = append(fnKwargs, starlark.Tuple{starlark.String(k), streamValues[k]})
+		}
+		_, err := starlark.Call(fnThread, fn, nil, fnKwargs)
+		stderrTail := streams.Close()
+		// Whatever's writing to us (if anything) would block forever if fn stopped reading early, so drain the rest.
+		// (Closing our end instead would make the writer fail, which is worse: it's not the one that did anything wrong.)
+		io.Copy(io.Discard, streams.Stdin)
+		if err == nil {
+			return nil
+		}
+		// If what failed was an action that fn did, that's the error that matters.
+		// Either way, it says where in fn it happened.
+		var serr serum.ErrorInterface
+		if errors.As(err, &serr) {
+			return wfxapi.WithStarlarkBacktrace(err)
+		}
+		pos, stack := wfxapi.Backtrace(err)
+		return wfxapi.WithScriptPosition(serum.Error(wfxapi.EcodeActionStarlark, withStderrTail(stderrTail,
+			serum.WithMessageTemplate("action {{fn|q}} failed: {{reason}}"),
+			serum.WithDetail("fn", name),
+			serum.WithDetail("reason", err.Error()),
+		)...), pos, stack)
+	}
+	return ap, nil
+}
+
+func (a *ActionPlanConstructor) Name() string          { return "action()" }
+func (a *ActionPlanConstructor) String() string        { return "action()" }
+func (a *ActionPlanConstructor) Type() string          { return "<actionPlanConstructor:action>" }
+func (a *ActionPlanConstructor) Freeze()               {}
+func (a *ActionPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *ActionPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *ActionPlanConstructor) MakesPlan()            {}
+
+func hasParam(fn *starlark.Function, name string) bool {
+	for i := 0; i < fn.NumParams(); i++ {
+		if pname, _ := fn.Param(i); pname == name {
+			return true
+		}
+	}
+	return false
+}
+
+// threadLocals are the thread locals that actions look at.
+// forkThread copies them, since starlark doesn't offer a way to list a thread's locals.
+var threadLocals = []string{"ctx", "stdout", "stderr", "target", "verbosity", "events", "record", "dir", "env", "secrets", "outputs"}
+
+// forkThread makes a new thread that's set up like the given one, for running starlark code concurrently with it.
+// (Starlark threads can't be used concurrently; and controllers like pipe run actions concurrently.)
+func forkThread(thread *starlark.Thread, name string) *starlark.Thread {
+	forked := &starlark.Thread{
+		Name:  name,
+		Print: thread.Print,
+		Load:  thread.Load,
+	}
+	for _, k := range threadLocals {
+		if v := thread.Local(k); v != nil {
+			forked.SetLocal(k, v)
+		}
+	}
+	return forked
+}
+
+var (
+	_ starlark.Iterable = (*lineReader)(nil)
+	_ starlark.HasAttrs = (*lineReader)(nil)
+)
+
+// lineReader is the `stdin` that functions given to `action` get.
+type lineReader struct {
+	r *bufio.Reader
+}
+
+func (lr *lineReader) String() string        { return "<stdin>" }
+func (lr *lineReader) Type() string          { return "stdin" }
+func (lr *lineReader) Freeze()               {}
+func (lr *lineReader) Truth() starlark.Bool  { return starlark.True }
+func (lr *lineReader) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: stdin") }
+func (lr *lineReader) Iterate() starlark.Iterator {
+	return &lineIterator{lr}
+}
+func (lr *lineReader) AttrNames() []string { return []string{"read"} }
+func (lr *lineReader) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "read":
+		return starlark.NewBuiltin("read", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if err := UnpackArgs("read", args, kwargs); err != nil {
+				return starlark.None, err
+			}
+			bs, err := io.ReadAll(lr.r)
+			return starlark.String(bs), err
+		}), nil
+	}
+	return nil, nil
+}
+
+type lineIterator struct {
+	lr *lineReader
+}
+
+func (it *lineIterator) Next(p *starlark.Value) bool {
+	line, err := it.lr.r.ReadString('\n')
+	if line == "" && err != nil {
+		// EOF, or the stream broke; either way, there's no more input.
+		return false
+	}
+	if line[len(line)-1] == '\n' {
+		line = line[:len(line)-1]
+	}
+	*p = starlark.String(line)
+	return true
+}
+func (it *lineIterator) Done() {}
+
+var _ starlark.HasAttrs = (*lineWriter)(nil)
+
+// lineWriter is the `stdout` and `stderr` that functions given to `action` get.
+type lineWriter struct {
+	name string
+	w    io.Writer
+}
+
+func (lw *lineWriter) String() string        { return "<" + lw.name + ">" }
+func (lw *lineWriter) Type() string          { return lw.name }
+func (lw *lineWriter) Freeze()               {}
+func (lw *lineWriter) Truth() starlark.Bool  { return starlark.True }
+func (lw *lineWriter) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", lw.name) }
+func (lw *lineWriter) AttrNames() []string   { return []string{"write", "writeln"} }
+func (lw *lineWriter) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "write", "writeln":
+		return starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var s string
+			if name == "write" {
+				if err := UnpackArgs(name, args, kwargs, "s", &s); err != nil {
+					return starlark.None, err
+				}
+			} else {
+				if err := UnpackArgs(name, args, kwargs, "s?", &s); err != nil {
+					return starlark.None, err
+				}
+				s += "\n"
+			}
+			_, err := io.WriteString(lw.w, s)
+			return starlark.None, err
+		}), nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,105 @@
+package action
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Anything can be given a time limit: `timeout(act, "30s")` works on any action,
+and `cmd("...", timeout="30s")` (or a customized `cmd`, for a default) is the shorthand for commands.
+Targets can have a time limit too, with a `timeout="1h"` parameter (that's in the wfx package, since targets aren't actions).
+
+All of these are just context deadlines.
+When a deadline passes, processes are killed -- immediately, and their whole process group,
+since unlike an interruption by the user, there's no point in waiting to see if they'll finish.
+The error is always wfx-timeout, and says how long things ran for, and what was running.
+*/
+
+var _ starlark.Callable = (*TimeoutControllerConstructor)(nil)
+
+// TimeoutControllerConstructor is `timeout(act, limit)`:
+// it produces an action that runs the given action, but fails it if it takes longer than the limit (a duration string, like "30s" or "5m").
+type TimeoutControllerConstructor struct{}
+
+func (a *TimeoutControllerConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var inner *ActionPlan
+	var limitStr string
+	if err := UnpackArgs("timeout", args, kwargs, "act", &inner, "limit", &limitStr); err != nil {
+		return starlark.None, err
+	}
+	limit, err := ParseTimeout("timeout", limitStr)
+	if err != nil {
+		return starlark.None, err
+	}
+	ap := &ActionPlan{
+		Name_:   "Timeout",
+		Details: inner,
+	}
+	ap.Run = func(ctx context.Context) error {
+		inner.InheritIO(ap)
+		ctx, cancel := context.WithTimeout(ctx, limit)
+		defer cancel()
+		start := time.Now()
+		err := inner.Execute(ctx, thread)
+		if err == nil || !TimedOut(ctx) || serum.Code(err) == wfxapi.EcodeTimeout {
+			return err
+		}
+		// The inner action wasn't a process (or didn't say it timed out); say so on its behalf.
+		return serum.Error(wfxapi.EcodeTimeout,
+			serum.WithMessageTemplate("action {{action}} timed out after {{elapsed}} (limit {{limit}})"),
+			serum.WithDetail("action", inner.String()),
+			serum.WithDetail("elapsed", FormatElapsed(time.Since(start))),
+			serum.WithDetail("limit", limit.String()),
+		)
+	}
+	return ap, nil
+}
+
+func (a *TimeoutControllerConstructor) Name() string          { return "timeout()" }
+func (a *TimeoutControllerConstructor) String() string        { return "timeout()" }
+func (a *TimeoutControllerConstructor) Type() string          { return "<action:timeout>" }
+func (a *TimeoutControllerConstructor) Freeze()               {}
+func (a *TimeoutControllerConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *TimeoutControllerConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *TimeoutControllerConstructor) MakesPlan()            {}
+
+// ParseTimeout parses a time limit given by a script, as a Go duration string (like "30s", "5m", or "1h30m").
+// The fnName is used in the error.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if the string isn't a duration, or isn't positive.
+func ParseTimeout(fnName string, s string) (time.Duration, error) {
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, serum.Errorf(wfxapi.EcodeScriptInvalid, "`%s` expects a timeout that's a positive duration, like \"30s\" or \"5m\", not %q", fnName, s)
+	}
+	return d, nil
+}
+
+// TimedOut returns true if ctx is done because its deadline passed (as opposed to, say, being interrupted).
+func TimedOut(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// FormatElapsed renders a duration for an error message: rounded, since nobody needs nanoseconds here.
+func FormatElapsed(d time.Duration) string {
+	return d.Round(time.Millisecond).String()
+}
+
+// errorCmdTimeout is for when a process was killed because its context's deadline passed.
+// If the stderrTail is nonempty, it's attached to the error as the "stderr" detail.
+func errorCmdTimeout(cmdline string, elapsed time.Duration, stderrTail string) error {
+	return serum.Error(wfxapi.EcodeTimeout, withStderrTail(stderrTail,
+		serum.WithMessageTemplate("cmd {{cmd|q}} timed out, and was killed after {{elapsed}}"),
+		serum.WithDetail("cmd", cmdline),
+		serum.WithDetail("elapsed", FormatElapsed(elapsed)),
+	)...)
+}
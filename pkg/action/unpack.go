@@ -0,0 +1,592 @@
+package action
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Unpacking never extracts anything outside of the destination:
+entries with absolute paths or ".." in them are rejected, as are symlinks whose targets would point outside the destination,
+and nothing is ever written through a symlink that came from the archive.
+Permission bits are kept, except for setuid, setgid, and sticky bits, which are dropped.
+
+The archive is unpacked into a temporary directory next to the destination, which is then renamed into place,
+so the destination is never seen half-unpacked.
+(Whatever was at the destination before is replaced entirely.)
+
+After unpacking, a small record is written next to the destination ("." + name + ".wfx-unpack"),
+noting the hash of the archive, the options used, and a hash of the resulting tree.
+If that record still matches -- same archive, same options, and the destination's content hasn't been changed since --
+unpacking again is skipped.
+*/
+
+var _ starlark.Callable = (*UnpackPlanConstructor)(nil)
+
+// UnpackPlanConstructor is `unpack(archive, dest, strip_components=0, include=[])`.
+//
+// The archive may be a tar (optionally compressed with gzip or zstd) or a zip; which it is, is detected from its content.
+// With strip_components, that many leading path segments are removed from each entry (and entries with no more segments than that are skipped).
+// With include, only entries whose path (after stripping) matches one of the globs, or is inside a directory that does, are unpacked.
+// Globs are as for path.Match.
+type UnpackPlanConstructor struct{}
+
+func (a *UnpackPlanConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var opts unpackOptions
+	var include *starlark.List
+	if err := starlark.UnpackArgs("unpack", args, kwargs, "archive", &opts.Archive, "dest", &opts.Dest, "strip_components?", &opts.StripComponents, "include?", &include); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	if opts.StripComponents < 0 {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`unpack` expects strip_components to be zero or more, not %d", opts.StripComponents)
+	}
+	if include != nil {
+		for i := 0; i < include.Len(); i++ {
+			s, ok := include.Index(i).(starlark.String)
+			if !ok {
+				return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`unpack` expects include to be a list of strings, but found a %s", include.Index(i).Type())
+			}
+			if _, err := path.Match(string(s), ""); err != nil {
+				return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`unpack` include glob %q is invalid: %s", string(s), err)
+			}
+			opts.Include = append(opts.Include, string(s))
+		}
+	}
+	ap := &ActionPlan{
+		Name_:   "Unpack",
+		Details: opts.Archive + " -> " + opts.Dest,
+	}
+	ap.Run = func(ctx context.Context) error {
+		defer closeStdout(ap)
+		RecordOf(thread).AddInput(opts.Archive)
+		resolved := opts
+		resolved.Archive = resolvePath(thread, opts.Archive)
+		resolved.Dest = resolvePath(thread, opts.Dest)
+		if err := unpack(resolved); err != nil {
+			return err
+		}
+		RecordOf(thread).AddOutput(opts.Dest)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *UnpackPlanConstructor) Name() string          { return "unpack()" }
+func (a *UnpackPlanConstructor) String() string        { return "unpack()" }
+func (a *UnpackPlanConstructor) Type() string          { return "<actionPlanConstructor:unpack>" }
+func (a *UnpackPlanConstructor) Freeze()               {}
+func (a *UnpackPlanConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *UnpackPlanConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *UnpackPlanConstructor) MakesPlan()            {}
+
+type unpackOptions struct {
+	Archive         string   `json:"-"`
+	Dest            string   `json:"-"`
+	StripComponents int      `json:"strip_components"`
+	Include         []string `json:"include,omitempty"`
+}
+
+// unpackRecord is what's stored next to an unpacked destination, to tell if it can be left alone next time.
+type unpackRecord struct {
+	ArchiveHash string        `json:"archive_sha256"`
+	Options     unpackOptions `json:"options"`
+	TreeHash    string        `json:"tree_sha256"`
+}
+
+func unpackRecordPath(dest string) string {
+	return filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".wfx-unpack")
+}
+
+// unpack does the whole job: checks the record, unpacks to a temp dir, swaps it into place, and writes the new record.
+//
+// Errors:
+//
+//   - wfx-action-error-unpack -- if the archive can't be read, or the destination can't be written.
+//   - wfx-action-error-unpack-unsafe -- if the archive contains entries that would land outside of the destination.
+func unpack(opts unpackOptions) error {
+	archiveHash, err := hashFile(opts.Archive)
+	if err != nil {
+		return errorUnpack(opts, err)
+	}
+	want := unpackRecord{ArchiveHash: archiveHash, Options: opts}
+	if recorded, err := os.ReadFile(unpackRecordPath(opts.Dest)); err == nil {
+		var have unpackRecord
+		if json.Unmarshal(recorded, &have) == nil && have.ArchiveHash == want.ArchiveHash && sameUnpackOptions(have.Options, want.Options) {
+			if treeHash, err := hashTree(opts.Dest); err == nil && treeHash == have.TreeHash {
+				return nil
+			}
+		}
+	}
+
+	parent := filepath.Dir(opts.Dest)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return errorUnpack(opts, err)
+	}
+	tmp, err := os.MkdirTemp(parent, "."+filepath.Base(opts.Dest)+".wfx-tmp-*")
+	if err != nil {
+		return errorUnpack(opts, err)
+	}
+	defer os.RemoveAll(tmp) // No-op if it's been renamed into place.
+	// MkdirTemp makes it private; the result shouldn't be.
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return errorUnpack(opts, err)
+	}
+	if err := extractArchive(opts, tmp); err != nil {
+		return err
+	}
+	if want.TreeHash, err = hashTree(tmp); err != nil {
+		return errorUnpack(opts, err)
+	}
+	if err := replaceDir(tmp, opts.Dest); err != nil {
+		return errorUnpack(opts, err)
+	}
+	recordBytes, _ := json.Marshal(want)
+	if err := os.WriteFile(unpackRecordPath(opts.Dest), append(recordBytes, '\n'), 0644); err != nil {
+		return errorUnpack(opts, err)
+	}
+	return nil
+}
+
+func sameUnpackOptions(a, b unpackOptions) bool {
+	if a.StripComponents != b.StripComponents || len(a.Include) != len(b.Include) {
+		return false
+	}
+	for i := range a.Include {
+		if a.Include[i] != b.Include[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceDir renames src to dst, replacing whatever was at dst.
+// If there was something there, it's first renamed aside, so the swap is as close to atomic as we can manage;
+// if the final rename fails, the old content is put back.
+func replaceDir(src, dst string) error {
+	if _, err := os.Lstat(dst); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return os.Rename(src, dst)
+		}
+		return err
+	}
+	aside := src + ".old"
+	if err := os.Rename(dst, aside); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		os.Rename(aside, dst)
+		return err
+	}
+	return os.RemoveAll(aside)
+}
+
+// archiveEntry is the common view of a tar or zip entry that extraction works with.
+type archiveEntry struct {
+	Name     string
+	Mode     fs.FileMode // Type bits and permission bits.
+	Linkname string      // For symlinks, the target; for hardlinks, the path of the other entry.
+	Hardlink bool
+	Open     func() (io.Reader, error)
+}
+
+// extractArchive unpacks the archive into root (which should be an empty directory).
+func extractArchive(opts unpackOptions, root string) error {
+	f, err := os.Open(opts.Archive)
+	if err != nil {
+		return errorUnpack(opts, err)
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	magic, _ := br.Peek(4)
+
+	var dirModes []dirMode
+	visit := func(ent archiveEntry) error {
+		dm, err := extractEntry(opts, root, ent)
+		if dm != nil {
+			dirModes = append(dirModes, *dm)
+		}
+		return err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		fi, err := f.Stat()
+		if err != nil {
+			return errorUnpack(opts, err)
+		}
+		zr, err := zip.NewReader(f, fi.Size())
+		if err != nil {
+			return errorUnpack(opts, err)
+		}
+		for _, zf := range zr.File {
+			zf := zf
+			ent := archiveEntry{Name: zf.Name, Mode: zf.Mode(), Open: func() (io.Reader, error) { return zf.Open() }}
+			if ent.Mode&fs.ModeSymlink != 0 {
+				rc, err := zf.Open()
+				if err != nil {
+					return errorUnpack(opts, err)
+				}
+				target, err := io.ReadAll(io.LimitReader(rc, 4096))
+				rc.Close()
+				if err != nil {
+					return errorUnpack(opts, err)
+				}
+				ent.Linkname = string(target)
+			}
+			if err := visit(ent); err != nil {
+				return err
+			}
+		}
+	default:
+		var r io.Reader = br
+		switch {
+		case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+			gz, err := gzip.NewReader(br)
+			if err != nil {
+				return errorUnpack(opts, err)
+			}
+			defer gz.Close()
+			r = gz
+		case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+			zr, err := zstd.NewReader(br)
+			if err != nil {
+				return errorUnpack(opts, err)
+			}
+			defer zr.Close()
+			r = zr
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return errorUnpack(opts, err)
+			}
+			ent := archiveEntry{Name: hdr.Name, Mode: hdr.FileInfo().Mode(), Linkname: hdr.Linkname, Open: func() (io.Reader, error) { return tr, nil }}
+			switch hdr.Typeflag {
+			case tar.TypeReg, tar.TypeRegA, tar.TypeDir, tar.TypeSymlink:
+			case tar.TypeLink:
+				ent.Hardlink = true
+			case tar.TypeXGlobalHeader:
+				continue
+			default:
+				return errorUnpackUnsafe(opts, hdr.Name, "is not a regular file, directory, symlink, or hardlink")
+			}
+			if err := visit(ent); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Each symlink was checked as it was extracted, but a later entry can change where an earlier one leads
+	// (by putting a symlink where it had only a name to go on), so they're all checked again, now that the tree is final.
+	if err := checkSymlinks(opts, root); err != nil {
+		return err
+	}
+
+	// Directory modes are applied last (and deepest first), so that read-only directories don't stop us from filling them.
+	sort.Slice(dirModes, func(i, j int) bool { return len(dirModes[i].path) > len(dirModes[j].path) })
+	for _, dm := range dirModes {
+		if err := os.Chmod(dm.path, dm.mode); err != nil {
+			return errorUnpack(opts, err)
+		}
+	}
+	return nil
+}
+
+type dirMode struct {
+	path string
+	mode fs.FileMode
+}
+
+// extractEntry puts one entry into place under root.
+// For directories, it returns the mode to apply to it later.
+func extractEntry(opts unpackOptions, root string, ent archiveEntry) (*dirMode, error) {
+	rel, ok, err := entryPath(ent.Name, opts)
+	if err != nil {
+		return nil, errorUnpackUnsafe(opts, ent.Name, err.Error())
+	}
+	if !ok {
+		return nil, nil
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+	if err := mkdirNoSymlinks(root, path.Dir(rel)); err != nil {
+		return nil, errorUnpackUnsafe(opts, ent.Name, err.Error())
+	}
+	perm := ent.Mode.Perm()
+	switch {
+	case ent.Mode.IsDir():
+		if err := os.Mkdir(target, 0755); err != nil && !errors.Is(err, fs.ErrExist) {
+			return nil, errorUnpack(opts, err)
+		}
+		if fi, err := os.Lstat(target); err != nil || !fi.IsDir() {
+			return nil, errorUnpackUnsafe(opts, ent.Name, "is a directory, but something else is already at that path")
+		}
+		return &dirMode{target, perm}, nil
+	case ent.Hardlink:
+		linkRel, ok, err := entryPath(ent.Linkname, opts)
+		if err != nil || !ok {
+			return nil, errorUnpackUnsafe(opts, ent.Name, "is a hardlink to a path outside of the destination")
+		}
+		if err := noSymlinksUnder(root, linkRel); err != nil {
+			return nil, errorUnpackUnsafe(opts, ent.Name, err.Error())
+		}
+		os.Remove(target)
+		if err := os.Link(filepath.Join(root, filepath.FromSlash(linkRel)), target); err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+	case ent.Mode&fs.ModeSymlink != 0:
+		if path.IsAbs(ent.Linkname) || !linkWithinRoot(root, path.Dir(rel), ent.Linkname) {
+			return nil, errorUnpackUnsafe(opts, ent.Name, "is a symlink to a path outside of the destination")
+		}
+		os.Remove(target)
+		if err := os.Symlink(ent.Linkname, target); err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+	case ent.Mode.IsRegular():
+		r, err := ent.Open()
+		if err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+		if rc, ok := r.(io.Closer); ok && rc != nil {
+			defer rc.Close()
+		}
+		os.Remove(target) // In case an earlier entry put a symlink here: don't write through it.
+		out, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+		if _, err := io.Copy(out, r); err != nil {
+			out.Close()
+			return nil, errorUnpack(opts, err)
+		}
+		if err := out.Close(); err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+		if err := os.Chmod(target, perm); err != nil {
+			return nil, errorUnpack(opts, err)
+		}
+	default:
+		return nil, errorUnpackUnsafe(opts, ent.Name, "is not a regular file, directory, symlink, or hardlink")
+	}
+	return nil, nil
+}
+
+// entryPath cleans an entry's name, applies strip_components and include, and checks that it stays within the destination.
+// It returns ok=false if the entry should be skipped.
+func entryPath(name string, opts unpackOptions) (rel string, ok bool, err error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if path.IsAbs(name) {
+		return "", false, errors.New("has an absolute path")
+	}
+	for _, seg := range strings.Split(name, "/") {
+		if seg == ".." {
+			return "", false, errors.New("has '..' in its path")
+		}
+	}
+	segs := strings.Split(path.Clean(name), "/")
+	if segs[0] == "." {
+		segs = segs[1:]
+	}
+	if len(segs) <= opts.StripComponents {
+		return "", false, nil
+	}
+	rel = strings.Join(segs[opts.StripComponents:], "/")
+	if len(opts.Include) > 0 && !included(rel, opts.Include) {
+		return "", false, nil
+	}
+	return rel, true, nil
+}
+
+// included returns true if rel, or any of its parent directories, matches one of the globs.
+func included(rel string, globs []string) bool {
+	for p := rel; p != "."; p = path.Dir(p) {
+		for _, g := range globs {
+			if ok, _ := path.Match(g, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// maxLinkHops is how many symlinks linkWithinRoot will follow, in resolving one link, before giving up (as the kernel does, with ELOOP).
+const maxLinkHops = 40
+
+// linkWithinRoot returns true if a symlink in the directory dir (a slash path under root, with no symlinks in it),
+// pointing at the relative path linkname, would resolve to somewhere within root.
+// It's not enough to look at the link's own path: it may lead through other symlinks, already extracted, which lead elsewhere
+// (e.g. "sub/e -> ..", "d -> sub/e", then "l -> d/.." is really "l -> ../.."),
+// so they're followed (on disk, since that's where they are), and each step has to stay within root.
+func linkWithinRoot(root, dir, linkname string) bool {
+	var cur []string                                                         // Resolved so far: real directories under root.
+	todo := append(strings.Split(dir, "/"), strings.Split(linkname, "/")...) // Not path.Join: that would clean "d/.." away, unresolved.
+	hops := 0
+	for len(todo) > 0 {
+		seg := todo[0]
+		todo = todo[1:]
+		switch seg {
+		case "", ".":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return false
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+		cur = append(cur, seg)
+		p := filepath.Join(root, filepath.Join(cur...))
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+			continue // Not there yet, or not a symlink: either way, it's just a name.
+		}
+		hops++
+		if hops > maxLinkHops {
+			return false
+		}
+		target, err := os.Readlink(p)
+		if err != nil || path.IsAbs(target) || filepath.IsAbs(target) {
+			return false
+		}
+		cur = cur[:len(cur)-1]
+		todo = append(strings.Split(filepath.ToSlash(target), "/"), todo...)
+	}
+	return true
+}
+
+// checkSymlinks checks that every symlink under root (in the finished tree) resolves to somewhere within it.
+func checkSymlinks(opts unpackOptions, root string) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return errorUnpack(opts, err)
+		}
+		if d.Type()&fs.ModeSymlink == 0 {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, p)
+		rel = filepath.ToSlash(rel)
+		target, err := os.Readlink(p)
+		if err != nil {
+			return errorUnpack(opts, err)
+		}
+		if !linkWithinRoot(root, path.Dir(rel), filepath.ToSlash(target)) {
+			return errorUnpackUnsafe(opts, rel, "is a symlink to a path outside of the destination")
+		}
+		return nil
+	})
+}
+
+// mkdirNoSymlinks makes sure every directory on the slash path rel exists under root, as a real directory (not a symlink).
+func mkdirNoSymlinks(root, rel string) error {
+	if rel == "." {
+		return nil
+	}
+	cur := root
+	for _, seg := range strings.Split(rel, "/") {
+		cur = filepath.Join(cur, seg)
+		fi, err := os.Lstat(cur)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			if err := os.Mkdir(cur, 0755); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case fi.Mode()&fs.ModeSymlink != 0:
+			return errors.New("would be written through a symlink")
+		case !fi.IsDir():
+			return errors.New("would be written inside of something that isn't a directory")
+		}
+	}
+	return nil
+}
+
+// noSymlinksUnder returns an error if any part of the slash path rel under root is a symlink.
+func noSymlinksUnder(root, rel string) error {
+	cur := root
+	for _, seg := range strings.Split(rel, "/") {
+		cur = filepath.Join(cur, seg)
+		fi, err := os.Lstat(cur)
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return errors.New("would be linked through a symlink")
+		}
+	}
+	return nil
+}
+
+// hashTree returns a sha256 over a whole filesystem tree: every path, its type and permission bits, and its content (or symlink target).
+func hashTree(root string) (string, error) {
+	hasher := sha256.New()
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(hasher, "%s\x00%o\x00", filepath.ToSlash(rel), fi.Mode())
+		switch {
+		case fi.Mode().IsRegular():
+			h, err := hashFile(p)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hasher, h)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			io.WriteString(hasher, target)
+		}
+		hasher.Write([]byte{0})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func errorUnpack(opts unpackOptions, cause error) error {
+	return Error(wfxapi.EcodeActionUnpack, "unpack", cause, "archive", opts.Archive, "dest", opts.Dest)
+}
+
+func errorUnpackUnsafe(opts unpackOptions, entry string, problem string) error {
+	return serum.Error(wfxapi.EcodeActionUnpackUnsafe,
+		serum.WithMessageTemplate("unpack archive={{archive|q}} refused: entry {{entry|q}} {{problem}}"),
+		serum.WithDetail("archive", opts.Archive),
+		serum.WithDetail("dest", opts.Dest),
+		serum.WithDetail("entry", entry),
+		serum.WithDetail("problem", problem),
+	)
+}
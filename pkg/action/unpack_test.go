@@ -0,0 +1,213 @@
+package action
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/klauspost/compress/zstd"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+type testEntry struct {
+	name     string
+	typ      byte
+	mode     int64
+	body     string
+	linkname string
+}
+
+var testEntries = []testEntry{
+	{name: "pkg-1.0/", typ: tar.TypeDir, mode: 0755},
+	{name: "pkg-1.0/bin/", typ: tar.TypeDir, mode: 0755},
+	{name: "pkg-1.0/bin/tool", typ: tar.TypeReg, mode: 04755, body: "#!/bin/sh\n"},
+	{name: "pkg-1.0/README", typ: tar.TypeReg, mode: 0644, body: "readme\n"},
+	{name: "pkg-1.0/bin/alias", typ: tar.TypeSymlink, linkname: "tool"},
+	{name: "pkg-1.0/bin/hard", typ: tar.TypeLink, linkname: "pkg-1.0/bin/tool"},
+}
+
+func makeTar(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typ, Mode: e.mode, Linkname: e.linkname, Size: int64(len(e.body)), ModTime: time.Unix(0, 0)}
+		qt.Assert(t, tw.WriteHeader(hdr), qt.IsNil)
+		_, err := tw.Write([]byte(e.body))
+		qt.Assert(t, err, qt.IsNil)
+	}
+	qt.Assert(t, tw.Close(), qt.IsNil)
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, entries []testEntry) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &zip.FileHeader{Name: e.name}
+		switch e.typ {
+		case tar.TypeDir:
+			hdr.SetMode(fs.ModeDir | fs.FileMode(e.mode))
+		case tar.TypeSymlink:
+			hdr.SetMode(fs.ModeSymlink | 0777)
+			e.body = e.linkname
+		case tar.TypeLink:
+			continue // zip has no hardlinks.
+		default:
+			hdr.SetMode(fs.FileMode(e.mode & 0777))
+		}
+		w, err := zw.CreateHeader(hdr)
+		qt.Assert(t, err, qt.IsNil)
+		io.WriteString(w, e.body)
+	}
+	qt.Assert(t, zw.Close(), qt.IsNil)
+	return buf.Bytes()
+}
+
+func listTree(t *testing.T, root string) []string {
+	var res []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		qt.Assert(t, err, qt.IsNil)
+		rel, _ := filepath.Rel(root, p)
+		fi, _ := d.Info()
+		desc := rel + " " + fi.Mode().String()
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			target, _ := os.Readlink(p)
+			desc += " -> " + target
+		}
+		res = append(res, desc)
+		return nil
+	})
+	qt.Assert(t, err, qt.IsNil)
+	sort.Strings(res)
+	return res
+}
+
+func TestUnpackFormats(t *testing.T) {
+	tarball := makeTar(t, testEntries)
+	var gz, zst bytes.Buffer
+	gzw := gzip.NewWriter(&gz)
+	gzw.Write(tarball)
+	gzw.Close()
+	zw, _ := zstd.NewWriter(&zst)
+	zw.Write(tarball)
+	zw.Close()
+
+	expectTar := []string{
+		". drwxr-xr-x",
+		"README -rw-r--r--",
+		"bin drwxr-xr-x",
+		"bin/alias Lrwxrwxrwx -> tool",
+		"bin/hard -rwxr-xr-x",
+		"bin/tool -rwxr-xr-x",
+	}
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		expect  []string
+	}{
+		{"tar", tarball, expectTar},
+		{"tar.gz", gz.Bytes(), expectTar},
+		{"tar.zst", zst.Bytes(), expectTar},
+		{"zip", makeZip(t, testEntries), []string{
+			". drwxr-xr-x",
+			"README -rw-r--r--",
+			"bin drwxr-xr-x",
+			"bin/alias Lrwxrwxrwx -> tool",
+			"bin/tool -rwxr-xr-x",
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "archive")
+			qt.Assert(t, os.WriteFile(archive, tc.archive, 0644), qt.IsNil)
+			opts := unpackOptions{Archive: archive, Dest: filepath.Join(dir, "out"), StripComponents: 1}
+			qt.Assert(t, unpack(opts), qt.IsNil)
+			qt.Assert(t, listTree(t, opts.Dest), qt.DeepEquals, tc.expect)
+		})
+	}
+}
+
+func TestUnpackInclude(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.tar")
+	qt.Assert(t, os.WriteFile(archive, makeTar(t, testEntries), 0644), qt.IsNil)
+	opts := unpackOptions{Archive: archive, Dest: filepath.Join(dir, "out"), StripComponents: 1, Include: []string{"bin/t*"}}
+	qt.Assert(t, unpack(opts), qt.IsNil)
+	qt.Assert(t, listTree(t, opts.Dest), qt.DeepEquals, []string{
+		". drwxr-xr-x",
+		"bin drwxr-xr-x",
+		"bin/tool -rwxr-xr-x",
+	})
+}
+
+func TestUnpackSkipsWhenUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "archive.tar")
+	qt.Assert(t, os.WriteFile(archive, makeTar(t, testEntries), 0644), qt.IsNil)
+	opts := unpackOptions{Archive: archive, Dest: filepath.Join(dir, "out")}
+	qt.Assert(t, unpack(opts), qt.IsNil)
+
+	// Unchanged: the very same directory is left in place.
+	before, _ := os.Stat(opts.Dest)
+	qt.Assert(t, unpack(opts), qt.IsNil)
+	after, _ := os.Stat(opts.Dest)
+	qt.Assert(t, os.SameFile(before, after), qt.IsTrue)
+
+	// Tampered with: it's unpacked again.
+	readme := filepath.Join(opts.Dest, "pkg-1.0", "README")
+	qt.Assert(t, os.WriteFile(readme, []byte("scribbles\n"), 0644), qt.IsNil)
+	qt.Assert(t, unpack(opts), qt.IsNil)
+	got, _ := os.ReadFile(readme)
+	qt.Assert(t, string(got), qt.Equals, "readme\n")
+}
+
+func TestUnpackUnsafe(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"dotdot", []testEntry{{name: "../evil", typ: tar.TypeReg, mode: 0644, body: "x"}}},
+		{"absolute", []testEntry{{name: "/tmp/evil", typ: tar.TypeReg, mode: 0644, body: "x"}}},
+		{"symlink-escape", []testEntry{{name: "a/link", typ: tar.TypeSymlink, linkname: "../../evil"}}},
+		{"symlink-absolute", []testEntry{{name: "link", typ: tar.TypeSymlink, linkname: "/etc"}}},
+		{"through-symlink", []testEntry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "link", typ: tar.TypeSymlink, linkname: "sub"},
+			{name: "link/file", typ: tar.TypeReg, mode: 0644, body: "x"},
+		}},
+		{"symlink-chain-escape", []testEntry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "sub/e", typ: tar.TypeSymlink, linkname: ".."},
+			{name: "d", typ: tar.TypeSymlink, linkname: "sub/e"},
+			{name: "l", typ: tar.TypeSymlink, linkname: "d/.."},
+		}},
+		{"symlink-chain-escape-later", []testEntry{
+			{name: "sub/", typ: tar.TypeDir, mode: 0755},
+			{name: "x", typ: tar.TypeSymlink, linkname: "sub/y/../.."},
+			{name: "sub/y", typ: tar.TypeSymlink, linkname: ".."},
+		}},
+		{"hardlink-escape", []testEntry{{name: "hard", typ: tar.TypeLink, linkname: "../evil"}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "archive.tar")
+			qt.Assert(t, os.WriteFile(archive, makeTar(t, tc.entries), 0644), qt.IsNil)
+			opts := unpackOptions{Archive: archive, Dest: filepath.Join(dir, "out")}
+			err := unpack(opts)
+			qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionUnpackUnsafe)
+			_, statErr := os.Lstat(opts.Dest)
+			qt.Assert(t, os.IsNotExist(statErr), qt.IsTrue)
+		})
+	}
+}
@@ -1,5 +1,23 @@
 package action
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
 // Future work for wfx involves having an easy way to trigger `warpforge run`,
 // as well as (especially) unpacking the resultant filesystems onto the host.
 
@@ -34,3 +52,218 @@ package action
 //
 // So.  Yes.  It seems like teaching wfx some simple built-in actions for direction warpforge will have high utility.
 // (We might even implement them as simple exec internally, with minimal API coupling!  Even so: utility.)
+
+// ---
+
+/*
+So here they are: `warpforge_run` and `warpforge_unpack`.
+Both work by executing the warpforge binary -- minimal API coupling, as promised above.
+
+The binary is "warpforge", found on the PATH, unless the WFX_WARPFORGE environment variable names another one.
+(That's also how the tests substitute a fake one.)
+*/
+
+var _ starlark.Callable = (*WarpforgeRunConstructor)(nil)
+
+// WarpforgeRunConstructor is `warpforge_run(module)`.
+// It runs `warpforge --json run <module>`, and returns a dict of the module's output labels to ware IDs.
+//
+// Unlike most actions, this runs as soon as it's called, rather than returning an ActionPlan:
+// its whole point is its result, and the result needs assigning (which would otherwise prevent the action from running).
+// It's still reported as an action in events, timings, etc.
+//
+// Warpforge's JSON output is a stream of objects; the one we want has a "plotresults" key,
+// which is a map of output labels to ware IDs (either as "packtype:hash" strings, or as {"packtype": ..., "hash": ...} objects).
+type WarpforgeRunConstructor struct{}
+
+func (a *WarpforgeRunConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var module string
+	if err := starlark.UnpackArgs("warpforge_run", args, kwargs, "module", &module); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	var results map[string]string
+	ap := &ActionPlan{
+		Name_:   "WarpforgeRun",
+		Details: "warpforge --json run " + module,
+		IsExec:  true,
+	}
+	ap.Run = func(ctx context.Context) error {
+		var stdout bytes.Buffer
+		if err := runWarpforge(ctx, thread, ap, &stdout, "--json", "run", module); err != nil {
+			return err
+		}
+		var err error
+		results, err = parsePlotResults(&stdout)
+		if err != nil {
+			return serum.Error(wfxapi.EcodeActionWarpforge,
+				serum.WithMessageTemplate("warpforge run of {{module|q}} produced output we couldn't understand: {{reason}}"),
+				serum.WithDetail("module", module),
+				serum.WithDetail("reason", err.Error()),
+			)
+		}
+		RecordOf(thread).AddInput(module)
+		return nil
+	}
+	if err := ap.Execute(Context(thread), thread); err != nil {
+		return starlark.None, err
+	}
+	labels := make([]string, 0, len(results))
+	for label := range results {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	dict := starlark.NewDict(len(labels))
+	for _, label := range labels {
+		dict.SetKey(starlark.String(label), starlark.String(results[label]))
+	}
+	return dict, nil
+}
+
+func (a *WarpforgeRunConstructor) Name() string          { return "warpforge_run()" }
+func (a *WarpforgeRunConstructor) String() string        { return "warpforge_run()" }
+func (a *WarpforgeRunConstructor) Type() string          { return "<actionPlanConstructor:warpforge_run>" }
+func (a *WarpforgeRunConstructor) Freeze()               {}
+func (a *WarpforgeRunConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *WarpforgeRunConstructor) Hash() (uint32, error) { return 0, nil }
+
+var _ starlark.Callable = (*WarpforgeUnpackConstructor)(nil)
+
+// WarpforgeUnpackConstructor is `warpforge_unpack(ware_id, path)`.
+// It runs `warpforge ware unpack --path <path> <ware_id>`, placing the ware's filesystem on the host at path.
+// Typically the ware_id comes from the dict returned by `warpforge_run`.
+//
+// The path is recorded as an output of the target.
+type WarpforgeUnpackConstructor struct{}
+
+func (a *WarpforgeUnpackConstructor) CallInternal(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var wareID, path string
+	if err := starlark.UnpackArgs("warpforge_unpack", args, kwargs, "ware_id", &wareID, "path", &path); err != nil {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s", err)
+	}
+	if !strings.Contains(wareID, ":") {
+		return starlark.None, serum.Errorf(wfxapi.EcodeScriptInvalid, "`warpforge_unpack` expects a ware ID (like \"tar:abc123...\"), not %q", wareID)
+	}
+	ap := &ActionPlan{
+		Name_:   "WarpforgeUnpack",
+		Details: "warpforge ware unpack --path " + path + " " + wareID,
+		IsExec:  true,
+	}
+	ap.Run = func(ctx context.Context) error {
+		if err := runWarpforge(ctx, thread, ap, nil, "ware", "unpack", "--path", path, wareID); err != nil {
+			return err
+		}
+		RecordOf(thread).AddOutput(path)
+		return nil
+	}
+	return ap, nil
+}
+
+func (a *WarpforgeUnpackConstructor) Name() string          { return "warpforge_unpack()" }
+func (a *WarpforgeUnpackConstructor) String() string        { return "warpforge_unpack()" }
+func (a *WarpforgeUnpackConstructor) Type() string          { return "<actionPlanConstructor:warpforge_unpack>" }
+func (a *WarpforgeUnpackConstructor) Freeze()               {}
+func (a *WarpforgeUnpackConstructor) Truth() starlark.Bool  { return starlark.True }
+func (a *WarpforgeUnpackConstructor) Hash() (uint32, error) { return 0, nil }
+func (a *WarpforgeUnpackConstructor) MakesPlan()            {}
+
+// runWarpforge executes the warpforge binary with the given args.
+// If captureStdout is non-nil, stdout goes there; otherwise it's wired as for any other action.
+//
+// Errors:
+//
+//   - wfx-action-error-warpforge -- if the binary can't be found or started, or exits nonzero.
+//   - wfx-timeout -- if ctx's deadline passed, and so the process was killed.
+func runWarpforge(ctx context.Context, thread *starlark.Thread, ap *ActionPlan, captureStdout io.Writer, args ...string) error {
+	bin := getenv(ctx, thread, "WFX_WARPFORGE")
+	if bin == "" {
+		bin = "warpforge"
+	}
+	cmdline := bin + " " + strings.Join(args, " ")
+	resolved, err := exec.LookPath(bin)
+	if err != nil {
+		return serum.Error(wfxapi.EcodeActionWarpforge,
+			serum.WithMessageTemplate("cannot run {{cmd|q}}: warpforge binary not found (install it, or set WFX_WARPFORGE to its path)"),
+			serum.WithDetail("cmd", cmdline),
+		)
+	}
+	cmd := exec.Command(resolved, args...)
+	cmd.Dir = WorkDir(thread)
+	cmd.Env = Environ(ctx, thread)
+	streams := ap.Streams(thread)
+	if ap.Stdin != nil {
+		cmd.Stdin = streams.Stdin
+	}
+	cmd.Stdout = streams.Stdout
+	if captureStdout != nil {
+		cmd.Stdout = captureStdout
+	}
+	cmd.Stderr = streams.Stderr
+	start := time.Now()
+	err = runProcess(ctx, cmd)
+	ap.Process = cmd.ProcessState
+	stderrTail := streams.Close()
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return nil
+	case TimedOut(ctx):
+		return errorCmdTimeout(cmdline, time.Since(start), stderrTail)
+	case errors.As(err, &exitErr) && exitErr.Exited():
+		return serum.Error(wfxapi.EcodeActionWarpforge, withStderrTail(stderrTail,
+			serum.WithMessageTemplate("{{cmd|q}} exited with code {{exitcode}}"),
+			serum.WithDetail("cmd", cmdline),
+			serum.WithDetail("exitcode", strconv.Itoa(exitErr.ExitCode())),
+		)...)
+	default:
+		return serum.Error(wfxapi.EcodeActionWarpforge, withStderrTail(stderrTail,
+			serum.WithMessageTemplate("{{cmd|q}} failed: {{reason}}"),
+			serum.WithDetail("cmd", cmdline),
+			serum.WithDetail("reason", err.Error()),
+		)...)
+	}
+}
+
+// parsePlotResults finds the "plotresults" object in a stream of warpforge's JSON output.
+// If there are several, the last one wins.
+func parsePlotResults(r io.Reader) (map[string]string, error) {
+	dec := json.NewDecoder(r)
+	var results map[string]string
+	for {
+		var msg map[string]json.RawMessage
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		raw, ok := msg["plotresults"]
+		if !ok {
+			continue
+		}
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &values); err != nil {
+			return nil, errors.New("plotresults is not a map: " + err.Error())
+		}
+		results = make(map[string]string, len(values))
+		for label, v := range values {
+			var s string
+			if err := json.Unmarshal(v, &s); err == nil {
+				results[label] = s
+				continue
+			}
+			var wid struct {
+				Packtype string `json:"packtype"`
+				Hash     string `json:"hash"`
+			}
+			if err := json.Unmarshal(v, &wid); err != nil || wid.Packtype == "" || wid.Hash == "" {
+				return nil, errors.New("plotresults value for " + strconv.Quote(label) + " is not a ware ID")
+			}
+			results[label] = wid.Packtype + ":" + wid.Hash
+		}
+	}
+	if results == nil {
+		return nil, errors.New("no plotresults found")
+	}
+	return results, nil
+}
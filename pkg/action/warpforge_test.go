@@ -0,0 +1,61 @@
+package action
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+func TestWarpforge(t *testing.T) {
+	fake, err := filepath.Abs("testdata/fake-warpforge")
+	qt.Assert(t, err, qt.IsNil)
+	t.Setenv("WFX_WARPFORGE", fake)
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "module.wf"), []byte("{}"), 0644), qt.IsNil)
+
+	exec := func(t *testing.T, script string) (starlark.StringDict, error) {
+		var stdout, stderr bytes.Buffer
+		thread := &starlark.Thread{}
+		thread.SetLocal("stdout", &stdout)
+		thread.SetLocal("stderr", &stderr)
+		return starlark.ExecFile(thread, "test.fx", script, starlark.StringDict{
+			"do":               &Do{},
+			"warpforge_run":    &WarpforgeRunConstructor{},
+			"warpforge_unpack": &WarpforgeUnpackConstructor{},
+		})
+	}
+
+	t.Run("run-and-unpack", func(t *testing.T) {
+		globals, err := exec(t, `
+outputs = warpforge_run("`+filepath.Join(dir, "module.wf")+`")
+do(warpforge_unpack(outputs["docs"], "`+filepath.Join(dir, "docs")+`"))
+`)
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, globals["outputs"].String(), qt.Equals,
+			`{"docs": "tar:4z9DCTxoKkStqXQRwtf9nimpfQQ36dbndDsAPCQgECfbXt3edanUrsVKCjE9TkX2v9", "out": "tar:6q7G4hWr283FpTa5Lf8heVqw9t97b5VoMU6AGszuBYAz9EzQdeHVFAou7c4W9vFcQ6"}`)
+		got, err := os.ReadFile(filepath.Join(dir, "docs", "WAREID"))
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, string(got), qt.Equals, "tar:4z9DCTxoKkStqXQRwtf9nimpfQQ36dbndDsAPCQgECfbXt3edanUrsVKCjE9TkX2v9\n")
+	})
+	t.Run("run-fails", func(t *testing.T) {
+		_, err := exec(t, `warpforge_run("`+filepath.Join(dir, "nonexistent.wf")+`")`)
+		err = errors.Unwrap(err) // Starlark wraps it in an EvalError.
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionWarpforge)
+		qt.Assert(t, serum.Detail(err, "exitcode"), qt.Equals, "4")
+		qt.Assert(t, serum.Detail(err, "stderr"), qt.Contains, "module not found")
+	})
+	t.Run("not-installed", func(t *testing.T) {
+		t.Setenv("WFX_WARPFORGE", filepath.Join(dir, "no-such-warpforge"))
+		_, err := exec(t, `warpforge_run("module.wf")`)
+		err = errors.Unwrap(err)
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionWarpforge)
+	})
+}
@@ -0,0 +1,27 @@
+/*
+The 'fswatch' package notices changes to files on the filesystem.
+
+It's used by wfx's watch mode, which re-invokes targets when their inputs change.
+Only Linux (inotify) is supported at the moment;
+on other platforms, New returns an error.
+
+Changes are reported as paths, built by joining the watched path with the name of whatever changed within it.
+So if you watch relative paths, you'll get relative paths back.
+Reports are batched: Next blocks for the first change,
+then keeps collecting until things have been quiet for a moment,
+so that a burst of writes (say, an editor saving, or a `git checkout`) becomes a single report.
+*/
+package fswatch
+
+import (
+	"sort"
+)
+
+func sortedKeys(m map[string]struct{}) []string {
+	res := make([]string, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
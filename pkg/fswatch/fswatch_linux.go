@@ -0,0 +1,182 @@
+package fswatch
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO |
+	syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// Watcher reports changes to a set of paths.
+type Watcher struct {
+	f *os.File // the inotify fd, wrapped so that reads go through the runtime poller (and thus can have deadlines, and be interrupted by Close).
+
+	dirs      map[int32]string // watch descriptor to the directory path it watches.
+	recursive map[int32]bool   // true for dirs that we got to by recursion (so their new subdirs should be watched too).
+	buf       [64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1)]byte
+}
+
+// New starts watching the given paths.
+// Directories are watched recursively, including any subdirectories created later.
+// Files are watched by watching their parent directory
+// (which is how we notice editors that save by writing a new file and renaming it into place);
+// this means changes to sibling files will be reported too.
+// Paths that don't exist yet have their nearest existing parent watched instead.
+//
+// Errors:
+//
+//   - wfx-watch-failed -- if inotify can't be set up.
+func New(paths []string) (*Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, serum.Error(wfxapi.EcodeWatchFailed, serum.WithCause(err))
+	}
+	w := &Watcher{
+		f:         os.NewFile(uintptr(fd), "inotify"),
+		dirs:      map[int32]string{},
+		recursive: map[int32]bool{},
+	}
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		fi, err := os.Stat(p)
+		switch {
+		case err == nil && fi.IsDir():
+			err = w.addRecursive(p)
+		default:
+			err = w.addParent(p)
+		}
+		if err != nil {
+			w.Close()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+func (w *Watcher) add(dir string, recursive bool) error {
+	wd, err := syscall.InotifyAddWatch(int(w.f.Fd()), dir, watchMask)
+	if err != nil {
+		return serum.Error(wfxapi.EcodeWatchFailed,
+			serum.WithCause(err),
+			serum.WithDetail("path", dir),
+		)
+	}
+	w.dirs[int32(wd)] = dir
+	w.recursive[int32(wd)] = w.recursive[int32(wd)] || recursive
+	return nil
+}
+
+func (w *Watcher) addRecursive(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Things can vanish while we walk; that's not our problem to report.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return serum.Error(wfxapi.EcodeWatchFailed,
+				serum.WithCause(err),
+				serum.WithDetail("path", p),
+			)
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		return w.add(p, true)
+	})
+}
+
+func (w *Watcher) addParent(p string) error {
+	for {
+		p = filepath.Dir(p)
+		if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+			return w.add(p, false)
+		}
+		if p == "." || p == string(filepath.Separator) {
+			return w.add(p, false)
+		}
+	}
+}
+
+// Next blocks until something changes, then keeps collecting changes until none have arrived for the debounce duration.
+// It returns the changed paths, deduplicated and sorted.
+//
+// Errors:
+//
+//   - wfx-watch-failed -- if reading from inotify fails, including because the Watcher was closed.
+func (w *Watcher) Next(debounce time.Duration) ([]string, error) {
+	changed := map[string]struct{}{}
+	if err := w.f.SetReadDeadline(time.Time{}); err != nil {
+		return nil, serum.Error(wfxapi.EcodeWatchFailed, serum.WithCause(err))
+	}
+	for {
+		n, err := w.f.Read(w.buf[:])
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) && len(changed) > 0 {
+				return sortedKeys(changed), nil
+			}
+			return nil, serum.Error(wfxapi.EcodeWatchFailed, serum.WithCause(err))
+		}
+		w.parse(w.buf[:n], changed)
+		if len(changed) > 0 {
+			if err := w.f.SetReadDeadline(time.Now().Add(debounce)); err != nil {
+				return nil, serum.Error(wfxapi.EcodeWatchFailed, serum.WithCause(err))
+			}
+		}
+	}
+}
+
+func (w *Watcher) parse(buf []byte, changed map[string]struct{}) {
+	for off := 0; off+syscall.SizeofInotifyEvent <= len(buf); {
+		ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(ev.Len)]
+		off += syscall.SizeofInotifyEvent + int(ev.Len)
+
+		name := string(nameBytes)
+		for i := 0; i < len(name); i++ { // names are nul-padded.
+			if name[i] == 0 {
+				name = name[:i]
+				break
+			}
+		}
+		dir, known := w.dirs[ev.Wd]
+		switch {
+		case ev.Mask&syscall.IN_Q_OVERFLOW != 0:
+			// We lost track of things.  Report every directory we're watching, which should cause everything to be considered changed.
+			for _, d := range w.dirs {
+				changed[d] = struct{}{}
+			}
+			continue
+		case !known:
+			continue
+		case ev.Mask&syscall.IN_IGNORED != 0:
+			delete(w.dirs, ev.Wd)
+			delete(w.recursive, ev.Wd)
+			continue
+		}
+		p := dir
+		if name != "" {
+			p = filepath.Join(dir, name)
+		}
+		changed[p] = struct{}{}
+		if ev.Mask&syscall.IN_ISDIR != 0 && ev.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 && w.recursive[ev.Wd] {
+			// Best effort: if this fails, we'll just be blind to that new directory.
+			_ = w.addRecursive(p)
+		}
+	}
+}
+
+// Close stops watching.  Any blocked call to Next will return an error.
+func (w *Watcher) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,56 @@
+package fswatch
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+func TestDebounce(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.Mkdir(filepath.Join(dir, "sub"), 0755), qt.IsNil)
+	w, err := New([]string{dir})
+	qt.Assert(t, err, qt.IsNil)
+	defer w.Close()
+
+	// A burst of writes, spaced closer together than the debounce, comes back as one report.
+	const debounce = 200 * time.Millisecond
+	go func() {
+		for _, name := range []string{"a", "b", "sub/c", "a"} {
+			os.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+			time.Sleep(debounce / 4)
+		}
+	}()
+	start := time.Now()
+	changed, err := w.Next(debounce)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, changed, qt.DeepEquals, []string{
+		filepath.Join(dir, "a"),
+		filepath.Join(dir, "b"),
+		filepath.Join(dir, "sub", "c"),
+	})
+	qt.Assert(t, time.Since(start) >= debounce, qt.IsTrue)
+
+	// Writes after things have gone quiet are the next report.
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "b"), []byte("y"), 0644), qt.IsNil)
+	changed, err = w.Next(debounce)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, changed, qt.DeepEquals, []string{filepath.Join(dir, "b")})
+}
+
+func TestCloseInterruptsNext(t *testing.T) {
+	w, err := New([]string{t.TempDir()})
+	qt.Assert(t, err, qt.IsNil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.Close()
+	}()
+	_, err = w.Next(time.Millisecond)
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeWatchFailed)
+}
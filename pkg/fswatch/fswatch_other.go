@@ -0,0 +1,38 @@
+//go:build !linux
+
+package fswatch
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// Watcher reports changes to a set of paths.
+// (Not implemented on this platform.)
+type Watcher struct{}
+
+// New always fails on this platform.
+//
+// Errors:
+//
+//   - wfx-watch-unsupported -- always.
+func New(paths []string) (*Watcher, error) {
+	return nil, serum.Error(wfxapi.EcodeWatchUnsupported,
+		serum.WithMessageTemplate("watching files is not yet supported on {{platform}}"),
+		serum.WithDetail("platform", runtime.GOOS),
+	)
+}
+
+// Next is never reachable, because New never succeeds on this platform.
+func (w *Watcher) Next(debounce time.Duration) ([]string, error) {
+	panic("unreachable")
+}
+
+// Close does nothing on this platform.
+func (w *Watcher) Close() error {
+	return nil
+}
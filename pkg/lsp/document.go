@@ -0,0 +1,409 @@
+package lsp
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// document is an open make.fx file, and what we know about it.
+// It's rebuilt from scratch on every change: make.fx files are small, and parsing is quick.
+type document struct {
+	uri      string
+	filename string
+	text     string
+	lines    []string
+
+	ast *syntax.File // The parse (with names resolved, as far as they'll resolve).  Nil if the text doesn't parse.
+
+	// These are from the last version of the text that parsed, so that completion still works while the text is half-typed.
+	targets []*wfx.Target
+	globals []string // Names defined at the top level, sorted.
+	defs    map[string]*syntax.DefStmt
+
+	dependsOn map[*syntax.Literal]bool // The string literals in targets' depends_on clauses.
+}
+
+func newDocument(uri, text string, builtins starlark.StringDict, prev *document) *document {
+	d := &document{
+		uri:      uri,
+		filename: uri,
+		text:     text,
+		lines:    strings.Split(text, "\n"),
+	}
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		d.filename = u.Path
+	}
+	if ast, err := syntax.Parse(d.filename, text, syntax.RetainComments); err == nil {
+		d.ast = ast
+		_ = resolve.File(ast, builtins.Has, starlark.Universe.Has) // Errors are reported by Lint; we only want the bindings.
+		d.defs = map[string]*syntax.DefStmt{}
+		d.dependsOn = map[*syntax.Literal]bool{}
+		seen := map[string]bool{}
+		for _, stmt := range ast.Stmts {
+			switch stmt := stmt.(type) {
+			case *syntax.DefStmt:
+				d.defs[stmt.Name.Name] = stmt
+				seen[stmt.Name.Name] = true
+				d.findDependsOn(stmt)
+			case *syntax.AssignStmt:
+				if id, ok := stmt.LHS.(*syntax.Ident); ok {
+					seen[id.Name] = true
+				}
+			}
+		}
+		for name := range seen {
+			d.globals = append(d.globals, name)
+		}
+		sort.Strings(d.globals)
+	} else if prev != nil {
+		d.globals, d.defs = prev.globals, prev.defs
+	}
+	if fx, err := wfx.ParseFxFile(d.filename, text); err == nil {
+		d.targets = fx.ListTargets()
+	} else if prev != nil {
+		d.targets = prev.targets
+	}
+	return d
+}
+
+func (d *document) findDependsOn(def *syntax.DefStmt) {
+	for _, param := range def.Params {
+		bin, ok := param.(*syntax.BinaryExpr)
+		if !ok {
+			continue
+		}
+		if id, ok := bin.X.(*syntax.Ident); !ok || id.Name != "depends_on" {
+			continue
+		}
+		syntax.Walk(bin.Y, func(n syntax.Node) bool {
+			if lit, ok := n.(*syntax.Literal); ok && lit.Token == syntax.STRING {
+				d.dependsOn[lit] = true
+			}
+			return true
+		})
+	}
+}
+
+func (d *document) target(name string) *wfx.Target {
+	for _, t := range d.targets {
+		if t.Name() == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// lspPosition converts a starlark position (one-based, counting runes) to an LSP one (zero-based, counting UTF-16 code units).
+func (d *document) lspPosition(pos syntax.Position) Position {
+	line := int(pos.Line) - 1
+	if line < 0 || line >= len(d.lines) {
+		return Position{Line: line}
+	}
+	units, runes := 0, 0
+	for _, r := range d.lines[line] {
+		if runes >= int(pos.Col)-1 {
+			break
+		}
+		units += len(utf16.Encode([]rune{r}))
+		runes++
+	}
+	return Position{Line: line, Character: units}
+}
+
+func (d *document) lspRange(n syntax.Node) Range {
+	start, end := n.Span()
+	return Range{Start: d.lspPosition(start), End: d.lspPosition(end)}
+}
+
+// starlarkPosition converts an LSP position to a starlark line and column.
+func (d *document) starlarkPosition(pos Position) (line, col int32) {
+	if pos.Line < 0 || pos.Line >= len(d.lines) {
+		return int32(pos.Line) + 1, 1
+	}
+	units, runes := 0, 0
+	for _, r := range d.lines[pos.Line] {
+		if units >= pos.Character {
+			break
+		}
+		units += len(utf16.Encode([]rune{r}))
+		runes++
+	}
+	return int32(pos.Line) + 1, int32(runes) + 1
+}
+
+// offset converts an LSP position to a byte offset in the text.
+func (d *document) offset(pos Position) int {
+	off := 0
+	for i := 0; i < pos.Line && i < len(d.lines); i++ {
+		off += len(d.lines[i]) + 1
+	}
+	if pos.Line >= len(d.lines) {
+		return len(d.text)
+	}
+	units := 0
+	for i, r := range d.lines[pos.Line] {
+		if units >= pos.Character {
+			return off + i
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return off + len(d.lines[pos.Line])
+}
+
+// nodeAt returns the identifier or literal at the position (including just after its end), or nil.
+func (d *document) nodeAt(pos Position) syntax.Node {
+	if d.ast == nil {
+		return nil
+	}
+	line, col := d.starlarkPosition(pos)
+	var found syntax.Node
+	syntax.Walk(d.ast, func(n syntax.Node) bool {
+		switch n.(type) {
+		case *syntax.Ident, *syntax.Literal:
+			start, end := n.Span()
+			if !before(line, col, start) && !before(end.Line, end.Col, syntax.MakePosition(nil, line, col)) {
+				found = n
+			}
+		}
+		return true
+	})
+	return found
+}
+
+// before returns true if line:col comes before pos.
+func before(line, col int32, pos syntax.Position) bool {
+	return line < pos.Line || line == pos.Line && col < pos.Col
+}
+
+// definition returns the identifier that defines what's at the position (e.g. the name in a def), or nil.
+func (d *document) definition(pos Position) *syntax.Ident {
+	switch n := d.nodeAt(pos).(type) {
+	case *syntax.Ident:
+		if b, ok := n.Binding.(*resolve.Binding); ok && b.First != nil {
+			return b.First
+		}
+	case *syntax.Literal:
+		if d.dependsOn[n] {
+			if def := d.defs[n.Value.(string)]; def != nil {
+				return def.Name
+			}
+		}
+	}
+	return nil
+}
+
+// hover describes what's at the position, in markdown, and returns the node it's about; or empty string and nil if there's nothing to say.
+func (d *document) hover(pos Position, builtins starlark.StringDict) (string, syntax.Node) {
+	n := d.nodeAt(pos)
+	switch n := n.(type) {
+	case *syntax.Ident:
+		b, _ := n.Binding.(*resolve.Binding)
+		switch {
+		case b == nil:
+			return "", nil
+		case b.Scope == resolve.Predeclared:
+			if v, ok := builtins[n.Name]; ok {
+				return "`" + n.Name + "` -- wfx builtin (`" + v.Type() + "`)", n
+			}
+		case b.Scope == resolve.Universal:
+			return "`" + n.Name + "` -- starlark builtin", n
+		case b.Scope == resolve.Global && b.First != nil:
+			if def := d.defs[b.First.Name]; def != nil && def.Name == b.First {
+				return d.describeDef(def), n
+			}
+		}
+	case *syntax.Literal:
+		if d.dependsOn[n] {
+			if def := d.defs[n.Value.(string)]; def != nil {
+				return d.describeDef(def), n
+			}
+			return "`" + n.Value.(string) + "` isn't a target", n
+		}
+	}
+	return "", nil
+}
+
+func (d *document) describeDef(def *syntax.DefStmt) string {
+	var params []string
+	for _, param := range def.Params {
+		params = append(params, paramName(param))
+	}
+	var sb strings.Builder
+	sb.WriteString("```python\ndef " + def.Name.Name + "(" + strings.Join(params, ", ") + ")\n```\n")
+	if doc := docstring(def); doc != "" {
+		sb.WriteString("\n" + doc + "\n")
+	}
+	if t := d.target(def.Name.Name); t != nil {
+		sb.WriteString("\nTarget.")
+		if deps := t.DependsOn(); len(deps) > 0 {
+			sb.WriteString("  Depends on: `" + strings.Join(deps, "`, `") + "`.")
+		}
+		if files := t.Files(); len(files) > 0 {
+			sb.WriteString("  Owns: `" + strings.Join(files, "`, `") + "`.")
+		}
+		if timeout := t.Timeout(); timeout > 0 {
+			sb.WriteString("  Time limit: " + timeout.String() + ".")
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func paramName(param syntax.Expr) string {
+	switch p := param.(type) {
+	case *syntax.Ident:
+		return p.Name
+	case *syntax.BinaryExpr:
+		return paramName(p.X)
+	case *syntax.UnaryExpr:
+		if p.X == nil {
+			return p.Op.String()
+		}
+		return p.Op.String() + paramName(p.X)
+	}
+	return "?"
+}
+
+// docstring returns the docstring of a function: a string literal that's its first statement.
+func docstring(def *syntax.DefStmt) string {
+	if len(def.Body) == 0 {
+		return ""
+	}
+	stmt, ok := def.Body[0].(*syntax.ExprStmt)
+	if !ok {
+		return ""
+	}
+	lit, ok := stmt.X.(*syntax.Literal)
+	if !ok || lit.Token != syntax.STRING {
+		return ""
+	}
+	lines := strings.Split(strings.TrimSpace(lit.Value.(string)), "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.Join(lines, "\n")
+}
+
+// dependsOnContext matches the text after the last "depends_on" before the cursor, if the cursor is within its value:
+// either in the list, or in a string.
+var dependsOnContext = regexp.MustCompile(`^\s*=\s*(\[[^\]]*|["'][^"']*)$`)
+
+// completion returns the completions for the position.
+// Within a depends_on clause, that's the targets; anywhere else, it's everything defined at the top level, and the builtins.
+func (d *document) completion(pos Position, builtins starlark.StringDict) []CompletionItem {
+	res := []CompletionItem{}
+	text := d.text[:d.offset(pos)]
+	if i := strings.LastIndex(text, "depends_on"); i >= 0 && dependsOnContext.MatchString(text[i+len("depends_on"):]) {
+		tail := text[i+len("depends_on"):]
+		inString := (strings.Count(tail, `"`)+strings.Count(tail, `'`))%2 == 1
+		for _, t := range d.targets {
+			item := CompletionItem{Label: t.Name(), Kind: completionKindFunction, Detail: describeTarget(t)}
+			if !inString {
+				item.InsertText = `"` + t.Name() + `"`
+			}
+			res = append(res, item)
+		}
+		return res
+	}
+	seen := map[string]bool{}
+	for _, name := range d.globals {
+		seen[name] = true
+		item := CompletionItem{Label: name, Kind: completionKindVariable}
+		if def := d.defs[name]; def != nil {
+			item.Kind = completionKindFunction
+			item.Detail = "function"
+			if t := d.target(name); t != nil {
+				item.Detail = describeTarget(t)
+			}
+		}
+		res = append(res, item)
+	}
+	var names []string
+	for name := range builtins {
+		names = append(names, name)
+	}
+	for name := range starlark.Universe {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if seen[name] || strings.HasPrefix(name, "_") {
+			continue
+		}
+		seen[name] = true
+		detail := "starlark builtin"
+		if v, ok := builtins[name]; ok {
+			detail = v.Type()
+		}
+		res = append(res, CompletionItem{Label: name, Kind: completionKindFunction, Detail: detail})
+	}
+	return res
+}
+
+func describeTarget(t *wfx.Target) string {
+	desc := "target"
+	if deps := t.DependsOn(); len(deps) > 0 {
+		desc += "; depends on " + strings.Join(deps, ", ")
+	}
+	return desc
+}
+
+// diagnostics are the findings of wfx.Lint, which include anything that doesn't parse or resolve.
+func (d *document) diagnostics(builtins starlark.StringDict) []Diagnostic {
+	res := []Diagnostic{}
+	for _, f := range wfx.Lint(d.filename, d.text, builtins) {
+		start := d.lspPosition(syntax.MakePosition(nil, f.Line, f.Col))
+		end := start
+		// Underline the dependency it's about, or the word that starts there, if there is one; otherwise, one character.
+		if lit := d.dependsOnAt(f.Line, f.Col); lit != nil {
+			end = d.lspRange(lit).End
+		} else if start.Line < len(d.lines) {
+			if rest := []rune(d.lines[start.Line]); int(f.Col)-1 < len(rest) {
+				rest = rest[f.Col-1:]
+				n := 0
+				for n < len(rest) && isWordRune(rest[n]) {
+					n++
+				}
+				if n == 0 {
+					n = 1
+				}
+				end = d.lspPosition(syntax.MakePosition(nil, f.Line, f.Col+int32(n)))
+			}
+		}
+		severity := severityWarning
+		if f.Severity == wfx.LintError {
+			severity = severityError
+		}
+		res = append(res, Diagnostic{
+			Range:    Range{Start: start, End: end},
+			Severity: severity,
+			Code:     f.Code,
+			Source:   "wfx",
+			Message:  f.Message,
+		})
+	}
+	return res
+}
+
+func (d *document) dependsOnAt(line, col int32) *syntax.Literal {
+	for lit := range d.dependsOn {
+		if lit.TokenPos.Line == line && lit.TokenPos.Col == col {
+			return lit
+		}
+	}
+	return nil
+}
+
+func isWordRune(r rune) bool {
+	return r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r >= utf8.RuneSelf
+}
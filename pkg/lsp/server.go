@@ -0,0 +1,176 @@
+/*
+Package lsp is a Language Server Protocol server for make.fx files, so editors can understand them.
+
+It offers:
+
+  - diagnostics: anything that doesn't parse or resolve, and everything else `wfx lint` finds;
+  - completion: target names within a depends_on clause, and otherwise everything defined at the top level, and the builtins;
+  - go-to-definition: for targets (including from within depends_on), helper functions, and variables;
+  - hover: a function's signature and docstring, and for a target, what it depends on, owns, and its time limit.
+
+Serve speaks LSP over a pair of streams (for `wfx lsp`, stdin and stdout).
+Documents are synced whole on every change.
+*/
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/wfx"
+)
+
+// ErrExitWithoutShutdown is returned by Serve if the client said to exit without first asking to shut down.
+// (LSP says the process should exit nonzero, in that case.)
+var ErrExitWithoutShutdown = errors.New("lsp: exit without shutdown")
+
+type server struct {
+	out      io.Writer
+	builtins starlark.StringDict
+	docs     map[string]*document
+
+	initialized bool
+	shutdown    bool
+}
+
+// Serve reads LSP messages from in, and writes responses (and diagnostics) to out, until the client says to exit, or in ends.
+// Messages are handled one at a time, in order.
+//
+// Errors are only returned for broken streams (or ErrExitWithoutShutdown); anything wrong with individual messages is answered as LSP says.
+func Serve(in io.Reader, out io.Writer) error {
+	s := &server{
+		out:      out,
+		builtins: wfx.Builtins(),
+		docs:     map[string]*document{},
+	}
+	r := bufio.NewReader(in)
+	for {
+		body, err := readMessage(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			if err := s.replyError(json.RawMessage("null"), codeParseError, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		if msg.Method == "exit" {
+			if !s.shutdown {
+				return ErrExitWithoutShutdown
+			}
+			return nil
+		}
+		if err := s.handle(msg); err != nil {
+			return err
+		}
+	}
+}
+
+// handle handles one message.  Only errors writing to the client are returned.
+func (s *server) handle(msg message) error {
+	isRequest := len(msg.ID) > 0
+	if !s.initialized && msg.Method != "initialize" {
+		if isRequest {
+			return s.replyError(msg.ID, codeServerNotInitialized, "the server hasn't been initialized")
+		}
+		return nil
+	}
+	if s.shutdown && isRequest {
+		return s.replyError(msg.ID, codeInvalidRequest, "the server has been shut down")
+	}
+	switch msg.Method {
+	case "initialize":
+		s.initialized = true
+		return s.reply(msg.ID, InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:   textDocumentSyncFull,
+				CompletionProvider: &CompletionOptions{TriggerCharacters: []string{`"`, `'`}},
+				DefinitionProvider: true,
+				HoverProvider:      true,
+			},
+			ServerInfo: ServerInfo{Name: "wfx"},
+		})
+	case "shutdown":
+		s.shutdown = true
+		return s.reply(msg.ID, nil)
+
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return nil
+		}
+		return s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) != nil || len(params.ContentChanges) == 0 {
+			return nil
+		}
+		return s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if json.Unmarshal(msg.Params, &params) != nil {
+			return nil
+		}
+		delete(s.docs, params.TextDocument.URI)
+		return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: params.TextDocument.URI, Diagnostics: []Diagnostic{}})
+
+	case "textDocument/completion", "textDocument/definition", "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return s.replyError(msg.ID, codeInvalidParams, err.Error())
+		}
+		doc := s.docs[params.TextDocument.URI]
+		if doc == nil {
+			return s.replyError(msg.ID, codeInvalidParams, "document isn't open: "+params.TextDocument.URI)
+		}
+		switch msg.Method {
+		case "textDocument/completion":
+			return s.reply(msg.ID, doc.completion(params.Position, s.builtins))
+		case "textDocument/definition":
+			id := doc.definition(params.Position)
+			if id == nil {
+				return s.reply(msg.ID, nil)
+			}
+			return s.reply(msg.ID, Location{URI: doc.uri, Range: doc.lspRange(id)})
+		default:
+			text, node := doc.hover(params.Position, s.builtins)
+			if text == "" {
+				return s.reply(msg.ID, nil)
+			}
+			rng := doc.lspRange(node)
+			return s.reply(msg.ID, Hover{Contents: MarkupContent{Kind: "markdown", Value: text}, Range: &rng})
+		}
+	}
+	if isRequest {
+		return s.replyError(msg.ID, codeMethodNotFound, "method not supported: "+msg.Method)
+	}
+	return nil // Notifications we don't understand are ignored, as LSP says.
+}
+
+// update replaces the text of a document, and publishes its diagnostics.
+func (s *server) update(uri, text string) error {
+	doc := newDocument(uri, text, s.builtins, s.docs[uri])
+	s.docs[uri] = doc
+	return s.notify("textDocument/publishDiagnostics", PublishDiagnosticsParams{URI: uri, Diagnostics: doc.diagnostics(s.builtins)})
+}
+
+func (s *server) reply(id json.RawMessage, result interface{}) error {
+	return writeMessage(s.out, resultResponse{JSONRPC: "2.0", ID: id, Result: result})
+}
+
+func (s *server) replyError(id json.RawMessage, code int, msg string) error {
+	return writeMessage(s.out, errorResponse{JSONRPC: "2.0", ID: id, Error: &responseError{Code: code, Message: msg}})
+}
+
+func (s *server) notify(method string, params interface{}) error {
+	return writeMessage(s.out, notification{JSONRPC: "2.0", Method: method, Params: params})
+}
@@ -0,0 +1,77 @@
+package lsp
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/warpfork/go-testmark"
+)
+
+// TestTranscripts replays the recorded sessions in testdata/transcripts.md.
+// In each, lines starting with "-->" are sent to the server, and lines starting with "<--" are what the server must send back, in that order.
+// (Messages are compared as JSON values, so spacing and key order don't matter.)
+func TestTranscripts(t *testing.T) {
+	doc, err := testmark.ReadFile("testdata/transcripts.md")
+	qt.Assert(t, err, qt.IsNil)
+	for _, hunk := range doc.DataHunks {
+		hunk := hunk
+		t.Run(hunk.Name, func(t *testing.T) {
+			replay(t, string(hunk.Body))
+		})
+	}
+}
+
+func replay(t *testing.T, transcript string) {
+	inR, inW := io.Pipe()
+	outR, outW := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(inR, outW)
+		outW.Close()
+	}()
+	received := make(chan []byte, 100)
+	go func() {
+		defer close(received)
+		r := bufio.NewReader(outR)
+		for {
+			body, err := readMessage(r)
+			if err != nil {
+				return
+			}
+			received <- body
+		}
+	}()
+
+	for i, line := range strings.Split(transcript, "\n") {
+		switch {
+		case strings.TrimSpace(line) == "", strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "--> "):
+			qt.Assert(t, writeMessage(inW, json.RawMessage(line[4:])), qt.IsNil)
+		case strings.HasPrefix(line, "<-- "):
+			select {
+			case body, ok := <-received:
+				if !ok {
+					t.Fatalf("line %d: expected a message, but the server stopped", i+1)
+				}
+				var got, want interface{}
+				qt.Assert(t, json.Unmarshal(body, &got), qt.IsNil)
+				qt.Assert(t, json.Unmarshal([]byte(line[4:]), &want), qt.IsNil, qt.Commentf("line %d", i+1))
+				qt.Assert(t, got, qt.DeepEquals, want, qt.Commentf("line %d; got:\n<-- %s", i+1, body))
+			case <-time.After(5 * time.Second):
+				t.Fatalf("line %d: timed out waiting for a message from the server", i+1)
+			}
+		default:
+			t.Fatalf("line %d: transcript lines must start with \"-->\" or \"<--\" (or \"#\", for comments)", i+1)
+		}
+	}
+	inW.Close()
+	qt.Check(t, <-done, qt.IsNil)
+	for body := range received {
+		t.Errorf("unexpected message from the server: %s", body)
+	}
+}
@@ -0,0 +1,237 @@
+/*
+Package timings records how long targets and actions take, and renders reports about it:
+a plain-text summary of the slowest things, and a trace file in the Chrome Trace Event format
+(which can be loaded into chrome://tracing, Perfetto, or speedscope, to see it all on a timeline).
+
+A Recorder is a wfxapi.EventSink; it learns everything it knows from the event stream.
+*/
+package timings
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// Span is one timed thing: either a target, or an action.
+type Span struct {
+	Target string
+	Action string // empty for target spans.
+	Cmd    string
+	Start  time.Time
+	Wall   time.Duration
+	User   time.Duration // for targets, the sum over their actions.
+	Sys    time.Duration // for targets, the sum over their actions.
+	Error  string        // the error code, if it failed.
+}
+
+// Describe returns a short human-readable name for the span.
+func (s Span) Describe() string {
+	if s.Action == "" {
+		return s.Target
+	}
+	desc := s.Target + ": " + s.Action
+	if s.Cmd != "" {
+		desc += " " + strconv.Quote(s.Cmd)
+	}
+	return desc
+}
+
+// Recorder collects spans from events.  It's safe for concurrent use.
+type Recorder struct {
+	mu      sync.Mutex
+	targets []Span
+	actions []Span
+}
+
+var _ wfxapi.EventSink = (*Recorder)(nil)
+
+// Emit implements wfxapi.EventSink.  Only finish events are interesting; everything else is ignored.
+func (r *Recorder) Emit(ev wfxapi.Event) {
+	if ev.Type != wfxapi.EventTargetFinish && ev.Type != wfxapi.EventActionFinish {
+		return
+	}
+	end := ev.Time
+	if end.IsZero() {
+		end = time.Now()
+	}
+	span := Span{
+		Target: ev.Target,
+		Cmd:    ev.Cmd,
+		Wall:   millis(ev.Duration),
+		User:   millis(ev.UserTime),
+		Sys:    millis(ev.SysTime),
+	}
+	span.Start = end.Add(-span.Wall)
+	if ev.Error != nil {
+		span.Error = ev.Error.Code
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch ev.Type {
+	case wfxapi.EventTargetFinish:
+		for _, a := range r.actions {
+			if a.Target == span.Target && !a.Start.Before(span.Start) {
+				span.User += a.User
+				span.Sys += a.Sys
+			}
+		}
+		r.targets = append(r.targets, span)
+	case wfxapi.EventActionFinish:
+		span.Action = ev.Action
+		if ev.Label != "" {
+			span.Action = ev.Label
+		}
+		r.actions = append(r.actions, span)
+	}
+}
+
+// Reset forgets everything recorded so far, so the next reports cover only what happens after this.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.targets, r.actions = nil, nil
+}
+
+func millis(ms *float64) time.Duration {
+	if ms == nil {
+		return 0
+	}
+	return time.Duration(*ms * float64(time.Millisecond))
+}
+
+// WriteSummary writes a table of the n slowest targets, and the n slowest actions, by wall-clock time.
+func (r *Recorder) WriteSummary(w io.Writer, n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	writeTable := func(title string, spans []Span) {
+		sorted := append([]Span(nil), spans...)
+		sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Wall > sorted[j].Wall })
+		if len(sorted) > n {
+			sorted = sorted[:n]
+		}
+		fmt.Fprintf(w, "%s (slowest %d of %d):\n", title, len(sorted), len(spans))
+		fmt.Fprintf(w, "  %10s %10s %10s  %s\n", "wall", "user", "sys", "name")
+		for _, s := range sorted {
+			fmt.Fprintf(w, "  %10s %10s %10s  %s\n", seconds(s.Wall), seconds(s.User), seconds(s.Sys), s.Describe())
+		}
+	}
+	writeTable("targets", r.targets)
+	writeTable("actions", r.actions)
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 3, 64) + "s"
+}
+
+// traceEvent is one entry in the Chrome Trace Event format.
+// See https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU for the spec.
+type traceEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat,omitempty"`
+	Ph   string            `json:"ph"`
+	Ts   int64             `json:"ts"`            // microseconds.
+	Dur  int64             `json:"dur,omitempty"` // microseconds.
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// WriteChromeTrace writes everything recorded as a Chrome Trace Event JSON document.
+//
+// Targets and actions that ran one after another share a row ("thread", in the trace format's terms),
+// with actions nested under their target.
+// Actions that overlapped in time (e.g. the stages of a pipe) are placed on additional rows.
+func (r *Recorder) WriteChromeTrace(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var origin time.Time
+	for _, s := range append(append([]Span(nil), r.targets...), r.actions...) {
+		if origin.IsZero() || s.Start.Before(origin) {
+			origin = s.Start
+		}
+	}
+	micros := func(d time.Duration) int64 { return d.Microseconds() }
+
+	events := []traceEvent{{
+		Name: "process_name",
+		Ph:   "M",
+		Pid:  1,
+		Args: map[string]string{"name": "wfx"},
+	}}
+	for _, s := range r.targets {
+		events = append(events, traceEvent{
+			Name: s.Target,
+			Cat:  "target",
+			Ph:   "X",
+			Ts:   micros(s.Start.Sub(origin)),
+			Dur:  micros(s.Wall),
+			Pid:  1,
+			Tid:  1,
+			Args: spanArgs(s),
+		})
+	}
+
+	// Greedy row assignment: each action goes on the lowest row that's free when it starts.
+	// Row 1 is shared with the targets, which is fine, since actions nest within them.
+	actions := append([]Span(nil), r.actions...)
+	sort.SliceStable(actions, func(i, j int) bool { return actions[i].Start.Before(actions[j].Start) })
+	var rowFreeAt []time.Time
+	for _, s := range actions {
+		row := 0
+		for row < len(rowFreeAt) && rowFreeAt[row].After(s.Start) {
+			row++
+		}
+		if row == len(rowFreeAt) {
+			rowFreeAt = append(rowFreeAt, time.Time{})
+		}
+		rowFreeAt[row] = s.Start.Add(s.Wall)
+		name := s.Action
+		if s.Cmd != "" {
+			name = s.Cmd
+		}
+		events = append(events, traceEvent{
+			Name: name,
+			Cat:  "action",
+			Ph:   "X",
+			Ts:   micros(s.Start.Sub(origin)),
+			Dur:  micros(s.Wall),
+			Pid:  1,
+			Tid:  row + 1,
+			Args: spanArgs(s),
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}{events, "ms"})
+}
+
+func spanArgs(s Span) map[string]string {
+	args := map[string]string{"target": s.Target}
+	if s.Action != "" {
+		args["action"] = s.Action
+	}
+	if s.Cmd != "" {
+		args["cmd"] = s.Cmd
+	}
+	if s.User != 0 || s.Sys != 0 {
+		args["user"] = seconds(s.User)
+		args["sys"] = seconds(s.Sys)
+	}
+	if s.Error != "" {
+		args["error"] = s.Error
+	}
+	return args
+}
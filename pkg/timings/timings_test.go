@@ -0,0 +1,161 @@
+package timings
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+var t0 = time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+// finish makes a finish event for something that ran from start to end (in milliseconds after t0).
+func finish(typ, target, action, cmd string, start, end, user, sys float64) wfxapi.Event {
+	return wfxapi.Event{
+		Type:     typ,
+		Time:     t0.Add(time.Duration(end * float64(time.Millisecond))),
+		Target:   target,
+		Action:   action,
+		Cmd:      cmd,
+		Duration: wfxapi.DurationMillis(time.Duration((end - start) * float64(time.Millisecond))),
+		UserTime: wfxapi.DurationMillis(time.Duration(user * float64(time.Millisecond))),
+		SysTime:  wfxapi.DurationMillis(time.Duration(sys * float64(time.Millisecond))),
+	}
+}
+
+// record feeds a recorder the events of a small build:
+// "gen" runs one command; "build" runs two in a row, then a pipe of two at once; "lint" fails.
+func record() *Recorder {
+	r := &Recorder{}
+	for _, ev := range []wfxapi.Event{
+		{Type: wfxapi.EventTargetStart, Target: "gen", Time: t0},
+		{Type: wfxapi.EventActionStart, Target: "gen", Action: "Cmd", Cmd: "protoc", Time: t0},
+		finish(wfxapi.EventActionFinish, "gen", "Cmd", "protoc", 0, 100, 80, 10),
+		finish(wfxapi.EventTargetFinish, "gen", "", "", 0, 110, 0, 0),
+
+		finish(wfxapi.EventActionFinish, "build", "Cmd", "go vet", 120, 420, 250, 40),
+		finish(wfxapi.EventActionFinish, "build", "Cmd", "go build", 420, 920, 900, 60),
+		finish(wfxapi.EventActionFinish, "build", "Cmd", "tar c .", 920, 1100, 50, 20),
+		finish(wfxapi.EventActionFinish, "build", "Cmd", "gzip", 930, 1120, 150, 5),
+		finish(wfxapi.EventActionFinish, "build", "Pipe", "", 920, 1120, 0, 0),
+		finish(wfxapi.EventTargetFinish, "build", "", "", 110, 1130, 0, 0),
+	} {
+		r.Emit(ev)
+	}
+	failed := finish(wfxapi.EventTargetFinish, "lint", "", "", 1130, 1330, 0, 0)
+	failed.Error = &wfxapi.EventErrorInfo{Code: wfxapi.EcodeActionCmdExit}
+	r.Emit(failed)
+	return r
+}
+
+func TestAggregation(t *testing.T) {
+	r := record()
+	qt.Assert(t, r.targets, qt.HasLen, 3)
+	qt.Assert(t, r.actions, qt.HasLen, 6)
+
+	// Start events are ignored; spans come from the finish events' times and durations.
+	gen := r.targets[0]
+	qt.Check(t, gen.Target, qt.Equals, "gen")
+	qt.Check(t, gen.Start, qt.Equals, t0)
+	qt.Check(t, gen.Wall, qt.Equals, 110*time.Millisecond)
+	// Targets get the CPU time of their actions, and only their own.
+	qt.Check(t, gen.User, qt.Equals, 80*time.Millisecond)
+	qt.Check(t, gen.Sys, qt.Equals, 10*time.Millisecond)
+	build := r.targets[1]
+	qt.Check(t, build.User, qt.Equals, (250+900+50+150)*time.Millisecond)
+	qt.Check(t, build.Sys, qt.Equals, (40+60+20+5)*time.Millisecond)
+	qt.Check(t, r.targets[2].Error, qt.Equals, wfxapi.EcodeActionCmdExit)
+
+	qt.Check(t, r.actions[1].Describe(), qt.Equals, `build: Cmd "go vet"`)
+	qt.Check(t, r.actions[1].Start, qt.Equals, t0.Add(120*time.Millisecond))
+	qt.Check(t, r.actions[5].Describe(), qt.Equals, "build: Pipe")
+	qt.Check(t, r.targets[0].Describe(), qt.Equals, "gen")
+
+	// Labels, when given, name actions.
+	r.Emit(wfxapi.Event{Type: wfxapi.EventActionFinish, Target: "gen", Action: "Action", Label: "shout", Time: t0})
+	qt.Check(t, r.actions[6].Action, qt.Equals, "shout")
+}
+
+func TestSummary(t *testing.T) {
+	var buf bytes.Buffer
+	record().WriteSummary(&buf, 2)
+	qt.Assert(t, buf.String(), qt.Equals, ""+
+		"targets (slowest 2 of 3):\n"+
+		"        wall       user        sys  name\n"+
+		"      1.020s     1.350s     0.125s  build\n"+
+		"      0.200s     0.000s     0.000s  lint\n"+
+		"actions (slowest 2 of 6):\n"+
+		"        wall       user        sys  name\n"+
+		"      0.500s     0.900s     0.060s  build: Cmd \"go build\"\n"+
+		"      0.300s     0.250s     0.040s  build: Cmd \"go vet\"\n",
+	)
+
+	// Ties keep the order things finished in.
+	r := record()
+	r.Reset()
+	r.Emit(finish(wfxapi.EventTargetFinish, "a", "", "", 0, 100, 0, 0))
+	r.Emit(finish(wfxapi.EventTargetFinish, "b", "", "", 100, 200, 0, 0))
+	buf.Reset()
+	r.WriteSummary(&buf, 5)
+	qt.Assert(t, buf.String(), qt.Equals, ""+
+		"targets (slowest 2 of 2):\n"+
+		"        wall       user        sys  name\n"+
+		"      0.100s     0.000s     0.000s  a\n"+
+		"      0.100s     0.000s     0.000s  b\n"+
+		"actions (slowest 0 of 0):\n"+
+		"        wall       user        sys  name\n",
+	)
+}
+
+func TestChromeTrace(t *testing.T) {
+	var buf bytes.Buffer
+	qt.Assert(t, record().WriteChromeTrace(&buf), qt.IsNil)
+	var doc struct {
+		TraceEvents     []traceEvent `json:"traceEvents"`
+		DisplayTimeUnit string       `json:"displayTimeUnit"`
+	}
+	qt.Assert(t, json.Unmarshal(buf.Bytes(), &doc), qt.IsNil)
+	qt.Check(t, doc.DisplayTimeUnit, qt.Equals, "ms")
+
+	type row struct {
+		Name, Cat, Ph string
+		Ts, Dur       int64
+		Tid           int
+	}
+	var rows []row
+	for _, ev := range doc.TraceEvents {
+		qt.Check(t, ev.Pid, qt.Equals, 1)
+		rows = append(rows, row{ev.Name, ev.Cat, ev.Ph, ev.Ts, ev.Dur, ev.Tid})
+	}
+	qt.Assert(t, rows, qt.DeepEquals, []row{
+		{"process_name", "", "M", 0, 0, 0},
+		{"gen", "target", "X", 0, 110000, 1},
+		{"build", "target", "X", 110000, 1020000, 1},
+		{"lint", "target", "X", 1130000, 200000, 1},
+		// Sequential actions share the targets' row...
+		{"protoc", "action", "X", 0, 100000, 1},
+		{"go vet", "action", "X", 120000, 300000, 1},
+		{"go build", "action", "X", 420000, 500000, 1},
+		// ...but the pipe, and its stages, overlap, so each gets a row of its own.
+		{"tar c .", "action", "X", 920000, 180000, 1},
+		{"Pipe", "action", "X", 920000, 200000, 2},
+		{"gzip", "action", "X", 930000, 190000, 3},
+	})
+
+	qt.Check(t, doc.TraceEvents[0].Args, qt.DeepEquals, map[string]string{"name": "wfx"})
+	qt.Check(t, doc.TraceEvents[3].Args, qt.DeepEquals, map[string]string{
+		"target": "lint",
+		"error":  wfxapi.EcodeActionCmdExit,
+	})
+	qt.Check(t, doc.TraceEvents[5].Args, qt.DeepEquals, map[string]string{
+		"target": "build",
+		"action": "Cmd",
+		"cmd":    "go vet",
+		"user":   "0.250s",
+		"sys":    "0.040s",
+	})
+}
@@ -0,0 +1,100 @@
+package wfx
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// Clean removes the paths that the named targets own (their "fx_files"), or, if no names are given, the paths that every target owns.
+// As with Plan, names may also be paths that a target owns, meaning that target.
+// Dependencies aren't cleaned.  If dryrun is true, nothing is removed.
+//
+// Returns the paths that were removed (or, with dryrun, would have been), in the order they were declared.
+// Paths that don't exist are skipped.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if a name isn't a target (or a path a target owns),
+//     or a target claims a path that isn't within the project directory (which Clean won't remove, to be safe).
+//   - wfx-action-error-remove -- if a path can't be removed.
+func (p *Project) Clean(targetNames []string, dryrun bool) ([]string, error) {
+	targets := p.fxFile.targets
+	if len(targetNames) > 0 {
+		targets = nil
+		for _, name := range targetNames {
+			t := p.fxFile.TargetByName(name)
+			if t == nil {
+				t = p.fxFile.TargetByFile(name)
+			}
+			if t == nil {
+				return nil, serum.Error(wfxapi.EcodeScriptInvalid,
+					serum.WithMessageTemplate("there is no target named {{target|q}}"),
+					serum.WithDetail("target", name),
+				)
+			}
+			targets = append(targets, t)
+		}
+	}
+	var paths []string
+	seen := map[string]bool{}
+	for _, t := range targets {
+		for _, f := range t.files {
+			if err := checkRemovable(t, f, "cleaned"); err != nil {
+				return nil, err
+			}
+			clean := path.Clean(f)
+			if !seen[clean] {
+				seen[clean] = true
+				paths = append(paths, f)
+			}
+		}
+	}
+
+	var res []string
+	for _, f := range paths {
+		file := filepath.Join(p.opts.Dir, filepath.FromSlash(f))
+		if _, err := os.Lstat(file); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if !dryrun {
+			if err := os.RemoveAll(file); err != nil {
+				return res, serum.Error(wfxapi.EcodeActionRemove,
+					serum.WithMessageTemplate("removing {{path|q}} failed: {{reason}}"),
+					serum.WithDetail("path", f),
+					serum.WithDetail("reason", reason(err)),
+				)
+			}
+		}
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// checkRemovable returns an error if f, a path that target t claims (with "fx_files"), isn't within the project directory:
+// it's ".", or "..", or goes up out of the directory, or is absolute.
+// Anything that removes owned paths must check this first, since removing any of those would remove things that aren't the target's.
+// The outcome says what won't be done about it (e.g. "cleaned"), for the error message.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if the path isn't within the project directory.
+func checkRemovable(t *Target, f string, outcome string) error {
+	clean := path.Clean(filepath.ToSlash(f))
+	if clean == "." || clean == ".." || strings.HasPrefix(clean, "../") || path.IsAbs(clean) || filepath.IsAbs(f) {
+		return serum.Error(wfxapi.EcodeScriptInvalid,
+			serum.WithMessageTemplate("target {{target|q}} claims {{path|q}}, which isn't within the project directory, so it won't be {{outcome}}"),
+			serum.WithDetail("target", t.name),
+			serum.WithDetail("path", f),
+			serum.WithDetail("outcome", outcome),
+		)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package wfx
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+The environment variables that actions get are built up in layers.
+From lowest to highest precedence (later ones override earlier ones):
+
+ 1. The process's environment (or Options.Env, if given).
+ 2. `ENV = {"KEY": "value", ...}` at the top level of make.fx: the project's own settings.
+ 3. The `.env` file in the project directory, if there is one: for local settings that don't belong in version control.
+ 4. `env(act, {...})` around an action: the most specific.
+
+Variables named in `SENSITIVE_ENV = ["KEY", ...]` at the top level of make.fx are secrets, wherever their values come from:
+their values are redacted from action output and errors (and from Program.Env).
+(The `env` controller can mark more, with its `sensitive` param.)
+
+In hermetic mode (see Options.Hermetic), nothing comes from the host unless the project says so,
+so that evaluation goes the same way on every machine.  The layers are instead:
+
+ 1. HermeticEnv: a fixed PATH, locale, timezone, and SOURCE_DATE_EPOCH.
+ 2. `HOST_ENV = ["KEY", ...]` at the top level of make.fx: the variables the project declares it needs from the host (the process's environment, or Options.Env), passed through as they are.  Those that aren't set on the host stay unset.
+ 3. `ENV = {...}` in make.fx, as usual.
+ 4. `env(act, {...})` around an action, as usual.
+
+The `.env` file isn't read, since it's local to one machine.
+Everything that looks at environment variables from make.fx -- actions, and SENSITIVE_ENV -- sees only these,
+so the host's environment can't be read without being declared.
+(Outside of hermetic mode, HOST_ENV means nothing: everything passes through.)
+*/
+
+// EnvPrecedence describes the layers of environment variables, lowest precedence first.
+var EnvPrecedence = []string{
+	"process environment",
+	"ENV in make.fx",
+	".env file",
+	"env() around an action",
+}
+
+// HermeticEnvPrecedence is EnvPrecedence, in hermetic mode.
+var HermeticEnvPrecedence = []string{
+	"hermetic defaults",
+	"HOST_ENV in make.fx",
+	"ENV in make.fx",
+	"env() around an action",
+}
+
+// HermeticEnv is the bottom layer of environment variables in hermetic mode, instead of the process's environment.
+// The project can change any of them with ENV (or pass the host's through, with HOST_ENV).
+var HermeticEnv = []string{
+	"PATH=/usr/local/bin:/usr/bin:/bin",
+	"LANG=C",
+	"LC_ALL=C",
+	"TZ=UTC",
+	"SOURCE_DATE_EPOCH=315532800", // 1980-01-01T00:00:00Z: the earliest time that zip files can represent.
+}
+
+// Sources for EnvSetting.
+const (
+	EnvSourceHermetic = "hermetic defaults"
+	EnvSourceHost     = "HOST_ENV in make.fx"
+	EnvSourceFx       = "ENV in make.fx"
+	EnvSourceDotEnv   = ".env file"
+)
+
+// EnvSetting is an environment variable that the project sets (in layers 2 and 3, as described by EnvPrecedence;
+// or in hermetic mode, layers 1 to 3, as described by HermeticEnvPrecedence).
+type EnvSetting struct {
+	Name       string
+	Value      string // Redacted, if the variable is sensitive.
+	Source     string // One of the EnvSource constants.
+	Sensitive  bool
+	Overridden bool // True if a higher layer sets the same variable.
+}
+
+// Env lists the environment variables that the project sets (in make.fx's ENV, and in .env; or in hermetic mode, everything), in precedence order.
+// Sensitive values are redacted.
+func (prog *Program) Env() []EnvSetting {
+	return prog.envSettings
+}
+
+// compileEnv builds the environment from the layers, and finds the secrets.
+// The settings are remembered for Env; the environment itself and the secrets are returned.
+// (The environment is nil if nothing changes the process's environment, as with Options.Env.)
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if ENV, SENSITIVE_ENV, or HOST_ENV aren't the right shape.
+//   - wfx-dotenv-invalid -- if the .env file has a line that can't be parsed.
+//   - wfx-project-unreadable -- if the .env file exists, but can't be read.
+func (prog *Program) compileEnv() ([]string, *action.Secrets, error) {
+	hermetic := prog.project.opts.Hermetic
+	env := prog.project.opts.Env
+	var settings []EnvSetting
+	hostVars, err := globalStringList(prog.globals, "HOST_ENV")
+	if err != nil {
+		return nil, nil, err
+	}
+	if hermetic {
+		host := env
+		if host == nil {
+			host = os.Environ()
+		}
+		env = []string{} // Not nil: that would mean the process's environment.
+		for _, kv := range HermeticEnv {
+			k, v, _ := strings.Cut(kv, "=")
+			settings = append(settings, EnvSetting{Name: k, Value: v, Source: EnvSourceHermetic})
+		}
+		for _, name := range hostVars {
+			if v, ok := lookupEnvOk(host, name); ok {
+				settings = append(settings, EnvSetting{Name: name, Value: v, Source: EnvSourceHost})
+			}
+		}
+	}
+	fxVars, err := globalStringDict(prog.globals, "ENV")
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, kv := range fxVars {
+		settings = append(settings, EnvSetting{Name: kv[0], Value: kv[1], Source: EnvSourceFx})
+	}
+	if !hermetic {
+		dotVars, err := loadDotEnv(filepath.Join(prog.project.opts.Dir, ".env"))
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, kv := range dotVars {
+			settings = append(settings, EnvSetting{Name: kv[0], Value: kv[1], Source: EnvSourceDotEnv})
+		}
+	}
+	sensitive, err := globalStringList(prog.globals, "SENSITIVE_ENV")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(settings) > 0 {
+		set := make(map[string]string, len(settings))
+		for _, s := range settings {
+			set[s.Name] = s.Value
+		}
+		env = action.EditEnv(env, set, nil)
+	}
+	secrets := &action.Secrets{}
+	for _, name := range sensitive {
+		if env == nil {
+			secrets.Add(os.Getenv(name))
+		} else {
+			for _, kv := range env {
+				if k, v, _ := strings.Cut(kv, "="); k == name {
+					secrets.Add(v)
+				}
+			}
+		}
+	}
+	for i := range settings {
+		for _, later := range settings[i+1:] {
+			if later.Name == settings[i].Name {
+				settings[i].Overridden = true
+			}
+		}
+		for _, name := range sensitive {
+			if settings[i].Name == name {
+				settings[i].Sensitive = true
+				settings[i].Value = action.Redacted
+			}
+		}
+	}
+	prog.envSettings = settings
+	return env, secrets, nil
+}
+
+// globalStringDict reads a global that, if it's set, must be a dict of strings to strings.
+// The result is in the dict's order.
+func globalStringDict(globals starlark.StringDict, name string) ([][2]string, error) {
+	v, ok := globals[name]
+	if !ok {
+		return nil, nil
+	}
+	dict, ok := v.(*starlark.Dict)
+	if !ok {
+		return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s must be a dict of strings to strings, not a %s", name, v.Type())
+	}
+	var res [][2]string
+	for _, item := range dict.Items() {
+		k, ok1 := item[0].(starlark.String)
+		v, ok2 := item[1].(starlark.String)
+		if !ok1 || !ok2 {
+			return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s must be a dict of strings to strings, but has a %s: %s", name, item[0].Type(), item[1].Type())
+		}
+		res = append(res, [2]string{string(k), string(v)})
+	}
+	return res, nil
+}
+
+// globalStringList reads a global that, if it's set, must be a list (or tuple) of strings.
+func globalStringList(globals starlark.StringDict, name string) ([]string, error) {
+	v, ok := globals[name]
+	if !ok {
+		return nil, nil
+	}
+	var seq starlark.Indexable
+	switch v := v.(type) {
+	case *starlark.List:
+		seq = v
+	case starlark.Tuple:
+		seq = v
+	default:
+		return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s must be a list of strings, not a %s", name, v.Type())
+	}
+	res := make([]string, seq.Len())
+	for i := range res {
+		s, ok := seq.Index(i).(starlark.String)
+		if !ok {
+			return nil, serum.Errorf(wfxapi.EcodeScriptInvalid, "%s must be a list of strings, but has a %s", name, seq.Index(i).Type())
+		}
+		res[i] = string(s)
+	}
+	return res, nil
+}
+
+// loadDotEnv reads a .env file, if it exists.
+//
+// The format is the usual one: `KEY=value` lines (optionally starting with `export `), with blank lines and `#` comment lines ignored.
+// Values may be double-quoted (with backslash escapes, as in Go), or single-quoted (taken literally); otherwise they're used as-is, trimmed.
+//
+// Errors:
+//
+//   - wfx-dotenv-invalid -- if a line can't be parsed.
+//   - wfx-project-unreadable -- if the file exists, but can't be read.
+func loadDotEnv(filename string) ([][2]string, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, serum.Error(wfxapi.EcodeProjectUnreadable,
+			serum.WithMessageTemplate("cannot read {{file|q}}: {{reason}}"),
+			serum.WithDetail("file", filename),
+			serum.WithDetail("reason", reason(err)),
+		)
+	}
+	defer f.Close()
+	var res [][2]string
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		k, v, ok := strings.Cut(line, "=")
+		k = strings.TrimSpace(k)
+		if !ok || !isEnvName(k) {
+			return nil, errorDotEnvInvalid(filename, lineNum, "expected KEY=value")
+		}
+		v = strings.TrimSpace(v)
+		switch {
+		case strings.HasPrefix(v, `"`):
+			unquoted, err := strconv.Unquote(v)
+			if err != nil {
+				return nil, errorDotEnvInvalid(filename, lineNum, "bad double-quoted value")
+			}
+			v = unquoted
+		case strings.HasPrefix(v, `'`):
+			if len(v) < 2 || !strings.HasSuffix(v, `'`) {
+				return nil, errorDotEnvInvalid(filename, lineNum, "unterminated single-quoted value")
+			}
+			v = v[1 : len(v)-1]
+		}
+		res = append(res, [2]string{k, v})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, serum.Error(wfxapi.EcodeProjectUnreadable,
+			serum.WithMessageTemplate("cannot read {{file|q}}: {{reason}}"),
+			serum.WithDetail("file", filename),
+			serum.WithDetail("reason", reason(err)),
+		)
+	}
+	return res, nil
+}
+
+func isEnvName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func errorDotEnvInvalid(filename string, line int, problem string) error {
+	return serum.Error(wfxapi.EcodeDotEnvInvalid,
+		serum.WithMessageTemplate("{{file}}:{{line}}: {{problem}}"),
+		serum.WithDetail("file", filename),
+		serum.WithDetail("line", strconv.Itoa(line)),
+		serum.WithDetail("problem", problem),
+	)
+}
+
+// lookupEnvOk returns the value of key in env (in "KEY=value" form), and whether it's there at all.
+func lookupEnvOk(env []string, key string) (string, bool) {
+	for i := len(env) - 1; i >= 0; i-- {
+		if k, v, ok := strings.Cut(env[i], "="); ok && k == key {
+			return v, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,153 @@
+package wfx
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const envFx = `
+ENV = {"A": "from-fx", "B": "from-fx", "C": "from-fx"}
+SENSITIVE_ENV = ["TOKEN"]
+
+def layers(fx):
+	env(cmd("echo $A $B $C ${D-unset}"), {"C": "from-controller"}, unset=["D"])
+
+def leak(fx):
+	cmd("echo token=$TOKEN; echo also $TOKEN >&2")
+
+def leak_and_fail(fx):
+	cmd("echo oops $TOKEN >&2; exit 3")
+
+def leak_inline(fx):
+	env(cmd("echo $EXTRA"), {"EXTRA": "hunter2"}, sensitive=["EXTRA"])
+`
+
+const envDotEnv = `
+# Local settings.
+B=from-dotenv
+export TOKEN="s3cr3t-value"
+QUOTED='$not $expanded'
+`
+
+func TestEnvLayers(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, ".env"), []byte(envDotEnv), 0644), qt.IsNil)
+	var stdout, stderr bytes.Buffer
+	proj, err := LoadSource("make.fx", envFx, Options{
+		Dir:    dir,
+		Env:    []string{"PATH=" + os.Getenv("PATH"), "A=from-process", "D=from-process"},
+		Stdout: &stdout,
+		Stderr: &stderr,
+		// Verbose, so the output of actions comes through.
+		Verbosity: action.VerbosityVerbose,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+
+	t.Run("describe", func(t *testing.T) {
+		qt.Check(t, prog.Env(), qt.DeepEquals, []EnvSetting{
+			{Name: "A", Value: "from-fx", Source: EnvSourceFx},
+			{Name: "B", Value: "from-fx", Source: EnvSourceFx, Overridden: true},
+			{Name: "C", Value: "from-fx", Source: EnvSourceFx},
+			{Name: "B", Value: "from-dotenv", Source: EnvSourceDotEnv},
+			{Name: "TOKEN", Value: "[redacted]", Source: EnvSourceDotEnv, Sensitive: true},
+			{Name: "QUOTED", Value: "$not $expanded", Source: EnvSourceDotEnv},
+		})
+	})
+	t.Run("precedence", func(t *testing.T) {
+		stdout.Reset()
+		qt.Assert(t, prog.Run(context.Background(), []string{"layers"}), qt.IsNil)
+		qt.Check(t, stdout.String(), qt.Equals, "[layers] cmd(echo $A $B $C ${D-unset}): from-fx from-dotenv from-controller unset\n")
+	})
+	t.Run("redacted output", func(t *testing.T) {
+		stdout.Reset()
+		stderr.Reset()
+		qt.Assert(t, prog.Run(context.Background(), []string{"leak"}), qt.IsNil)
+		qt.Assert(t, prog.Run(context.Background(), []string{"leak_inline"}), qt.IsNil)
+		qt.Check(t, stdout.String(), qt.Equals, ""+
+			"[leak] cmd(echo token=$TOKEN; echo also $TOKEN >&2): token=[redacted]\n"+
+			"[leak_inline] cmd(echo $EXTRA): [redacted]\n")
+		qt.Check(t, stderr.String(), qt.Equals, "[leak] cmd(echo token=$TOKEN; echo also $TOKEN >&2): also [redacted]\n")
+	})
+	t.Run("redacted error", func(t *testing.T) {
+		err := prog.Run(context.Background(), []string{"leak_and_fail"})
+		var serr serum.ErrorInterface
+		qt.Assert(t, errors.As(err, &serr), qt.IsTrue)
+		qt.Check(t, serum.Code(serr), qt.Equals, wfxapi.EcodeActionCmdExit)
+		qt.Check(t, serum.Detail(serr, "stderr"), qt.Equals, "oops [redacted]\n")
+	})
+}
+
+func TestHermeticEnv(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, ".env"), []byte("DOTENV=from-dotenv\n"), 0644), qt.IsNil)
+	var stdout bytes.Buffer
+	proj, err := LoadSource("make.fx", `
+HOST_ENV = ["HOME", "MISSING"]
+ENV = {"TZ": "Europe/Berlin"}
+
+def show(fx):
+	cmd("echo $HOME ${OTHER-unset} ${DOTENV-unset} ${MISSING-unset} $TZ $LC_ALL $SOURCE_DATE_EPOCH $PATH")
+`, Options{
+		Dir:       dir,
+		Env:       []string{"PATH=/somewhere/else", "HOME=/home/someone", "OTHER=from-process"},
+		Stdout:    &stdout,
+		Verbosity: action.VerbosityVerbose,
+		Hermetic:  true,
+	})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, prog.Run(context.Background(), []string{"show"}), qt.IsNil)
+	qt.Check(t, stdout.String(), qt.Equals, "[show] cmd(echo $HOME ${OTHER-unset} ${DOTENV-un...): /home/someone unset unset unset Europe/Berlin C 315532800 /usr/local/bin:/usr/bin:/bin\n")
+	qt.Check(t, prog.Env(), qt.DeepEquals, []EnvSetting{
+		{Name: "PATH", Value: "/usr/local/bin:/usr/bin:/bin", Source: EnvSourceHermetic},
+		{Name: "LANG", Value: "C", Source: EnvSourceHermetic},
+		{Name: "LC_ALL", Value: "C", Source: EnvSourceHermetic},
+		{Name: "TZ", Value: "UTC", Source: EnvSourceHermetic, Overridden: true},
+		{Name: "SOURCE_DATE_EPOCH", Value: "315532800", Source: EnvSourceHermetic},
+		{Name: "HOME", Value: "/home/someone", Source: EnvSourceHost},
+		{Name: "TZ", Value: "Europe/Berlin", Source: EnvSourceFx},
+	})
+}
+
+func TestDotEnvInvalid(t *testing.T) {
+	for _, body := range []string{
+		"OK=1\nnot a setting\n",
+		"OK=1\n\nBAD=\"unterminated\n",
+		"OK=1\n\n\n'X'=1\n",
+	} {
+		dir := t.TempDir()
+		qt.Assert(t, os.WriteFile(filepath.Join(dir, ".env"), []byte(body), 0644), qt.IsNil)
+		proj, err := LoadSource("make.fx", "", Options{Dir: dir})
+		qt.Assert(t, err, qt.IsNil)
+		_, err = proj.Compile()
+		qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeDotEnvInvalid)
+		qt.Check(t, serum.Detail(err, "line") != "1", qt.IsTrue)
+	}
+}
+
+func TestEnvInvalid(t *testing.T) {
+	for _, src := range []string{
+		`ENV = ["A=1"]`,
+		`ENV = {"A": 1}`,
+		`SENSITIVE_ENV = "TOKEN"`,
+		`HOST_ENV = "HOME"`,
+	} {
+		proj, err := LoadSource("make.fx", src, Options{Dir: t.TempDir()})
+		qt.Assert(t, err, qt.IsNil)
+		_, err = proj.Compile()
+		qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid, qt.Commentf("%s", src))
+	}
+}
@@ -1,8 +1,11 @@
 package wfx
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"io"
+	"strings"
+	"time"
 
 	"github.com/serum-errors/go-serum"
 	"go.starlark.net/resolve"
@@ -13,61 +16,101 @@ import (
 	"github.com/warptools/wfx/pkg/wfxapi"
 )
 
-// EvalCtx shepherds an FxFile through the evaluation process.
-// It holds a reference to the FxFile itself,
-// gathers other configuration like top-level IO wiring,
-// and also carries some state between phases of parse and evaluation.
+// Program is a Project that has been compiled and had its globals evaluated: its targets are ready to be executed.
+// Get one from Project.Compile.
 //
-// It's frankly not a terribly clear abstraction, because the FxFile *also* ends up mutated throughout the process
-// (the starlark AST doesn't seem to have a convenient deepcopy method, so we just went with a dirty approach).
-//
-// There is also implicitly a statemachine here with only some orderings of calls being valid, but this is not enforced in code; caveat emptor.
-type EvalCtx struct {
-	FxFile *FxFile
+// Each Program has its own globals, so a Project can be compiled into several Programs (even concurrently),
+// and they won't interfere with each other (except, of course, through whatever effects their actions have).
+// A single Program executes one plan at a time.
+type Program struct {
+	project *Project
+	globals starlark.StringDict
 
-	Stdout io.Writer
-	Stderr io.Writer
+	env         []string        // Environment variables for actions, with the project's ENV and .env applied.  Nil means the process's own.
+	envSettings []EnvSetting    // What the project's ENV and .env set; see Env.
+	secrets     *action.Secrets // Values of sensitive variables, to be redacted.
 
-	Globals starlark.StringDict // Assigned at the end of FirstPass.
+	records       map[string]*action.Record // What each target touched, the last time it was invoked.
+	globalsRecord *action.Record            // What evaluating the top level of the script touched (e.g. a `VERSION = read_file("VERSION")`).
 }
 
 var predef = starlark.StringDict{
-	"_do":   &action.Do{},
-	"cmd":   &action.CmdPlanConstructor{},
-	"pipe":  &action.PipeControllerConstructor{},
-	"panic": &action.PanicAction{},
+	"_do":        &action.Do{},
+	"cmd":        &action.CmdPlanConstructor{},
+	"pipe":       &action.PipeControllerConstructor{},
+	"ignorantly": &action.IgnorantlyControllerConstructor{},
+	"timeout":    &action.TimeoutControllerConstructor{},
+	"panic":      &action.PanicAction{},
+	"action":     &action.ActionPlanConstructor{},
+	"env":        &action.EnvControllerConstructor{},
+	"sandboxed":  &action.SandboxedControllerConstructor{},
+
+	"mkdir":   &action.MkdirPlanConstructor{},
+	"copy":    &action.CopyPlanConstructor{},
+	"move":    &action.MovePlanConstructor{},
+	"remove":  &action.RemovePlanConstructor{},
+	"symlink": &action.SymlinkPlanConstructor{},
+
+	"write_file": &action.WriteFilePlanConstructor{},
+	"template":   &action.TemplatePlanConstructor{},
+	"fetch":      &action.FetchPlanConstructor{},
+	"unpack":     &action.UnpackPlanConstructor{},
+
+	"glob":      &action.GlobBuiltin{},
+	"exists":    &action.ExistsBuiltin{},
+	"read_file": &action.ReadFileBuiltin{},
+	"read_json": &action.ReadJSONBuiltin{},
+
+	"json":    action.JSONModule,
+	"path":    action.PathModule,
+	"re":      action.ReModule,
+	"hashing": action.HashingModule,
+	"time":    action.TimeModule,
+
+	"warpforge_run":    &action.WarpforgeRunConstructor{},
+	"warpforge_unpack": &action.WarpforgeUnpackConstructor{},
 }
 
-// FirstPass performs only the first round eval -- which identifies targets.
+// Compile performs the first round eval -- which identifies targets.
 // Starlark is evaluated here, but only whatever is used to initialize values.
-// No functions are called nor fx targets evaluated -- that comes later.
-//
-// The global values at the end of the evaluation are stored in the EvalCtx.
+// No functions are called nor fx targets evaluated -- that comes when the Program is executed.
 //
 // Errors:
 //
 //   - wfx-script-parsefail -- if the resolve phase fails,
-//      or if the second resolve after AST modification fails.
+//     or if the second resolve after AST modification fails.
 //   - wfx-eval-error -- if the init execution (computes globals) fails.
-func (ctx *EvalCtx) FirstPass() error {
+//     (Or the code of whatever it called that failed.  Either way, the error says where; see wfxapi.WithStarlarkBacktrace.)
+//   - wfx-script-invalid -- if the ENV or SENSITIVE_ENV globals aren't the right shape.
+//   - wfx-dotenv-invalid -- if the project has a .env file with a line that can't be parsed.
+//   - wfx-project-unreadable -- if the project has a .env file that can't be read.
+func (p *Project) Compile() (*Program, error) {
+	builtins := p.builtins()
+
+	// Compiling involves rewriting the AST, so we work on a fresh parse of it, and leave the FxFile's alone.
+	// (There's no deep-copy method for starlark ASTs; parsing again is the easy way to get a copy.)
+	ast, err := syntax.Parse(p.fxFile.filename, p.fxFile.body, syntax.RetainComments)
+	if err != nil {
+		return nil, wfxapi.ErrorScriptParsefail(err, "parse")
+	}
+
 	// First pass: resolve everything.
 	// This gives us some early error checking; it also populates all the `resolve.Binding` data into the AST, which is handy.
-	if err := resolve.File(ctx.FxFile.ast, predef.Has, starlark.Universe.Has); err != nil {
-		return wfxapi.ErrorScriptParsefail(err, "resolve")
+	if err := resolve.File(ast, builtins.Has, starlark.Universe.Has); err != nil {
+		return nil, wfxapi.ErrorScriptParsefail(err, "resolve")
 	}
 
 	// This walk finds any statements which contain just a call expression, and rewrites them so they're wrapped in a certain magic function.
 	// We use this to make some very fun DSL.
-	// BEWARNED: this is quite mutation-happy.  Attempting to reuse an FxFile across EvalCtx's would be unsafe.
-	// (There's no easy deep-copy method I'm aware of either; I'd happily use it to compartmentalize the phases better if there were.)
-	syntax.Walk(ctx.FxFile.ast, func(n syntax.Node) bool {
+	syntax.Walk(ast, func(n syntax.Node) bool {
 		switch n := n.(type) {
 		case *syntax.ExprStmt:
-			//fmt.Printf("::ExprStmt found: %T\n", n.X)
 			if c, ok := n.X.(*syntax.CallExpr); ok {
 				n.X = &syntax.CallExpr{
-					Fn:   &syntax.Ident{Name: "_do"},
-					Args: []syntax.Expr{c},
+					Fn:     &syntax.Ident{Name: "_do"},
+					Lparen: c.Lparen, // Calls are positioned by their paren, so errors from the action are reported where it's written.
+					Args:   []syntax.Expr{c},
+					Rparen: c.Rparen,
 				}
 			}
 		}
@@ -75,9 +118,9 @@ func (ctx *EvalCtx) FirstPass() error {
 	})
 
 	// Resolves the whole AST again (we've modified it!) and compiles the program.  Almost ready to run.
-	prog, dirtyerr := starlark.FileProgram(ctx.FxFile.ast, predef.Has)
+	prog, dirtyerr := starlark.FileProgram(ast, builtins.Has)
 	if dirtyerr != nil {
-		return wfxapi.ErrorScriptParsefail(dirtyerr, "resolve2") // n.b., internally, the "compile" process can't error... the only thing going on inside that can error is `resolve.File` again.
+		return nil, wfxapi.ErrorScriptParsefail(dirtyerr, "resolve2") // n.b., internally, the "compile" process can't error... the only thing going on inside that can error is `resolve.File` again.
 	}
 
 	// Create a "thread".  We're about to partially evaluate the script:
@@ -85,65 +128,274 @@ func (ctx *EvalCtx) FirstPass() error {
 	thread := &starlark.Thread{
 		Name: "exploration",
 		Print: func(thread *starlark.Thread, msg string) {
-			fmt.Fprintln(ctx.Stdout, "during exploratory eval: "+msg)
+			fmt.Fprintln(p.opts.stdout(), "during exploratory eval: "+msg)
 		},
 	}
+	p.setThreadEnv(thread)
+	record := &action.Record{}
+	thread.SetLocal("record", record)
 
-	globals, dirtyerr := prog.Init(thread, predef)
+	globals, dirtyerr := prog.Init(thread, builtins)
 	if dirtyerr != nil {
-		return serum.Error("wfx-eval-error",
-			serum.WithCause(dirtyerr),
-			serum.WithDetail("phase", "init"),
-		)
+		return nil, wfxapi.WithStarlarkBacktrace(dirtyerr)
 	}
 	globals.Freeze()
-	ctx.Globals = globals
+	res := &Program{project: p, globals: globals, globalsRecord: record}
+	res.env, res.secrets, err = res.compileEnv()
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
 
-	return nil
+// Project returns the Project this Program was compiled from.
+func (prog *Program) Project() *Project {
+	return prog.project
 }
 
-// InvokeTargets a graph of targets, starting with their dependencies.
-func (ctx *EvalCtx) InvokeTargets(targetNames []string) error {
-	// walk down the topo order.  keep a set of everything that's supported to be touched.
-	todo := map[string]struct{}{}
-	for _, t := range targetNames {
-		todo[t] = struct{}{}
-	}
-	order, err := toposort(ctx.FxFile.targets)
+// Run executes a graph of targets, starting with their dependencies.
+// It's Project.Plan followed by Execute.
+//
+// The names may also be paths that a target declared ownership of (with "fx_files"),
+// in which case the owning target is invoked.
+func (prog *Program) Run(ctx context.Context, targetNames []string) error {
+	plan, err := prog.project.Plan(targetNames)
 	if err != nil {
 		return err
 	}
-	for _, stepName := range order {
-		if _, exists := todo[stepName]; !exists {
-			continue
-		}
-		for _, depName := range ctx.FxFile.targetsByName[stepName].dependsOn {
-			todo[depName] = struct{}{}
+	return prog.Execute(ctx, plan)
+}
+
+// Execute invokes exactly the named targets, in the order given.
+// Dependencies are not added; use Project.Plan to produce a complete plan.
+//
+// Execution halts at the first target that fails.
+// If the context is cancelled, execution halts promptly:
+// targets that haven't started aren't started, and the current one is interrupted --
+// its starlark code stops, and so do its actions (processes are stopped as described by action.WithStopping).
+//
+// Errors:
+//
+//   - wfx-interrupted -- if the context was cancelled.
+//   - wfx-script-invalid -- if a name in the plan isn't a target.
+//   - wfx-action-error-* -- if a target fails, due to one of its actions failing.
+//   - wfx-eval-error -- if a target fails, due to an error in its starlark code.
+//
+// Errors from a target's code (including its actions) say where in make.fx they came from; see wfxapi.WithStarlarkBacktrace.
+//
+// If a target changes a path it doesn't own, that's not an error, but there's a warning (see warnUnownedWrites).
+func (prog *Program) Execute(ctx context.Context, plan []string) error {
+	for _, targetName := range plan {
+		if _, ok := prog.globals[targetName].(starlark.Callable); !ok || prog.project.fxFile.TargetByName(targetName) == nil {
+			return serum.Error(wfxapi.EcodeScriptInvalid,
+				serum.WithMessageTemplate("there is no target named {{target|q}}"),
+				serum.WithDetail("target", targetName),
+			)
 		}
 	}
-	// Now go backwards and do the things that should be done.
-	for i := len(order) - 1; i >= 0; i-- {
-		if _, exists := todo[order[i]]; !exists {
-			continue
+	events := prog.events()
+	// Each target's after scan is the next one's before scan, so there's just one scan per target.
+	scan := prog.project.fxFile.scanOwned(prog.project.opts.Dir)
+	for i, targetName := range plan {
+		err := ctx.Err()
+		if err == nil {
+			_, err = prog.invokeOneTarget(ctx, targetName)
+			if scan != nil {
+				scan = prog.warnUnownedWrites(targetName, scan)
+			}
 		}
-		_, err := ctx.invokeOneTarget(order[i])
 		if err != nil {
+			reason := "halted after target " + targetName + " failed"
+			if ctx.Err() != nil {
+				err = errorInterrupted(targetName, plan[:i], plan[i+1:])
+				reason = "interrupted during target " + targetName
+			}
+			if events != nil {
+				for _, skipped := range plan[i+1:] {
+					events.Emit(wfxapi.Event{
+						Type:   wfxapi.EventTargetSkip,
+						Target: skipped,
+						Reason: reason,
+					})
+				}
+			}
 			return err
 		}
 	}
 	return nil
 }
 
+// warnUnownedWrites checks what changed since the before scan (see scanOwned), and warns about anything the target didn't own:
+// on the Stderr in Options, and as target.warning events.
+// It returns the scan it compared against, which is the before scan for whatever runs next.
+func (prog *Program) warnUnownedWrites(targetName string, before ownershipScan) ownershipScan {
+	opts := prog.project.opts
+	fxFile := prog.project.fxFile
+	after := fxFile.scanOwned(opts.Dir)
+	changed := changedPaths(before, after)
+	for _, warning := range fxFile.unownedWrites(fxFile.TargetByName(targetName), changed) {
+		fmt.Fprintf(opts.stderr(), "wfx: warning: %s\n", warning)
+		if events := prog.events(); events != nil {
+			events.Emit(wfxapi.Event{
+				Type:    wfxapi.EventTargetWarn,
+				Time:    time.Now(),
+				Target:  targetName,
+				Warning: wfxapi.NewEventErrorInfo(warning),
+			})
+		}
+	}
+	return after
+}
+
+// errorInterrupted describes how far execution got before it was interrupted:
+// the target it was in the middle of, and (as comma-separated lists) the ones that completed, and the ones that didn't get to run.
+func errorInterrupted(targetName string, completed, notRun []string) error {
+	return serum.Error(wfxapi.EcodeInterrupted,
+		serum.WithMessageTemplate("interrupted during target {{target|q}}"),
+		serum.WithDetail("target", targetName),
+		serum.WithDetail("completed", strings.Join(completed, ",")),
+		serum.WithDetail("notrun", strings.Join(notRun, ",")),
+	)
+}
+
+// events returns where events should go (the Events in Options), with the project's secrets redacted from them;
+// or nil, if events aren't wanted.
+func (prog *Program) events() wfxapi.EventSink {
+	if prog.project.opts.Events == nil {
+		return nil
+	}
+	return action.RedactingEventSink(prog.project.opts.Events, prog.secrets)
+}
+
+// Record returns what the named target touched (the paths its actions reported reading and producing), the last time it was invoked.
+// Returns nil if the target hasn't been invoked.
+func (prog *Program) Record(targetName string) *action.Record {
+	return prog.records[targetName]
+}
+
+// Inputs returns the paths the named target reads: the ones it declared (with "fx_inputs"),
+// plus the ones its actions reported reading, the last time it was invoked (see Record).
+// Paths may be directories, in which case everything within them counts as an input.
+func (prog *Program) Inputs(targetName string) []string {
+	t := prog.project.fxFile.TargetByName(targetName)
+	if t == nil {
+		return nil
+	}
+	res := append([]string(nil), t.Inputs()...)
+	return append(res, prog.Record(targetName).Inputs()...)
+}
+
+// GlobalInputs returns the paths that were read while the top level of the script was evaluated (by Project.Compile),
+// such as by a `VERSION = read_file("VERSION")`.  If any of them change, the globals may be stale: compile again.
+// Paths may be directories (e.g. where a glob looked), in which case everything within them counts.
+func (prog *Program) GlobalInputs() []string {
+	return prog.globalsRecord.Inputs()
+}
+
+// Affected is like FxFile.Affected, but a target is also affected if anything it was recorded reading changed (see Inputs).
+func (prog *Program) Affected(plan []string, changed []string) []string {
+	return prog.project.fxFile.affected(plan, changed, func(t *Target) []string {
+		return prog.Inputs(t.name)
+	})
+}
+
 // invokeOneTarget calls exactly one target.  It does not call dependencies.
-func (ctx *EvalCtx) invokeOneTarget(targetName string) (starlark.Value, error) {
+// If the target declared a timeout, and it runs out, the error is a wfx-timeout error.
+func (prog *Program) invokeOneTarget(ctx context.Context, targetName string) (starlark.Value, error) {
+	limit := prog.project.fxFile.TargetByName(targetName).Timeout()
+	if limit == 0 {
+		return prog.callTarget(ctx, targetName)
+	}
+	tctx, cancel := context.WithTimeout(ctx, limit)
+	defer cancel()
+	start := time.Now()
+	res, err := prog.callTarget(tctx, targetName)
+	if err != nil && action.TimedOut(tctx) && ctx.Err() == nil {
+		err = errorTargetTimeout(targetName, limit, time.Since(start), err)
+	}
+	return res, err
+}
+
+// errorTargetTimeout is for when a target's own time limit ran out.
+// If it was a command that was running at the time, the cause says so, and its "cmd" is included.
+func errorTargetTimeout(targetName string, limit time.Duration, elapsed time.Duration, cause error) error {
+	tmpl := "target {{target|q}} timed out after {{elapsed}} (limit {{limit}})"
+	params := []serum.WithConstruction{
+		serum.WithDetail("target", targetName),
+		serum.WithDetail("elapsed", action.FormatElapsed(elapsed)),
+		serum.WithDetail("limit", limit.String()),
+	}
+	var serr serum.ErrorInterface
+	if errors.As(cause, &serr) {
+		if cmd := serum.Detail(serr, "cmd"); cmd != "" {
+			tmpl += ", while running cmd {{cmd|q}}"
+			params = append(params, serum.WithDetail("cmd", cmd))
+		}
+		if stderr := serum.Detail(serr, "stderr"); stderr != "" {
+			params = append(params, serum.WithDetail("stderr", stderr))
+		}
+	}
+	params = append(params, serum.WithMessageTemplate(tmpl))
+	return serum.Error(wfxapi.EcodeTimeout, params...)
+}
+
+// callTarget does the work of invokeOneTarget.
+func (prog *Program) callTarget(ctx context.Context, targetName string) (starlark.Value, error) {
+	opts := prog.project.opts
 	thread := &starlark.Thread{
 		Name: "eval",
 		Print: func(thread *starlark.Thread, msg string) {
-			fmt.Fprintln(ctx.Stdout, "during target invokation (target="+targetName+"): "+msg)
+			fmt.Fprintln(opts.stdout(), "during target invokation (target="+targetName+"): "+msg)
 		},
 	}
-	thread.SetLocal("stdout", ctx.Stdout)
-	thread.SetLocal("stderr", ctx.Stderr)
+	thread.SetLocal("ctx", ctx)
+	thread.SetLocal("stdout", opts.stdout())
+	thread.SetLocal("stderr", opts.stderr())
+	thread.SetLocal("target", targetName)
+	thread.SetLocal("outputs", prog.project.fxFile.TargetByName(targetName).Files())
+	thread.SetLocal("verbosity", opts.Verbosity)
+	prog.project.setThreadEnv(thread)
+	if prog.env != nil {
+		thread.SetLocal("env", prog.env)
+	}
+	thread.SetLocal("secrets", prog.secrets)
+	record := &action.Record{}
+	if prog.records == nil {
+		prog.records = map[string]*action.Record{}
+	}
+	prog.records[targetName] = record
+	thread.SetLocal("record", record)
+
+	// Starlark checks for cancellation between steps of evaluation, so this stops the target's own code promptly.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			thread.Cancel(ctx.Err().Error())
+		case <-stop:
+		}
+	}()
 
-	return starlark.Call(thread, ctx.Globals[targetName], []starlark.Value{starlark.None}, nil)
+	events := prog.events()
+	if events == nil {
+		res, err := starlark.Call(thread, prog.globals[targetName], []starlark.Value{starlark.None}, nil)
+		return res, wfxapi.WithStarlarkBacktrace(err)
+	}
+	thread.SetLocal("events", events)
+	start := time.Now()
+	events.Emit(wfxapi.Event{
+		Type:   wfxapi.EventTargetStart,
+		Time:   start,
+		Target: targetName,
+	})
+	res, err := starlark.Call(thread, prog.globals[targetName], []starlark.Value{starlark.None}, nil)
+	err = wfxapi.WithStarlarkBacktrace(err)
+	events.Emit(wfxapi.Event{
+		Type:     wfxapi.EventTargetFinish,
+		Target:   targetName,
+		Duration: wfxapi.DurationMillis(time.Since(start)),
+		Error:    wfxapi.NewEventErrorInfo(err),
+	})
+	return res, err
 }
@@ -0,0 +1,480 @@
+package wfx
+
+import (
+	"sort"
+	"strings"
+
+	"go.starlark.net/syntax"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Format reprints a make.fx file in the canonical layout:
+
+  - Indentation is tabs; operators and commas are spaced the usual way; keyword arguments and parameter defaults have no spaces around the "=".
+  - Brackets (calls, lists, dicts, parenthesized tuples, and def parameters) stay on one line if they were on one line;
+    otherwise, each item goes on its own line, with a trailing comma.
+  - Blank lines between statements are kept, but never more than one in a row; top-level defs always have one on each side.
+  - Simple single-quoted strings become double-quoted.  Other literals are left as they were written.
+  - A target's depends_on is always a list, sorted, without duplicates.  (It's a set: the order never mattered.)
+
+Comments are kept.  Comments on the end of a line stay on the end of that line (or, if the line was split up or joined, the line that its code ends up on);
+whole-line comments stay before the code they were before (so a comment at the end of a block moves to before whatever follows the block).
+*/
+
+// Format returns the canonical formatting of a make.fx file.
+// Formatting is idempotent: formatting the result again changes nothing.
+//
+// Errors:
+//
+//   - wfx-script-parsefail -- if the file can't be parsed.
+func Format(filename string, body string) ([]byte, error) {
+	ast, err := syntax.Parse(filename, body, syntax.RetainComments)
+	if err != nil {
+		return nil, wfxapi.ErrorScriptParsefail(err, "parse")
+	}
+	normalizeDependsOn(ast)
+	p := &printer{atLineStart: true}
+	p.stmts(ast.Stmts, true, nil)
+	if c := ast.Comments(); c != nil && len(c.After) > 0 {
+		if len(ast.Stmts) > 0 {
+			_, end := ast.Stmts[len(ast.Stmts)-1].Span()
+			if c.After[0].Start.Line-end.Line > 1 {
+				p.out.WriteByte('\n')
+			}
+		}
+		p.comments(c.After)
+	}
+	return []byte(p.out.String()), nil
+}
+
+// normalizeDependsOn rewrites the depends_on of every target to be a sorted list without duplicates, if it's all string literals.
+func normalizeDependsOn(ast *syntax.File) {
+	for _, stmt := range ast.Stmts {
+		def, ok := stmt.(*syntax.DefStmt)
+		if !ok || !isTargetDef(def) {
+			continue
+		}
+		for _, param := range def.Params[1:] {
+			bin, ok := param.(*syntax.BinaryExpr)
+			if !ok || lintParamName(bin) == nil || lintParamName(bin).Name != "depends_on" {
+				continue
+			}
+			switch y := bin.Y.(type) {
+			case *syntax.Literal:
+				if y.Token == syntax.STRING {
+					bin.Y = &syntax.ListExpr{Lbrack: y.TokenPos, List: []syntax.Expr{y}, Rbrack: y.TokenPos}
+				}
+			case *syntax.ListExpr:
+				if !allStringLiterals(y.List) {
+					continue
+				}
+				sort.SliceStable(y.List, func(i, j int) bool {
+					return y.List[i].(*syntax.Literal).Value.(string) < y.List[j].(*syntax.Literal).Value.(string)
+				})
+				deduped := y.List[:0]
+				for i, item := range y.List {
+					if i > 0 && item.(*syntax.Literal).Value == y.List[i-1].(*syntax.Literal).Value {
+						continue
+					}
+					deduped = append(deduped, item)
+				}
+				y.List = deduped
+			}
+		}
+	}
+}
+
+func allStringLiterals(list []syntax.Expr) bool {
+	for _, item := range list {
+		if lit, ok := item.(*syntax.Literal); !ok || lit.Token != syntax.STRING {
+			return false
+		}
+	}
+	return true
+}
+
+type printer struct {
+	out         strings.Builder
+	indent      int
+	atLineStart bool
+	pending     []syntax.Comment // Suffix comments, waiting for the end of the line.
+}
+
+func (p *printer) write(s string) {
+	if p.atLineStart {
+		p.out.WriteString(strings.Repeat("\t", p.indent))
+		p.atLineStart = false
+	}
+	p.out.WriteString(s)
+}
+
+// newline ends the line, with any pending suffix comments.
+func (p *printer) newline() {
+	for _, c := range p.pending {
+		p.out.WriteString("  " + c.Text)
+	}
+	p.pending = nil
+	p.out.WriteByte('\n')
+	p.atLineStart = true
+}
+
+// comments prints whole-line comments, keeping (single) blank lines between them.
+func (p *printer) comments(list []syntax.Comment) {
+	for i, c := range list {
+		if i > 0 && c.Start.Line-list[i-1].Start.Line > 1 {
+			p.out.WriteByte('\n')
+		}
+		p.write(c.Text)
+		p.newline()
+	}
+}
+
+// before prints the whole-line comments before a node.
+// Statements and bracketed items are always at the start of a line; anything else that has comments before it must have been inside brackets,
+// so it's safe to break the line for them.
+func (p *printer) before(n syntax.Node) {
+	c := n.Comments()
+	if c == nil || len(c.Before) == 0 {
+		return
+	}
+	if p.atLineStart {
+		p.comments(c.Before)
+		if start, _ := n.Span(); start.Line-c.Before[len(c.Before)-1].Start.Line > 1 {
+			p.out.WriteByte('\n')
+		}
+		return
+	}
+	// Break the line, and continue it a level deeper.
+	p.indent++
+	p.newline()
+	p.comments(c.Before)
+	p.write("")
+	p.indent--
+}
+
+// after queues the suffix comments of a node, to be printed at the end of the line.
+func (p *printer) after(n syntax.Node) {
+	if c := n.Comments(); c != nil {
+		p.pending = append(p.pending, c.Suffix...)
+	}
+}
+
+// firstLine returns the line a statement starts on, including any comments before it.
+func firstLine(stmt syntax.Stmt) int32 {
+	if c := stmt.Comments(); c != nil && len(c.Before) > 0 {
+		return c.Before[0].Start.Line
+	}
+	start, _ := stmt.Span()
+	return start.Line
+}
+
+func (p *printer) stmts(list []syntax.Stmt, toplevel bool, trailing []syntax.Comment) {
+	for i, stmt := range list {
+		if i > 0 {
+			_, prevEnd := list[i-1].Span()
+			_, prevIsDef := list[i-1].(*syntax.DefStmt)
+			_, isDef := stmt.(*syntax.DefStmt)
+			if toplevel && (prevIsDef || isDef) || firstLine(stmt)-prevEnd.Line > 1 {
+				p.out.WriteByte('\n')
+			}
+		}
+		var tr []syntax.Comment
+		if i == len(list)-1 {
+			tr = trailing
+		}
+		p.stmt(stmt, tr)
+	}
+}
+
+func (p *printer) block(list []syntax.Stmt, trailing []syntax.Comment) {
+	p.indent++
+	p.stmts(list, false, trailing)
+	p.indent--
+}
+
+// stmt prints a statement, and ends its line.
+// The trailing comments are suffix comments that belong at the end of the statement's last line (from an enclosing compound statement).
+func (p *printer) stmt(stmt syntax.Stmt, trailing []syntax.Comment) {
+	p.before(stmt)
+	var suffix []syntax.Comment
+	if c := stmt.Comments(); c != nil {
+		suffix = c.Suffix
+	}
+	trailing = append(append([]syntax.Comment{}, suffix...), trailing...)
+	switch s := stmt.(type) {
+	case *syntax.ExprStmt:
+		p.expr(s.X)
+	case *syntax.AssignStmt:
+		p.expr(s.LHS)
+		p.write(" " + s.Op.String() + " ")
+		p.expr(s.RHS)
+	case *syntax.ReturnStmt:
+		p.write("return")
+		if s.Result != nil {
+			p.write(" ")
+			p.expr(s.Result)
+		}
+	case *syntax.BranchStmt:
+		p.write(s.Token.String())
+	case *syntax.LoadStmt:
+		p.write("load(")
+		p.expr(s.Module)
+		for i := range s.From {
+			p.write(", ")
+			if s.To[i].Name != s.From[i].Name {
+				p.write(s.To[i].Name + "=")
+			}
+			p.write(syntax.Quote(s.From[i].Name, false))
+		}
+		p.write(")")
+	case *syntax.DefStmt:
+		p.write("def ")
+		p.expr(s.Name)
+		multiline := false
+		if len(s.Params) > 0 {
+			_, end := s.Params[len(s.Params)-1].Span()
+			multiline = end.Line != s.Def.Line
+		}
+		p.seq("(", ")", s.Params, multiline, false)
+		p.write(":")
+		p.newline()
+		p.block(s.Body, trailing)
+		return
+	case *syntax.IfStmt:
+		p.ifStmt(s, trailing)
+		return
+	case *syntax.ForStmt:
+		p.write("for ")
+		p.expr(s.Vars)
+		p.write(" in ")
+		p.expr(s.X)
+		p.write(":")
+		p.newline()
+		p.block(s.Body, trailing)
+		return
+	case *syntax.WhileStmt:
+		p.write("while ")
+		p.expr(s.Cond)
+		p.write(":")
+		p.newline()
+		p.block(s.Body, trailing)
+		return
+	}
+	p.pending = append(p.pending, trailing...)
+	p.newline()
+}
+
+// ifStmt prints an if statement, and its chain of elifs and else.
+// (The parser represents elif as an if statement that's alone in the else block, and which starts where the else does.)
+func (p *printer) ifStmt(s *syntax.IfStmt, trailing []syntax.Comment) {
+	p.write("if ")
+	for {
+		p.expr(s.Cond)
+		p.write(":")
+		p.newline()
+		if len(s.False) == 0 {
+			p.block(s.True, trailing)
+			return
+		}
+		p.block(s.True, nil)
+		if elif, ok := s.False[0].(*syntax.IfStmt); ok && len(s.False) == 1 && elif.If == s.ElsePos {
+			p.before(elif)
+			if c := elif.Comments(); c != nil {
+				trailing = append(append([]syntax.Comment{}, c.Suffix...), trailing...)
+			}
+			p.write("elif ")
+			s = elif
+			continue
+		}
+		p.write("else:")
+		p.newline()
+		p.block(s.False, trailing)
+		return
+	}
+}
+
+// seq prints bracketed items, separated by commas: on one line, or one per line.
+// If tuple1 is true and there's just one item, it gets a trailing comma anyway (as a one-item tuple needs).
+func (p *printer) seq(open, close string, items []syntax.Expr, multiline bool, tuple1 bool) {
+	p.write(open)
+	if multiline && len(items) > 0 {
+		p.indent++
+		p.newline()
+		for _, item := range items {
+			p.expr(item)
+			p.write(",")
+			p.newline()
+		}
+		p.indent--
+	} else {
+		for i, item := range items {
+			if i > 0 {
+				p.write(", ")
+			}
+			p.expr(item)
+		}
+		if tuple1 && len(items) == 1 {
+			p.write(",")
+		}
+	}
+	p.write(close)
+}
+
+func spansLines(start, end syntax.Position) bool {
+	return start.Line != end.Line
+}
+
+func (p *printer) expr(e syntax.Expr) {
+	p.before(e)
+	switch e := e.(type) {
+	case *syntax.Ident:
+		p.write(e.Name)
+	case *syntax.Literal:
+		p.write(canonicalLiteral(e))
+	case *syntax.ParenExpr:
+		p.write("(")
+		p.expr(e.X)
+		p.write(")")
+	case *syntax.UnaryExpr:
+		p.write(e.Op.String())
+		if e.Op == syntax.NOT {
+			p.write(" ")
+		}
+		if e.X != nil {
+			p.expr(e.X)
+		}
+	case *syntax.BinaryExpr:
+		p.expr(e.X)
+		if e.Op == syntax.EQ { // Only in arguments and parameters.
+			p.write("=")
+		} else {
+			p.write(" " + e.Op.String() + " ")
+		}
+		p.expr(e.Y)
+	case *syntax.CallExpr:
+		p.expr(e.Fn)
+		p.seq("(", ")", e.Args, spansLines(e.Lparen, e.Rparen), false)
+	case *syntax.DotExpr:
+		p.expr(e.X)
+		p.write(".")
+		p.expr(e.Name)
+	case *syntax.IndexExpr:
+		p.expr(e.X)
+		p.write("[")
+		p.expr(e.Y)
+		p.write("]")
+	case *syntax.SliceExpr:
+		p.expr(e.X)
+		p.write("[")
+		if e.Lo != nil {
+			p.expr(e.Lo)
+		}
+		p.write(":")
+		if e.Hi != nil {
+			p.expr(e.Hi)
+		}
+		if e.Step != nil {
+			p.write(":")
+			p.expr(e.Step)
+		}
+		p.write("]")
+	case *syntax.ListExpr:
+		p.seq("[", "]", e.List, spansLines(e.Lbrack, e.Rbrack), false)
+	case *syntax.TupleExpr:
+		if e.Lparen.IsValid() {
+			p.seq("(", ")", e.List, spansLines(e.Lparen, e.Rparen), true)
+		} else {
+			for i, item := range e.List {
+				if i > 0 {
+					p.write(", ")
+				}
+				p.expr(item)
+			}
+			if len(e.List) == 1 {
+				p.write(",")
+			}
+		}
+	case *syntax.DictExpr:
+		p.seq("{", "}", e.List, spansLines(e.Lbrace, e.Rbrace), false)
+	case *syntax.DictEntry:
+		p.expr(e.Key)
+		p.write(": ")
+		p.expr(e.Value)
+	case *syntax.Comprehension:
+		open, close := "[", "]"
+		if e.Curly {
+			open, close = "{", "}"
+		}
+		p.write(open)
+		multiline := spansLines(e.Lbrack, e.Rbrack)
+		if multiline {
+			p.indent++
+			p.newline()
+		}
+		p.expr(e.Body)
+		for _, clause := range e.Clauses {
+			if multiline {
+				p.newline()
+			} else {
+				p.write(" ")
+			}
+			p.clause(clause)
+		}
+		if multiline {
+			p.newline()
+			p.indent--
+		}
+		p.write(close)
+	case *syntax.CondExpr:
+		p.expr(e.True)
+		p.write(" if ")
+		p.expr(e.Cond)
+		p.write(" else ")
+		p.expr(e.False)
+	case *syntax.LambdaExpr:
+		p.write("lambda")
+		for i, param := range e.Params {
+			if i == 0 {
+				p.write(" ")
+			} else {
+				p.write(", ")
+			}
+			p.expr(param)
+		}
+		p.write(": ")
+		p.expr(e.Body)
+	}
+	p.after(e)
+}
+
+// clause prints a for or if clause of a comprehension.
+func (p *printer) clause(n syntax.Node) {
+	p.before(n)
+	switch c := n.(type) {
+	case *syntax.ForClause:
+		p.write("for ")
+		p.expr(c.Vars)
+		p.write(" in ")
+		p.expr(c.X)
+	case *syntax.IfClause:
+		p.write("if ")
+		p.expr(c.Cond)
+	}
+	p.after(n)
+}
+
+// canonicalLiteral returns how a literal should be written:
+// as it was, except that simple single-quoted strings (with no escapes, and no double quotes in them) become double-quoted.
+func canonicalLiteral(lit *syntax.Literal) string {
+	raw := lit.Raw
+	if lit.Token != syntax.STRING || len(raw) < 2 || raw[0] != '\'' || strings.HasPrefix(raw, "'''") {
+		return raw
+	}
+	inner := raw[1 : len(raw)-1]
+	if strings.ContainsAny(inner, "\"\\") {
+		return raw
+	}
+	return "\"" + inner + "\""
+}
@@ -0,0 +1,117 @@
+package wfx
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/warpfork/go-testmark"
+	"go.starlark.net/syntax"
+)
+
+const formatIn = `# Header.
+
+load( 'lib.star' , 'a', b2 = 'b' )
+
+
+
+ENV = {'A':'1', "B" : "2"}  # settings
+def build(fx,depends_on=["test","gen","gen"],timeout="1m"):  # the build
+    # first thing
+    x = [i*2 for i in range(10) if i%2]
+    pipe(cmd("echo hi"),
+        cmd("tr h q"),  # shout
+        # then write
+        write_file('out.txt'))
+    if x:
+        pass
+    elif not x:  # elif comment
+        print(x[1:2], x[::2], -x[0])
+    else:
+        return {'k': lambda a, b=1: a+b}, (1,)
+def gen(fx, depends_on='test'):
+  for a, b in [(1,2), (3,4)]:
+    continue  # trailing of for
+# the end
+`
+
+const formatOut = `# Header.
+
+load("lib.star", "a", b2="b")
+
+ENV = {"A": "1", "B": "2"}  # settings
+
+def build(fx, depends_on=["gen", "test"], timeout="1m"):  # the build
+	# first thing
+	x = [i * 2 for i in range(10) if i % 2]
+	pipe(
+		cmd("echo hi"),
+		cmd("tr h q"),  # shout
+		# then write
+		write_file("out.txt"),
+	)
+	if x:
+		pass
+	elif not x:  # elif comment
+		print(x[1:2], x[::2], -x[0])
+	else:
+		return {"k": lambda a, b=1: a + b}, (1,)
+
+def gen(fx, depends_on=["test"]):
+	for a, b in [(1, 2), (3, 4)]:
+		continue  # trailing of for
+# the end
+`
+
+func TestFormat(t *testing.T) {
+	got, err := Format("make.fx", formatIn)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, string(got), qt.Equals, formatOut)
+}
+
+// TestFormatFixtures checks that formatting every make.fx in the fixtures (that parses) is idempotent, and loses no comments.
+func TestFormatFixtures(t *testing.T) {
+	files, err := filepath.Glob("../../fixtures/*.md")
+	qt.Assert(t, err, qt.IsNil)
+	sources := []string{formatIn}
+	for _, file := range files {
+		doc, err := testmark.ReadFile(file)
+		qt.Assert(t, err, qt.IsNil)
+		for _, hunk := range doc.DataHunks {
+			if strings.HasSuffix(hunk.Name, "/make.fx") {
+				sources = append(sources, string(hunk.Body))
+			}
+		}
+	}
+	for _, src := range sources {
+		if _, err := syntax.Parse("make.fx", src, 0); err != nil {
+			continue // Some fixtures are about syntax errors.
+		}
+		once, err := Format("make.fx", src)
+		qt.Assert(t, err, qt.IsNil, qt.Commentf("%s", src))
+		twice, err := Format("make.fx", string(once))
+		qt.Assert(t, err, qt.IsNil, qt.Commentf("%s", once))
+		qt.Check(t, string(twice), qt.Equals, string(once))
+		qt.Check(t, countComments(t, string(once)), qt.Equals, countComments(t, src))
+	}
+}
+
+func countComments(t *testing.T, src string) int {
+	ast, err := syntax.Parse("make.fx", src, syntax.RetainComments)
+	qt.Assert(t, err, qt.IsNil)
+	n := 0
+	count := func(node syntax.Node) {
+		if c := node.Comments(); c != nil {
+			n += len(c.Before) + len(c.Suffix) + len(c.After)
+		}
+	}
+	count(ast)
+	syntax.Walk(ast, func(node syntax.Node) bool {
+		if node != nil {
+			count(node)
+		}
+		return true
+	})
+	return n
+}
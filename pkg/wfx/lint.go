@@ -0,0 +1,357 @@
+package wfx
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// Severities of LintFinding.
+const (
+	LintError   = "error"   // The script won't work as written.
+	LintWarning = "warning" // The script works, but probably doesn't do what was meant.
+)
+
+// LintFinding is one problem found by Lint.
+// Codes are the wfxapi.EcodeLint* constants (or wfx-script-parsefail, for anything starlark itself rejects).
+type LintFinding struct {
+	File     string `json:"file"`
+	Line     int32  `json:"line"`
+	Col      int32  `json:"col"`
+	Code     string `json:"code"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// String renders the finding the way compilers do: "file:line:col: code: message".
+func (f LintFinding) String() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", f.File, f.Line, f.Col, f.Code, f.Message)
+}
+
+// Lint checks a make.fx file for mistakes, without evaluating any of it.
+// The builtins are what the file will be evaluated with; nil means Builtins().
+//
+// Unlike ParseFxFile, Lint doesn't stop at the first problem: it reports everything it can find, sorted by position.
+// If the file can't be parsed at all, that's the only finding.
+// If names don't resolve, the checks that depend on knowing what every name refers to are skipped.
+//
+// The checks are:
+//
+//   - targets named after builtins (which then hide the builtin everywhere), and calls to parameters that hide a builtin
+//     (like `timeout(...)`, in a target that has a `timeout` parameter);
+//   - depends_on entries that aren't the names of targets, and depends_on values that aren't string literals;
+//   - targets that claim the same path in fx_files (or one a path within another's);
+//   - helper functions that nothing uses (unless their name starts with "_");
+//   - action plans that are assigned to a variable that's never used -- so they're never executed
+//     (only action calls that are statements on their own are executed automatically);
+//   - print at the top level, which only happens while make.fx is being compiled, not when targets run.
+func Lint(filename string, body string, builtins starlark.StringDict) []LintFinding {
+	if builtins == nil {
+		builtins = Builtins()
+	}
+	l := &linter{builtins: builtins}
+	ast, err := syntax.Parse(filename, body, syntax.RetainComments)
+	if err != nil {
+		if serr, ok := err.(syntax.Error); ok {
+			l.report(serr.Pos, wfxapi.EcodeScriptParsefail, LintError, "%s", serr.Msg)
+		} else {
+			l.report(syntax.MakePosition(&filename, 1, 1), wfxapi.EcodeScriptParsefail, LintError, "%s", err)
+		}
+		return l.findings
+	}
+	resolved := true
+	if err := resolve.File(ast, builtins.Has, starlark.Universe.Has); err != nil {
+		resolved = false
+		if errs, ok := err.(resolve.ErrorList); ok {
+			for _, rerr := range errs {
+				l.report(rerr.Pos, wfxapi.EcodeScriptParsefail, LintError, "%s", rerr.Msg)
+			}
+		} else {
+			l.report(syntax.MakePosition(&filename, 1, 1), wfxapi.EcodeScriptParsefail, LintError, "%s", err)
+		}
+	}
+
+	l.lintTargets(ast)
+	l.lintOwnership(ast)
+	l.lintToplevelPrint(ast)
+	if resolved {
+		l.countUses(ast)
+		l.lintShadowingParams(ast)
+		l.lintUnusedHelpers(ast)
+		l.lintUnexecutedPlans(ast)
+	}
+
+	sort.SliceStable(l.findings, func(i, j int) bool {
+		a, b := l.findings[i], l.findings[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Col < b.Col
+	})
+	return l.findings
+}
+
+type linter struct {
+	builtins starlark.StringDict
+	uses     map[*resolve.Binding]int // How many identifiers refer to each variable (including where it's bound).
+	findings []LintFinding
+}
+
+func (l *linter) report(pos syntax.Position, code, severity, format string, args ...interface{}) {
+	l.findings = append(l.findings, LintFinding{
+		File:     pos.Filename(),
+		Line:     pos.Line,
+		Col:      pos.Col,
+		Code:     code,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (l *linter) isBuiltin(name string) bool {
+	return l.builtins.Has(name) || starlark.Universe.Has(name)
+}
+
+// lintParamName is like extractIdent, but doesn't mind `*args` and `**kwargs` (it returns nil for them).
+func lintParamName(param syntax.Expr) *syntax.Ident {
+	switch p := param.(type) {
+	case *syntax.Ident:
+		return p
+	case *syntax.BinaryExpr:
+		return lintParamName(p.X)
+	default:
+		return nil
+	}
+}
+
+// isTargetDef is the same rule findTargets uses: a top-level def whose first parameter is "fx".
+func isTargetDef(def *syntax.DefStmt) bool {
+	if len(def.Params) < 1 {
+		return false
+	}
+	id := lintParamName(def.Params[0])
+	return id != nil && id.Name == "fx"
+}
+
+// lintTargets checks target names and depends_on clauses.
+func (l *linter) lintTargets(ast *syntax.File) {
+	targetNames := map[string]bool{}
+	for _, stmt := range ast.Stmts {
+		if def, ok := stmt.(*syntax.DefStmt); ok && isTargetDef(def) {
+			targetNames[def.Name.Name] = true
+		}
+	}
+	for _, stmt := range ast.Stmts {
+		def, ok := stmt.(*syntax.DefStmt)
+		if !ok || !isTargetDef(def) {
+			continue
+		}
+		if l.isBuiltin(def.Name.Name) {
+			l.report(def.Name.NamePos, wfxapi.EcodeLintShadowedBuiltin, LintWarning,
+				"target %q hides the builtin of the same name, everywhere in this file", def.Name.Name)
+		}
+		for _, param := range def.Params[1:] {
+			bin, ok := param.(*syntax.BinaryExpr)
+			if !ok || lintParamName(bin) == nil || lintParamName(bin).Name != "depends_on" {
+				continue
+			}
+			var lits []syntax.Expr
+			switch y := bin.Y.(type) {
+			case *syntax.ListExpr:
+				lits = y.List
+			default:
+				lits = []syntax.Expr{y}
+			}
+			for _, expr := range lits {
+				lit, ok := expr.(*syntax.Literal)
+				if !ok || lit.Token != syntax.STRING {
+					start, _ := expr.Span()
+					l.report(start, wfxapi.EcodeLintNonliteralDependsOn, LintError,
+						"depends_on may only use string literals (or a list of them), since it's read without evaluating anything")
+					continue
+				}
+				if name := lit.Value.(string); !targetNames[name] {
+					l.report(lit.TokenPos, wfxapi.EcodeLintUnknownDependency, LintError,
+						"target %q depends on %q, which isn't a target", def.Name.Name, name)
+				}
+			}
+		}
+	}
+}
+
+// lintOwnership checks that no two targets claim the same path (see findOwnershipConflicts).
+// If the targets can't be read (e.g. an fx_files that isn't literal), ParseFxFile says so, and there's nothing to check.
+func (l *linter) lintOwnership(ast *syntax.File) {
+	targets, err := findTargets(ast)
+	if err != nil {
+		return
+	}
+	for _, c := range findOwnershipConflicts(targets) {
+		pos := c.target.stmt.Name.NamePos
+		if bin, ok := c.target.param("fx_files").(*syntax.BinaryExpr); ok {
+			pos, _ = bin.Y.Span()
+		}
+		l.report(pos, wfxapi.EcodeOwnershipConflict, LintError, "%s", serum.Message(c.error()))
+	}
+}
+
+// lintToplevelPrint checks for print calls that happen when the file is compiled, rather than in a target.
+func (l *linter) lintToplevelPrint(ast *syntax.File) {
+	for _, stmt := range ast.Stmts {
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			switch n := n.(type) {
+			case *syntax.DefStmt, *syntax.LambdaExpr:
+				return false
+			case *syntax.CallExpr:
+				if id, ok := n.Fn.(*syntax.Ident); ok && id.Name == "print" && !isRebound(id) {
+					l.report(id.NamePos, wfxapi.EcodeLintToplevelPrint, LintWarning,
+						"print at the top level only happens while make.fx is being compiled, not when targets run; put it in a target")
+				}
+			}
+			return true
+		})
+	}
+}
+
+// isRebound returns true if the resolver found the identifier refers to something the file defines, rather than a builtin.
+// (If names weren't resolved, it's false.)
+func isRebound(id *syntax.Ident) bool {
+	b, ok := id.Binding.(*resolve.Binding)
+	return ok && b.Scope != resolve.Predeclared && b.Scope != resolve.Universal
+}
+
+func (l *linter) countUses(ast *syntax.File) {
+	l.uses = map[*resolve.Binding]int{}
+	syntax.Walk(ast, func(n syntax.Node) bool {
+		if id, ok := n.(*syntax.Ident); ok {
+			if b, ok := id.Binding.(*resolve.Binding); ok {
+				l.uses[b]++
+			}
+		}
+		return true
+	})
+}
+
+// usedElsewhere returns true if any identifier other than id itself refers to the same variable.
+func (l *linter) usedElsewhere(id *syntax.Ident) bool {
+	b, ok := id.Binding.(*resolve.Binding)
+	return !ok || l.uses[b] > 1
+}
+
+// lintShadowingParams checks for calls to a parameter that has the same name as a builtin
+// (which calls the parameter's value, not the builtin -- e.g. a target's `timeout` parameter, which is a string).
+func (l *linter) lintShadowingParams(ast *syntax.File) {
+	syntax.Walk(ast, func(n syntax.Node) bool {
+		def, ok := n.(*syntax.DefStmt)
+		if !ok {
+			return true
+		}
+		shadowing := map[*resolve.Binding]bool{}
+		for _, param := range def.Params {
+			if id := lintParamName(param); id != nil && l.isBuiltin(id.Name) {
+				if b, ok := id.Binding.(*resolve.Binding); ok {
+					shadowing[b] = true
+				}
+			}
+		}
+		if len(shadowing) == 0 {
+			return true
+		}
+		for _, stmt := range def.Body {
+			syntax.Walk(stmt, func(n syntax.Node) bool {
+				call, ok := n.(*syntax.CallExpr)
+				if !ok {
+					return true
+				}
+				if id, ok := call.Fn.(*syntax.Ident); ok {
+					if b, ok := id.Binding.(*resolve.Binding); ok && shadowing[b] {
+						l.report(id.NamePos, wfxapi.EcodeLintShadowedBuiltin, LintWarning,
+							"this calls the parameter %q of %q, not the builtin of the same name", id.Name, def.Name.Name)
+					}
+				}
+				return true
+			})
+		}
+		return true
+	})
+}
+
+// lintUnusedHelpers checks for top-level functions that aren't targets, and that nothing refers to.
+func (l *linter) lintUnusedHelpers(ast *syntax.File) {
+	for _, stmt := range ast.Stmts {
+		def, ok := stmt.(*syntax.DefStmt)
+		if !ok || isTargetDef(def) || strings.HasPrefix(def.Name.Name, "_") {
+			continue
+		}
+		if !l.usedElsewhere(def.Name) {
+			l.report(def.Name.NamePos, wfxapi.EcodeLintUnusedHelper, LintWarning,
+				"function %q isn't a target (it has no \"fx\" parameter), and nothing uses it", def.Name.Name)
+		}
+	}
+}
+
+// lintUnexecutedPlans checks for action plans that are assigned to a variable that's never used.
+// Action calls are only executed automatically when they're statements on their own;
+// once assigned, it's up to the script to execute the plan (e.g. by using it in a pipe), and if the variable is never used, nothing does.
+func (l *linter) lintUnexecutedPlans(ast *syntax.File) {
+	// Customized constructors (e.g. `quiet_cmd = cmd.customize(...)`) make plans too.
+	customized := map[*resolve.Binding]bool{}
+	for _, stmt := range ast.Stmts {
+		assign, ok := stmt.(*syntax.AssignStmt)
+		if !ok || assign.Op != syntax.EQ {
+			continue
+		}
+		lhs, ok1 := assign.LHS.(*syntax.Ident)
+		call, ok2 := assign.RHS.(*syntax.CallExpr)
+		if !ok1 || !ok2 {
+			continue
+		}
+		if dot, ok := call.Fn.(*syntax.DotExpr); ok && dot.Name.Name == "customize" {
+			if recv, ok := dot.X.(*syntax.Ident); ok && l.makesPlans(recv, customized) {
+				if b, ok := lhs.Binding.(*resolve.Binding); ok {
+					customized[b] = true
+				}
+			}
+		}
+	}
+	syntax.Walk(ast, func(n syntax.Node) bool {
+		assign, ok := n.(*syntax.AssignStmt)
+		if !ok || assign.Op != syntax.EQ {
+			return true
+		}
+		lhs, ok1 := assign.LHS.(*syntax.Ident)
+		call, ok2 := assign.RHS.(*syntax.CallExpr)
+		if !ok1 || !ok2 {
+			return true
+		}
+		fn, ok := call.Fn.(*syntax.Ident)
+		if !ok || !l.makesPlans(fn, customized) || l.usedElsewhere(lhs) {
+			return true
+		}
+		l.report(lhs.NamePos, wfxapi.EcodeLintUnexecutedPlan, LintWarning,
+			"the action from %s(...) is assigned to %q, which is never used, so it never runs; to run it, make the call a statement on its own", fn.Name, lhs.Name)
+		return true
+	})
+}
+
+// makesPlans returns true if calling what the identifier refers to returns an action plan (rather than running anything):
+// if it's a builtin that's an action.PlanMaker, or a customized one.
+func (l *linter) makesPlans(id *syntax.Ident, customized map[*resolve.Binding]bool) bool {
+	b, ok := id.Binding.(*resolve.Binding)
+	if !ok {
+		return false
+	}
+	if b.Scope != resolve.Predeclared {
+		return customized[b]
+	}
+	_, ok = l.builtins[id.Name].(action.PlanMaker)
+	return ok
+}
@@ -0,0 +1,74 @@
+package wfx
+
+import (
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const lintFx = `
+quick = cmd.customize(timeout="1s")
+print("during compile")
+
+def copy(fx):
+	pass
+
+def helper():
+	pass
+
+def used_helper():
+	return cmd("echo hi")
+
+def _private():
+	pass
+
+def build(fx, depends_on=["copy", "nope"], timeout="1m"):
+	x = cmd("echo never")
+	y = quick("echo never")
+	z = cmd("echo used")
+	pipe(z, cmd("cat"))
+	used_helper()
+	timeout(cmd("sleep 1"), "1s")
+	print("during build")
+
+def test(fx, depends_on=["bu" + "ild"]):
+	outputs = warpforge_run("module.wf")
+
+def piped(fx):
+	result = pipe(cmd("echo"), cmd("cat"))
+	later = mkdir("later")
+`
+
+func TestLint(t *testing.T) {
+	var got []string
+	for _, f := range Lint("make.fx", lintFx, nil) {
+		got = append(got, fmt.Sprintf("%d:%d %s %s", f.Line, f.Col, f.Severity, f.Code))
+	}
+	qt.Check(t, got, qt.DeepEquals, []string{
+		"3:1 warning " + wfxapi.EcodeLintToplevelPrint,
+		"5:5 warning " + wfxapi.EcodeLintShadowedBuiltin,
+		"8:5 warning " + wfxapi.EcodeLintUnusedHelper,
+		"17:35 error " + wfxapi.EcodeLintUnknownDependency,
+		"18:2 warning " + wfxapi.EcodeLintUnexecutedPlan,
+		"19:2 warning " + wfxapi.EcodeLintUnexecutedPlan,
+		"23:2 warning " + wfxapi.EcodeLintShadowedBuiltin,
+		"26:26 error " + wfxapi.EcodeLintNonliteralDependsOn,
+		"31:2 warning " + wfxapi.EcodeLintUnexecutedPlan, // Not "result": pipe runs right away.
+	})
+}
+
+func TestLintUnparsable(t *testing.T) {
+	findings := Lint("make.fx", "def build(fx):\n\tcmd(\n", nil)
+	qt.Assert(t, findings, qt.HasLen, 1)
+	qt.Check(t, findings[0].Code, qt.Equals, wfxapi.EcodeScriptParsefail)
+	qt.Check(t, findings[0].Severity, qt.Equals, LintError)
+
+	// Unresolvable names are reported, and the checks that need resolved names are skipped, but the rest still happen.
+	findings = Lint("make.fx", "def build(fx, depends_on=\"nope\"):\n\tundefined_thing()\n\tx = cmd(\"true\")\n", nil)
+	qt.Assert(t, findings, qt.HasLen, 2)
+	qt.Check(t, findings[0].Code, qt.Equals, wfxapi.EcodeLintUnknownDependency)
+	qt.Check(t, findings[1].String(), qt.Equals, "make.fx:2:2: wfx-script-parsefail: undefined: undefined_thing")
+}
@@ -0,0 +1,211 @@
+package wfx
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/syntax"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Targets declare the paths they own with "fx_files".
+Each path can have only one owner: two targets can't claim the same path, or one path within another's (that's an error, when make.fx is parsed).
+
+Owning a path means a target may write it (and everything within it, if it's a directory), and that `wfx clean` removes it.
+Writing anywhere else isn't stopped (for that, see sandboxes, in the action package),
+but it is noticed, as far as is cheap to notice:
+before and after each target runs, the declared paths (and everything within them), and the directories that contain them, are scanned;
+and if anything there changed that the target doesn't own, there's a warning (wfx-unowned-write).
+(Directories count as changed only if they appear, disappear, or stop being directories, since writing within one changes it too.
+Creating the directories that lead to a target's own paths is fine.)
+*/
+
+// ownershipConflict is two targets claiming the same path, or one claiming a path within the other's.
+type ownershipConflict struct {
+	target, other *Target
+	path, within  string // path is target's; within is other's, and the same as path, or contains it.
+}
+
+// findOwnershipConflicts checks that no two targets claim the same path (or a path within another's).
+// Each conflict is reported once, for the later target.
+func findOwnershipConflicts(targets []*Target) []ownershipConflict {
+	var res []ownershipConflict
+	for i, t := range targets {
+	paths:
+		for _, p := range t.files {
+			for _, other := range targets[:i] {
+				for _, q := range other.files {
+					if pathWithin(p, q) || pathWithin(q, p) {
+						res = append(res, ownershipConflict{target: t, other: other, path: p, within: q})
+						continue paths
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// error returns the conflict as a wfx-ownership-conflict error, positioned at the target's fx_files.
+func (c ownershipConflict) error() error {
+	tmpl := "target {{target|q}} claims {{path|q}} (in fx_files), but so does target {{other|q}}"
+	if path.Clean(c.path) != path.Clean(c.within) {
+		tmpl = "target {{target|q}} claims {{path|q}} (in fx_files), which overlaps with {{within|q}}, claimed by target {{other|q}}"
+	}
+	err := serum.Error(wfxapi.EcodeOwnershipConflict,
+		serum.WithMessageTemplate(tmpl),
+		serum.WithDetail("target", c.target.name),
+		serum.WithDetail("path", c.path),
+		serum.WithDetail("other", c.other.name),
+		serum.WithDetail("within", c.within),
+	)
+	if param := c.target.param("fx_files"); param != nil {
+		return withParamPosition(err, param)
+	}
+	return err
+}
+
+// param returns the target's parameter of the given name, or nil.
+func (t *Target) param(name string) syntax.Expr {
+	if t.stmt == nil {
+		return nil
+	}
+	for _, param := range t.stmt.Params {
+		if extractIdent(param).Name == name {
+			return param
+		}
+	}
+	return nil
+}
+
+// pathWithin returns true if p is the same path as dir, or is within it.  Both are slash-separated, and relative to the project.
+func pathWithin(p, dir string) bool {
+	p, dir = path.Clean(p), path.Clean(dir)
+	return p == dir || dir == "." || strings.HasPrefix(p, dir+"/")
+}
+
+// Owner returns the target that owns the given path (with "fx_files"): the one that declared it, or a path it's within.
+// Returns nil if no target owns it.
+func (x *FxFile) Owner(p string) *Target {
+	for _, t := range x.targets {
+		for _, f := range t.files {
+			if pathWithin(p, f) {
+				return t
+			}
+		}
+	}
+	return nil
+}
+
+// fileStamp is what a scan notes about a path, to see if it changed: cheap to get, unlike the content.
+type fileStamp struct {
+	mode  fs.FileMode
+	size  int64
+	mtime time.Time
+}
+
+// ownershipScan is what's in the places where targets own things, at some moment.
+// The keys are slash-separated paths, relative to the project directory.
+type ownershipScan map[string]fileStamp
+
+// scanOwned scans every target's declared paths (and everything within them), and the directories that contain them.
+// Returns nil if no target declares any paths.
+func (x *FxFile) scanOwned(dir string) ownershipScan {
+	res := ownershipScan{}
+	note := func(rel string, info fs.FileInfo) {
+		stamp := fileStamp{mode: info.Mode().Type()}
+		if !info.IsDir() {
+			stamp.size, stamp.mtime = info.Size(), info.ModTime()
+		}
+		res[rel] = stamp
+	}
+	declared := false
+	for _, t := range x.targets {
+		for _, f := range t.files {
+			declared = true
+			f = path.Clean(f)
+			root := filepath.Join(dir, filepath.FromSlash(f))
+			filepath.Walk(root, func(file string, info fs.FileInfo, err error) error {
+				if err != nil {
+					return nil
+				}
+				rel, _ := filepath.Rel(dir, file)
+				if dir == "" {
+					rel = file
+				}
+				note(filepath.ToSlash(rel), info)
+				return nil
+			})
+			parent := path.Dir(f)
+			entries, _ := os.ReadDir(filepath.Join(dir, filepath.FromSlash(parent)))
+			for _, entry := range entries {
+				if info, err := entry.Info(); err == nil {
+					note(path.Join(parent, entry.Name()), info)
+				}
+			}
+		}
+	}
+	if !declared {
+		return nil
+	}
+	return res
+}
+
+// changedPaths returns the paths (sorted) that appeared, disappeared, or changed between two scans.
+func changedPaths(before, after ownershipScan) []string {
+	var res []string
+	for p, stamp := range before {
+		if now, ok := after[p]; !ok || now != stamp {
+			res = append(res, p)
+		}
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			res = append(res, p)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// unownedWrites returns the changes (from changedPaths) that the target didn't own,
+// as wfx-unowned-write warnings (which are errors only in form).
+// Directories that lead to a path the target owns are fine to create.
+func (x *FxFile) unownedWrites(t *Target, changed []string) []error {
+	var res []error
+	for _, p := range changed {
+		owned := false
+		for _, f := range t.files {
+			if pathWithin(p, f) || pathWithin(f, p) {
+				owned = true
+				break
+			}
+		}
+		if owned {
+			continue
+		}
+		if other := x.Owner(p); other != nil {
+			res = append(res, serum.Error(wfxapi.EcodeUnownedWrite,
+				serum.WithMessageTemplate("target {{target|q}} changed {{path|q}}, which belongs to target {{owner|q}}"),
+				serum.WithDetail("target", t.name),
+				serum.WithDetail("path", p),
+				serum.WithDetail("owner", other.name),
+			))
+			continue
+		}
+		res = append(res, serum.Error(wfxapi.EcodeUnownedWrite,
+			serum.WithMessageTemplate("target {{target|q}} changed {{path|q}}, which no target owns"),
+			serum.WithDetail("target", t.name),
+			serum.WithDetail("path", p),
+		))
+	}
+	return res
+}
@@ -0,0 +1,138 @@
+package wfx
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+func TestOwnershipConflicts(t *testing.T) {
+	for _, tc := range []struct {
+		src      string
+		conflict bool
+	}{
+		{`def a(fx, fx_files=["out"]): pass
+def b(fx, fx_files=["out2"]): pass`, false},
+		{`def a(fx, fx_files=["out", "out"]): pass`, false},
+		{`def a(fx, fx_files=["out/x"]): pass
+def b(fx, fx_files=["./out/x"]): pass`, true},
+		{`def a(fx, fx_files=["out/x"]): pass
+def b(fx, fx_files=["out"]): pass`, true},
+	} {
+		_, err := ParseFxFile("make.fx", tc.src)
+		if !tc.conflict {
+			qt.Check(t, err, qt.IsNil, qt.Commentf("%s", tc.src))
+			continue
+		}
+		qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeOwnershipConflict, qt.Commentf("%s", tc.src))
+		qt.Check(t, serum.Detail(err, "target"), qt.Equals, "b")
+		qt.Check(t, serum.Detail(err, "other"), qt.Equals, "a")
+		qt.Check(t, serum.Detail(err, "line"), qt.Equals, "2")
+
+		findings := Lint("make.fx", tc.src, nil)
+		qt.Assert(t, findings, qt.HasLen, 1)
+		qt.Check(t, findings[0].Code, qt.Equals, wfxapi.EcodeOwnershipConflict)
+	}
+}
+
+const cleanFx = `
+def gen(fx, fx_files=["gen"]):
+	pass
+
+def build(fx, fx_files=["bin/app", "missing"]):
+	pass
+
+def escape(fx, fx_files=["../elsewhere"]):
+	pass
+`
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"gen/a", "bin/app", "bin/other"} {
+		qt.Assert(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(f)), 0755), qt.IsNil)
+		qt.Assert(t, os.WriteFile(filepath.Join(dir, f), nil, 0644), qt.IsNil)
+	}
+	proj, err := LoadSource("make.fx", cleanFx, Options{Dir: dir})
+	qt.Assert(t, err, qt.IsNil)
+
+	paths, err := proj.Clean([]string{"gen", "bin/app"}, true)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, paths, qt.DeepEquals, []string{"gen", "bin/app"})
+	_, err = os.Stat(filepath.Join(dir, "gen", "a"))
+	qt.Check(t, err, qt.IsNil)
+
+	paths, err = proj.Clean([]string{"build"}, false)
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, paths, qt.DeepEquals, []string{"bin/app"})
+	_, err = os.Stat(filepath.Join(dir, "bin", "app"))
+	qt.Check(t, os.IsNotExist(err), qt.IsTrue)
+	_, err = os.Stat(filepath.Join(dir, "bin", "other"))
+	qt.Check(t, err, qt.IsNil)
+
+	// Nothing is removed if any path is outside the project.
+	_, err = proj.Clean(nil, false)
+	qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+	qt.Check(t, serum.Detail(err, "target"), qt.Equals, "escape")
+	_, err = os.Stat(filepath.Join(dir, "gen", "a"))
+	qt.Check(t, err, qt.IsNil)
+
+	_, err = proj.Clean([]string{"nope"}, true)
+	qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+}
+
+const unownedFx = `
+def gen(fx, fx_files=["out/gen.txt"]):
+	mkdir("out")
+	cmd("echo gen > out/gen.txt; echo stray > out/stray.txt")
+
+def build(fx, fx_files=["out/app"], depends_on=["gen"]):
+	cmd("echo app > out/app; echo again >> out/gen.txt")
+
+def tidy(fx, depends_on=["gen"]):
+	cmd("rm out/stray.txt")
+`
+
+func TestUnownedWrites(t *testing.T) {
+	var stderr bytes.Buffer
+	events := &eventCollector{}
+	proj, err := LoadSource("make.fx", unownedFx, Options{Dir: t.TempDir(), Stderr: &stderr, Events: events})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, prog.Run(context.Background(), []string{"build"}), qt.IsNil)
+	qt.Check(t, stderr.String(), qt.Equals, ""+
+		"wfx: warning: wfx-unowned-write: target \"gen\" changed \"out/stray.txt\", which no target owns\n"+
+		"wfx: warning: wfx-unowned-write: target \"build\" changed \"out/gen.txt\", which belongs to target \"gen\"\n")
+	var warnings []*wfxapi.EventErrorInfo
+	for _, ev := range events.events {
+		if ev.Type == wfxapi.EventTargetWarn {
+			warnings = append(warnings, ev.Warning)
+		}
+	}
+	qt.Assert(t, warnings, qt.HasLen, 2)
+	qt.Check(t, warnings[1].Details, qt.DeepEquals, map[string]string{"target": "build", "path": "out/gen.txt", "owner": "gen"})
+
+	// Removing things counts too.
+	stderr.Reset()
+	qt.Assert(t, prog.Execute(context.Background(), []string{"tidy"}), qt.IsNil)
+	qt.Check(t, stderr.String(), qt.Equals, "wfx: warning: wfx-unowned-write: target \"tidy\" changed \"out/stray.txt\", which no target owns\n")
+}
+
+type eventCollector struct {
+	mu     sync.Mutex
+	events []wfxapi.Event
+}
+
+func (c *eventCollector) Emit(ev wfxapi.Event) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.events = append(c.events, ev)
+}
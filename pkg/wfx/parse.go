@@ -1,6 +1,8 @@
 package wfx
 
 import (
+	"time"
+
 	"github.com/serum-errors/go-serum"
 	"go.starlark.net/starlark"
 	"go.starlark.net/syntax"
@@ -9,18 +11,33 @@ import (
 )
 
 // FxFile stores a parsed starlark syntax AST plus cached info about targets.
+// An FxFile is never modified after parsing, so it's safe to use concurrently, and to compile any number of times.
 type FxFile struct {
-	ast *syntax.File
+	filename string
+	body     string
+	ast      *syntax.File
 
 	// cached for your convenience, as we validated things.
 	targets       []*Target
 	targetsByName map[string]*Target
+	targetsByFile map[string]*Target
 }
 
 func (x *FxFile) ListTargets() []*Target {
 	return x.targets
 }
 
+// TargetByName returns the target of that name, or nil if there's no such target.
+func (x *FxFile) TargetByName(name string) *Target {
+	return x.targetsByName[name]
+}
+
+// TargetByFile returns the target that declared ownership of the given path (with "fx_files"),
+// or nil if no target claims it.
+func (x *FxFile) TargetByFile(path string) *Target {
+	return x.targetsByFile[path]
+}
+
 // ParseFxFile parses a an "fx file", which is expected to contain starlark code matching certain conventions.
 // The filename argument is advisory; the body argument is data that has already been loaded.
 //
@@ -28,6 +45,8 @@ func (x *FxFile) ListTargets() []*Target {
 // it also looks for the "fx" conventions that denote functions that are "targets",
 // and builds a map of those.
 //
+// Two targets can't claim the same path (or one a path within the other's) with "fx_files": that's a wfx-ownership-conflict error.
+//
 // Note that what is checked by this function is purely syntax parse.
 // It does not check that references in the code resolve, for example -- that comes later.
 func ParseFxFile(filename string, body string) (*FxFile, error) {
@@ -35,22 +54,33 @@ func ParseFxFile(filename string, body string) (*FxFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	res := &FxFile{ast: syntaxObj}
+	res := &FxFile{filename: filename, body: body, ast: syntaxObj}
 	res.targets, err = findTargets(res.ast)
 	if err != nil {
 		return nil, err
 	}
 	res.targetsByName = make(map[string]*Target, len(res.targets))
+	res.targetsByFile = make(map[string]*Target)
 	for _, t := range res.targets {
 		res.targetsByName[t.name] = t
+		for _, f := range t.files {
+			res.targetsByFile[f] = t
+		}
+	}
+	if conflicts := findOwnershipConflicts(res.targets); len(conflicts) > 0 {
+		return nil, conflicts[0].error()
 	}
 	return res, nil
 }
 
 type Target struct {
-	name      string   // mostly the def name, but for file-based targets, may be a generated mangle.
-	parent    *Target  // usually nil, but for file-based targets that have been manifested, points to the def that made them.
-	dependsOn []string // dependencies are by string name.
+	name      string        // mostly the def name, but for file-based targets, may be a generated mangle.
+	parent    *Target       // usually nil, but for file-based targets that have been manifested, points to the def that made them.
+	dependsOn []string      // dependencies are by string name.
+	files     []string      // paths this target declared ownership of, via "fx_files".
+	inputs    []string      // paths this target declared it reads, via "fx_inputs".  Directories include everything within them.
+	params    []string      // names of all the parameters after "fx", in declaration order.
+	timeout   time.Duration // time limit this target declared, via "timeout".  Zero means none.
 
 	stmt     *syntax.DefStmt
 	callable starlark.Callable // nil until FxFile.Eval has prepared us.
@@ -65,12 +95,34 @@ func (t *Target) DependsOn() []string {
 	return t.dependsOn
 }
 
+// Files returns the paths this target declared ownership of (with "fx_files").
+func (t *Target) Files() []string {
+	return t.files
+}
+
+// Inputs returns the paths this target declared that it reads (with "fx_inputs").
+// Paths may be directories, in which case everything within them counts as an input.
+func (t *Target) Inputs() []string {
+	return t.inputs
+}
+
+// Timeout returns the time limit this target declared (with "timeout"), or zero if it declared none.
+func (t *Target) Timeout() time.Duration {
+	return t.timeout
+}
+
+// Params returns the names of the target function's parameters, other than the leading "fx".
+func (t *Target) Params() []string {
+	return t.params
+}
+
 func findTargets(ast *syntax.File) (res []*Target, err error) {
 	// Targets can only be top-level defs.
 	// So, a simple non-recursive range suffices.
 	// Thereafter, they must have a certain known signature --
 	// they must have a first argument that is named exactly "fx".
-	// (This rule may expand in the future -- for example, "fx_files=*" for other target forms.)
+	// (This rule may expand in the future -- for example, "fx_files=*" for other target forms.
+	// For now, "fx_files" is recognized only as an additional parameter on a target that already has "fx".)
 	// Any defs not matching the pattern are simply regular functions.
 	for _, stmt := range ast.Stmts {
 		switch stmt2 := stmt.(type) {
@@ -91,28 +143,27 @@ func findTargets(ast *syntax.File) (res []*Target, err error) {
 			// For most of these, the "default" value will be examined; we can read those literals from here.
 			// Unrecognized arguments are ignored, for future-proofness.
 			for _, param := range stmt2.Params[1:] {
+				tgt.params = append(tgt.params, extractIdent(param).Name)
 				switch extractIdent(param).Name {
 				case "depends_on":
-					expr2, ok := param.(*syntax.BinaryExpr)
-					if !ok {
-						continue
+					tgt.dependsOn, err = stringsParamDefault(param, errDependsOnValueRestriction)
+					if err != nil {
+						return nil, withParamPosition(err, param)
+					}
+				case "fx_files":
+					tgt.files, err = stringsParamDefault(param, errFilesValueRestriction)
+					if err != nil {
+						return nil, withParamPosition(err, param)
 					}
-					switch v := expr2.Y.(type) {
-					case *syntax.ListExpr:
-						for _, item := range v.List {
-							lit, ok := item.(*syntax.Literal)
-							if !ok || lit.Token != syntax.STRING {
-								return nil, errDependsOnValueRestriction()
-							}
-							tgt.dependsOn = append(tgt.dependsOn, lit.Value.(string))
-						}
-					case *syntax.Literal:
-						if v.Token != syntax.STRING {
-							return nil, errDependsOnValueRestriction()
-						}
-						tgt.dependsOn = []string{v.Value.(string)}
-					default:
-						return nil, errDependsOnValueRestriction()
+				case "fx_inputs":
+					tgt.inputs, err = stringsParamDefault(param, errInputsValueRestriction)
+					if err != nil {
+						return nil, withParamPosition(err, param)
+					}
+				case "timeout":
+					tgt.timeout, err = timeoutParamDefault(param)
+					if err != nil {
+						return nil, withParamPosition(err, param)
 					}
 				}
 			}
@@ -122,6 +173,70 @@ func findTargets(ast *syntax.File) (res []*Target, err error) {
 	return
 }
 
+// stringsParamDefault reads the default value of a parameter, which must be either a list of string literals, or a single string literal.
+// If the parameter has no default value, the result is empty.
+// The errFn is used to produce an error if the default value is anything else.
+func stringsParamDefault(param syntax.Expr, errFn func() error) ([]string, error) {
+	expr2, ok := param.(*syntax.BinaryExpr)
+	if !ok {
+		return nil, nil
+	}
+	switch v := expr2.Y.(type) {
+	case *syntax.ListExpr:
+		res := make([]string, 0, len(v.List))
+		for _, item := range v.List {
+			lit, ok := item.(*syntax.Literal)
+			if !ok || lit.Token != syntax.STRING {
+				return nil, errFn()
+			}
+			res = append(res, lit.Value.(string))
+		}
+		return res, nil
+	case *syntax.Literal:
+		if v.Token != syntax.STRING {
+			return nil, errFn()
+		}
+		return []string{v.Value.(string)}, nil
+	default:
+		return nil, errFn()
+	}
+}
+
+// timeoutParamDefault reads the default value of a "timeout" parameter, which must be a string literal that's a positive duration (like "30s").
+// If the parameter has no default value, the result is zero.
+func timeoutParamDefault(param syntax.Expr) (time.Duration, error) {
+	expr2, ok := param.(*syntax.BinaryExpr)
+	if !ok {
+		return 0, nil
+	}
+	lit, ok := expr2.Y.(*syntax.Literal)
+	if !ok || lit.Token != syntax.STRING {
+		return 0, serum.Errorf(wfxapi.EcodeScriptInvalid, "timeout clause in target declaration may only use a string literal, like \"30s\"")
+	}
+	d, err := time.ParseDuration(lit.Value.(string))
+	if err != nil || d <= 0 {
+		return 0, serum.Errorf(wfxapi.EcodeScriptInvalid, "timeout clause in target declaration must be a positive duration, like \"30s\" or \"5m\", not %q", lit.Value.(string))
+	}
+	return d, nil
+}
+
+// withParamPosition says an error is about a parameter's default value (or the parameter itself, if it has none).
+func withParamPosition(err error, param syntax.Expr) error {
+	pos, _ := param.Span()
+	if bin, ok := param.(*syntax.BinaryExpr); ok {
+		pos, _ = bin.Y.Span()
+	}
+	return wfxapi.WithScriptPosition(err, pos, "")
+}
+
 func errDependsOnValueRestriction() error {
 	return serum.Errorf(wfxapi.EcodeScriptInvalid, "depends_on clause in target declaration may only use lists of string literals, or a single string literal")
 }
+
+func errFilesValueRestriction() error {
+	return serum.Errorf(wfxapi.EcodeScriptInvalid, "fx_files clause in target declaration may only use lists of string literals, or a single string literal")
+}
+
+func errInputsValueRestriction() error {
+	return serum.Errorf(wfxapi.EcodeScriptInvalid, "fx_inputs clause in target declaration may only use lists of string literals, or a single string literal")
+}
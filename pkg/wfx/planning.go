@@ -1,21 +1,161 @@
 package wfx
 
 import (
-	"github.com/dominikbraun/graph"
+	"path/filepath"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
 )
 
+// toposort returns the names of the targets ordered so that each target comes before all the targets it depends on.
+//
+// The order is deterministic: ties are broken by declaration order.
+// (Kahn's algorithm, with a queue seeded and fed in declaration order.)
+// Dependencies on names that aren't targets are ignored.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if the dependencies contain a cycle.
 func toposort(targets []*Target) ([]string, error) {
-	g := graph.New(
-		func(t *Target) string { return t.Name() },
-		graph.Directed(),
-		graph.PermitCycles(), // n.b., this does not do what the name suggests.
-	)
+	byName := make(map[string]*Target, len(targets))
+	for _, t := range targets {
+		byName[t.name] = t
+	}
+	dependents := make(map[string]int, len(targets)) // count of targets that depend on each target, and aren't yet placed.
 	for _, t := range targets {
-		g.AddVertex(t)
-		for _, e := range t.dependsOn {
-			g.AddEdge(t.Name(), e)
+		for _, dep := range t.dependsOn {
+			if _, exists := byName[dep]; exists {
+				dependents[dep]++
+			}
+		}
+	}
+	var queue []*Target
+	for _, t := range targets {
+		if dependents[t.name] == 0 {
+			queue = append(queue, t)
+		}
+	}
+	order := make([]string, 0, len(targets))
+	for len(queue) > 0 {
+		t := queue[0]
+		queue = queue[1:]
+		order = append(order, t.name)
+		for _, dep := range t.dependsOn {
+			if _, exists := byName[dep]; !exists {
+				continue
+			}
+			dependents[dep]--
+			if dependents[dep] == 0 {
+				queue = append(queue, byName[dep])
+			}
+		}
+	}
+	if len(order) < len(targets) {
+		var stuck []string
+		for _, t := range targets {
+			if dependents[t.name] > 0 {
+				stuck = append(stuck, t.name)
+			}
+		}
+		return nil, serum.Error(wfxapi.EcodeScriptInvalid,
+			serum.WithMessageTemplate("dependency cycle among targets: {{targets}}"),
+			serum.WithDetail("targets", strings.Join(stuck, ", ")),
+		)
+	}
+	return order, nil
+}
+
+// Plan returns the names of the targets that should be invoked to refresh the named targets,
+// in the order they should be invoked.  This includes all their dependencies, transitively.
+//
+// The names may also be paths that a target declared ownership of (with "fx_files"),
+// in which case the owning target is planned.
+// Names that are neither are ignored.
+func (x *FxFile) Plan(targetNames []string) ([]string, error) {
+	// walk down the topo order.  keep a set of everything that's supported to be touched.
+	todo := map[string]struct{}{}
+	for _, t := range targetNames {
+		if _, exists := x.targetsByName[t]; !exists {
+			if owner, exists := x.targetsByFile[t]; exists {
+				t = owner.name
+			}
+		}
+		todo[t] = struct{}{}
+	}
+	order, err := toposort(x.targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, stepName := range order {
+		if _, exists := todo[stepName]; !exists {
+			continue
+		}
+		for _, depName := range x.targetsByName[stepName].dependsOn {
+			todo[depName] = struct{}{}
+		}
+	}
+	// The topo order has dependencies last; the plan wants them first.
+	var plan []string
+	for i := len(order) - 1; i >= 0; i-- {
+		if _, exists := todo[order[i]]; !exists {
+			continue
+		}
+		plan = append(plan, order[i])
+	}
+	return plan, nil
+}
+
+// Affected filters a plan (as returned by Plan) down to the targets that need to be invoked again
+// after the given paths have changed.
+// A target is affected if one of its declared inputs (from "fx_inputs") changed,
+// or if anything it depends on is affected.
+// The order of the plan is preserved.
+//
+// Changes to paths that any target owns (with "fx_files") are disregarded:
+// those are outputs, and seeing them change is usually just the echo of a previous invocation.
+func (x *FxFile) Affected(plan []string, changed []string) []string {
+	return x.affected(plan, changed, (*Target).Inputs)
+}
+
+// affected is Affected, with the inputs of each target coming from the given function.
+func (x *FxFile) affected(plan []string, changed []string, inputs func(*Target) []string) []string {
+	var relevant []string
+	for _, p := range changed {
+		p = filepath.Clean(p)
+		if _, owned := x.targetsByFile[p]; owned {
+			continue
+		}
+		relevant = append(relevant, p)
+	}
+	affected := map[string]struct{}{}
+	var res []string
+	for _, name := range plan {
+		t := x.targetsByName[name]
+		hit := false
+		for _, dep := range t.dependsOn {
+			if _, exists := affected[dep]; exists {
+				hit = true
+				break
+			}
+		}
+		for _, input := range inputs(t) {
+			if hit {
+				break
+			}
+			input = filepath.Clean(input)
+			for _, p := range relevant {
+				if input == "." || p == input || strings.HasPrefix(p, input+string(filepath.Separator)) {
+					hit = true
+					break
+				}
+			}
+		}
+		if hit {
+			affected[name] = struct{}{}
+			res = append(res, name)
 		}
 	}
-	order, err := graph.TopologicalSort(g)
-	return order, err
+	return res
 }
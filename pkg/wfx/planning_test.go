@@ -0,0 +1,94 @@
+package wfx
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const planningFx = `
+def docs(fx, fx_inputs=["docs"]):
+	pass
+
+def gen(fx, fx_inputs=["schema.json"], fx_files=["gen.go"]):
+	pass
+
+def build(fx, depends_on=["gen"], fx_inputs=["src"], fx_files=["bin/app"]):
+	pass
+
+def package(fx, depends_on=["build", "docs"]):
+	pass
+`
+
+func TestAffected(t *testing.T) {
+	fxFile, err := ParseFxFile("make.fx", planningFx)
+	qt.Assert(t, err, qt.IsNil)
+	plan, err := fxFile.Plan([]string{"package"})
+	qt.Assert(t, err, qt.IsNil)
+
+	for _, tc := range []struct {
+		name    string
+		changed []string
+		expect  []string
+	}{
+		{"input of a leaf", []string{"schema.json"}, []string{"gen", "build", "package"}},
+		{"within an input dir", []string{"src/main.go"}, []string{"build", "package"}},
+		{"unclean path", []string{"./src/../src/main.go"}, []string{"build", "package"}},
+		{"sibling branch", []string{"docs/index.md"}, []string{"docs", "package"}},
+		{"similar prefix isn't within", []string{"srcs/main.go"}, nil},
+		{"unrelated", []string{"README.md"}, nil},
+		{"owned output echo", []string{"gen.go"}, nil},
+		{"owned output echo, with an input", []string{"bin/app", "src/main.go"}, []string{"build", "package"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			qt.Assert(t, fxFile.Affected(plan, tc.changed), qt.DeepEquals, tc.expect)
+		})
+	}
+
+	// Only targets in the plan can be affected.
+	plan, err = fxFile.Plan([]string{"build"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, fxFile.Affected(plan, []string{"schema.json", "docs/index.md"}), qt.DeepEquals, []string{"gen", "build"})
+}
+
+func TestPlanOrder(t *testing.T) {
+	// Dependencies declared after the targets that depend on them still come first,
+	// and ties are broken by declaration order, every time.
+	fxFile, err := ParseFxFile("make.fx", `
+def all(fx, depends_on=["b", "a"]):
+	pass
+
+def b(fx, depends_on=["c"]):
+	pass
+
+def a(fx, depends_on=["c"]):
+	pass
+
+def c(fx):
+	pass
+`)
+	qt.Assert(t, err, qt.IsNil)
+	for i := 0; i < 20; i++ {
+		plan, err := fxFile.Plan([]string{"all"})
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, plan, qt.DeepEquals, []string{"c", "a", "b", "all"})
+	}
+
+	fxFile, err = ParseFxFile("make.fx", `
+def a(fx, depends_on=["b"]):
+	pass
+
+def b(fx, depends_on=["a"]):
+	pass
+
+def c(fx):
+	pass
+`)
+	qt.Assert(t, err, qt.IsNil)
+	_, err = fxFile.Plan([]string{"c"})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+	qt.Assert(t, err, qt.ErrorMatches, ".*dependency cycle among targets: a, b")
+}
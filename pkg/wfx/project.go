@@ -0,0 +1,185 @@
+package wfx
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+/*
+Using wfx from Go happens in phases, and each phase has its own type, so they can't be done out of order:
+
+  - Load (or LoadSource) parses a make.fx file, producing a Project.
+    A Project knows its targets and their declared dependencies, files, and inputs; it can Plan; nothing has been evaluated yet.
+  - Project.Compile evaluates the file's globals, producing a Program.
+  - Program.Run (or Program.Execute, with a plan) invokes targets.
+
+For example:
+
+	proj, err := wfx.Load(wfx.Options{Dir: "/path/to/project", Stdout: &buf, Stderr: &buf})
+	...
+	prog, err := proj.Compile()
+	...
+	err = prog.Run(ctx, []string{"build"})
+
+A Project can be compiled any number of times, and each Program is independent.
+*/
+
+// Options configure how a Project is evaluated.  The zero value is usable.
+type Options struct {
+	// Dir is the project directory: where make.fx is, and what relative paths in it are relative to.
+	// Empty means the process's working directory.
+	Dir string
+
+	// Env is the environment variables that actions (e.g. cmd processes) get, in "KEY=value" form, as for os.Environ.
+	// Nil means they inherit the process's environment.
+	// Either way, this is only the bottom layer: the project's ENV and .env file go on top of it (see EnvPrecedence).
+	Env []string
+
+	// Hermetic, if true, makes actions' environment the same on every machine:
+	// instead of starting from the process's environment (or Env), it starts from HermeticEnv (a fixed PATH, locale, timezone, and SOURCE_DATE_EPOCH),
+	// and only the host variables the project names in HOST_ENV are passed through.  The .env file isn't read.
+	// (See HermeticEnvPrecedence.)
+	Hermetic bool
+
+	// Stdout and Stderr are where the output of actions goes (unless it's wired elsewhere, e.g. by a pipe),
+	// and also where starlark `print` goes.  Nil means io.Discard.
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Verbosity controls how action output is presented.  The zero value discards stdout, and keeps stderr only for the error if an action fails.
+	Verbosity action.Verbosity
+
+	// Events, if set, receives lifecycle events for targets and actions.
+	Events wfxapi.EventSink
+
+	// Builtins are predeclared in the script, in addition to the standard and registered ones (which they may replace).
+	Builtins starlark.StringDict
+}
+
+func (o Options) stdout() io.Writer {
+	if o.Stdout == nil {
+		return io.Discard
+	}
+	return o.Stdout
+}
+
+func (o Options) stderr() io.Writer {
+	if o.Stderr == nil {
+		return io.Discard
+	}
+	return o.Stderr
+}
+
+// Project is a parsed make.fx file, plus the Options for evaluating it.
+type Project struct {
+	fxFile *FxFile
+	opts   Options
+}
+
+// Load reads and parses the make.fx file in opts.Dir.
+//
+// Errors:
+//
+//   - wfx-project-unreadable -- if the make.fx file can't be read.
+//   - wfx-script-parsefail -- if the file isn't valid starlark syntax.
+//   - wfx-script-invalid -- if target declarations don't follow the rules (e.g. non-literal depends_on).
+func Load(opts Options) (*Project, error) {
+	filename := filepath.Join(opts.Dir, "make.fx")
+	bs, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, serum.Error(wfxapi.EcodeProjectUnreadable,
+			serum.WithMessageTemplate("cannot read {{file|q}}: {{reason}}"),
+			serum.WithDetail("file", filename),
+			serum.WithDetail("reason", reason(err)),
+		)
+	}
+	return LoadSource(filename, string(bs), opts)
+}
+
+// LoadSource is like Load, but for a make.fx file that's already been read.
+// The filename is only used in error messages.
+//
+// Errors:
+//
+//   - wfx-script-parsefail -- if the file isn't valid starlark syntax.
+//   - wfx-script-invalid -- if target declarations don't follow the rules (e.g. non-literal depends_on).
+func LoadSource(filename string, body string, opts Options) (*Project, error) {
+	fxFile, err := ParseFxFile(filename, body)
+	if err != nil {
+		if _, ok := err.(serum.ErrorInterface); !ok {
+			err = wfxapi.ErrorScriptParsefail(err, "parse")
+		}
+		return nil, err
+	}
+	return NewProject(fxFile, opts), nil
+}
+
+// reason returns just the underlying error of a *fs.PathError (e.g. "no such file or directory"), if it is one,
+// for when the path is already mentioned elsewhere in the error.
+func reason(err error) string {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err.Error()
+	}
+	return err.Error()
+}
+
+// NewProject makes a Project from an FxFile that's already been parsed.
+func NewProject(fxFile *FxFile, opts Options) *Project {
+	return &Project{fxFile: fxFile, opts: opts}
+}
+
+// FxFile returns the parsed make.fx file.
+func (p *Project) FxFile() *FxFile {
+	return p.fxFile
+}
+
+// Options returns the options the Project was loaded with.
+func (p *Project) Options() Options {
+	return p.opts
+}
+
+// Targets lists the targets, in the order they're declared.
+func (p *Project) Targets() []*Target {
+	return p.fxFile.ListTargets()
+}
+
+// Plan returns the names of targets that invoking the given targets would run, in order: dependencies first.
+// See FxFile.Plan.
+//
+// Errors:
+//
+//   - wfx-script-invalid -- if there's a dependency cycle.
+func (p *Project) Plan(targetNames []string) ([]string, error) {
+	return p.fxFile.Plan(targetNames)
+}
+
+// builtins returns the predeclared values: the standard and registered ones (see Builtins), plus any from the options.
+func (p *Project) builtins() starlark.StringDict {
+	res := Builtins()
+	for k, v := range p.opts.Builtins {
+		res[k] = v
+	}
+	return res
+}
+
+// setThreadEnv sets the thread locals that tell actions where to work, and with what environment variables.
+func (p *Project) setThreadEnv(thread *starlark.Thread) {
+	if p.opts.Dir != "" {
+		thread.SetLocal("dir", p.opts.Dir)
+	}
+	if p.opts.Hermetic {
+		thread.SetLocal("env", HermeticEnv) // Until the project's own settings are known; see Program.compileEnv.
+	} else if p.opts.Env != nil {
+		thread.SetLocal("env", p.opts.Env)
+	}
+}
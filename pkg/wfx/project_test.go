@@ -0,0 +1,126 @@
+package wfx
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const testFx = `
+def build(fx, depends_on=["gen"]):
+	cmd("cat gen.txt; echo $GREETING")
+
+def gen(fx):
+	write_file("gen.txt", "the answer is %d\n" % answer)
+	note("generated")
+`
+
+func TestEmbedding(t *testing.T) {
+	var notes []string
+	var stdout bytes.Buffer
+	dir := t.TempDir()
+	proj, err := LoadSource("make.fx", testFx, Options{
+		Dir:    dir,
+		Env:    []string{"GREETING=hello from the embedder"},
+		Stdout: &stdout,
+		// Verbose, so the output of actions comes through.
+		Verbosity: action.VerbosityVerbose,
+		Builtins: starlark.StringDict{
+			"answer": starlark.MakeInt(42),
+			"note": starlark.NewBuiltin("note", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+				var msg string
+				if err := starlark.UnpackArgs("note", args, kwargs, "msg", &msg); err != nil {
+					return nil, err
+				}
+				notes = append(notes, msg)
+				return starlark.None, nil
+			}),
+		},
+	})
+	qt.Assert(t, err, qt.IsNil)
+
+	var names []string
+	for _, tgt := range proj.Targets() {
+		names = append(names, tgt.Name())
+	}
+	qt.Assert(t, names, qt.DeepEquals, []string{"build", "gen"})
+	plan, err := proj.Plan([]string{"build"})
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, plan, qt.DeepEquals, []string{"gen", "build"})
+
+	// The same project can be compiled and run more than once.
+	for i := 0; i < 2; i++ {
+		stdout.Reset()
+		prog, err := proj.Compile()
+		qt.Assert(t, err, qt.IsNil)
+		qt.Assert(t, prog.Run(context.Background(), []string{"build"}), qt.IsNil)
+		qt.Assert(t, stdout.String(), qt.Equals, ""+
+			"[build] cmd(cat gen.txt; echo $GREETING): the answer is 42\n"+
+			"[build] cmd(cat gen.txt; echo $GREETING): hello from the embedder\n")
+		qt.Assert(t, prog.Record("gen").Outputs(), qt.DeepEquals, []string{"gen.txt"})
+	}
+	qt.Assert(t, notes, qt.DeepEquals, []string{"generated", "generated"})
+	_, err = os.Stat(filepath.Join(dir, "gen.txt"))
+	qt.Assert(t, err, qt.IsNil)
+}
+
+func TestEmbeddingCancel(t *testing.T) {
+	proj, err := LoadSource("make.fx", "def forever(fx):\n\tfor _ in range(1000000000):\n\t\tpass\n", Options{})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = prog.Run(ctx, []string{"forever"})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeInterrupted)
+}
+
+func TestEmbeddingCancelCmd(t *testing.T) {
+	proj, err := LoadSource("make.fx", `
+def first(fx):
+	pass
+
+def slow(fx, depends_on=["first"]):
+	cmd("sleep 60 | cat")
+
+def last(fx, depends_on=["slow"]):
+	pass
+`, Options{})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = prog.Run(ctx, []string{"last"})
+	qt.Assert(t, time.Since(start) < 5*time.Second, qt.IsTrue)
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeInterrupted)
+	qt.Assert(t, serum.Detail(err, "target"), qt.Equals, "slow")
+	qt.Assert(t, serum.Detail(err, "completed"), qt.Equals, "first")
+	qt.Assert(t, serum.Detail(err, "notrun"), qt.Equals, "last")
+}
+
+func TestEmbeddingErrors(t *testing.T) {
+	_, err := Load(Options{Dir: t.TempDir()})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeProjectUnreadable)
+
+	_, err = LoadSource("make.fx", "def (", Options{})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptParsefail)
+
+	proj, err := LoadSource("make.fx", "def a(fx):\n\tpass\n", Options{})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	err = prog.Execute(context.Background(), []string{"nope"})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+}
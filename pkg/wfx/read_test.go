@@ -0,0 +1,72 @@
+package wfx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+const readingFx = `
+def gen(fx, fx_inputs=["declared.txt"], fx_files=["out.txt"]):
+	names = glob(["src/**/*.txt"])
+	if exists("extra.json"):
+		names.append(read_json("extra.json")["name"])
+	write_file("out.txt", read_file("VERSION") + " ".join(names))
+`
+
+func TestReadsAreInputs(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.MkdirAll(filepath.Join(dir, "src/sub"), 0755), qt.IsNil)
+	for name, body := range map[string]string{
+		"VERSION":         "1.0\n",
+		"src/a.txt":       "",
+		"src/sub/b.txt":   "",
+		"src/sub/c.other": "",
+	} {
+		qt.Assert(t, os.WriteFile(filepath.Join(dir, name), []byte(body), 0644), qt.IsNil)
+	}
+	proj, err := LoadSource("make.fx", readingFx, Options{Dir: dir})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Assert(t, prog.Execute(context.Background(), []string{"gen"}), qt.IsNil)
+
+	out, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, string(out), qt.Equals, "1.0\nsrc/a.txt src/sub/b.txt")
+
+	qt.Check(t, prog.Record("gen").Inputs(), qt.DeepEquals, []string{"VERSION", "extra.json", "src"})
+	qt.Check(t, prog.Inputs("gen"), qt.DeepEquals, []string{"declared.txt", "VERSION", "extra.json", "src"})
+
+	// Changes to anything it read (or looked for) affect it; so do new files where it globbed.
+	for _, changed := range []string{"VERSION", "extra.json", "src/new/d.txt", "declared.txt"} {
+		qt.Check(t, prog.Affected([]string{"gen"}, []string{changed}), qt.DeepEquals, []string{"gen"}, qt.Commentf("%s", changed))
+	}
+	qt.Check(t, prog.Affected([]string{"gen"}, []string{"unrelated.txt"}), qt.HasLen, 0)
+	// The declared-only view doesn't know about what it read.
+	qt.Check(t, proj.FxFile().Affected([]string{"gen"}, []string{"VERSION"}), qt.HasLen, 0)
+}
+
+func TestGlobalInputs(t *testing.T) {
+	dir := t.TempDir()
+	qt.Assert(t, os.WriteFile(filepath.Join(dir, "VERSION"), []byte("1.0\n"), 0644), qt.IsNil)
+	proj, err := LoadSource("make.fx", `
+VERSION = read_file("VERSION").strip()
+HAS_EXTRA = exists("extra.json")
+
+def gen(fx):
+	read_file("VERSION")
+`, Options{Dir: dir})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	qt.Check(t, prog.GlobalInputs(), qt.DeepEquals, []string{"VERSION", "extra.json"})
+
+	// What targets read is theirs, not the script's.
+	qt.Assert(t, prog.Execute(context.Background(), []string{"gen"}), qt.IsNil)
+	qt.Check(t, prog.GlobalInputs(), qt.DeepEquals, []string{"VERSION", "extra.json"})
+	qt.Check(t, prog.Record("gen").Inputs(), qt.DeepEquals, []string{"VERSION"})
+}
@@ -0,0 +1,74 @@
+package wfx
+
+import (
+	"fmt"
+	"sync"
+
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+/*
+Custom actions and controllers -- or any other values -- can be made available to every make.fx file by registering them.
+The usual way to do this is from an init function, in a package that's imported by a custom build of the wfx binary:
+
+	package dockerfx
+
+	func init() {
+		wfx.Register("docker_build", action.NewPlanConstructor("docker_build", dockerBuild))
+	}
+
+and then a main package that's the same as wfx's own (see cmd/wfx), plus `import _ ".../dockerfx"`.
+
+(To add values for just one Project, rather than everywhere, use Options.Builtins instead.)
+See the action package for helpers for writing actions.
+*/
+
+var registry = struct {
+	sync.Mutex
+	values starlark.StringDict
+}{values: starlark.StringDict{}}
+
+// Register makes value predeclared, as name, in every make.fx file evaluated after this.
+//
+// It panics if name isn't a valid identifier, or is already taken (either by a standard builtin, or by another registration),
+// since either is a mistake in the program doing the registering, and should be noticed immediately.
+func Register(name string, value starlark.Value) {
+	if !isIdent(name) {
+		panic(fmt.Sprintf("wfx: Register called with %q, which is not a valid identifier", name))
+	}
+	registry.Lock()
+	defer registry.Unlock()
+	if _, exists := predef[name]; exists {
+		panic(fmt.Sprintf("wfx: Register called with %q, which is already a standard builtin", name))
+	}
+	if _, exists := registry.values[name]; exists {
+		panic(fmt.Sprintf("wfx: Register called twice for %q", name))
+	}
+	registry.values[name] = value
+}
+
+// Builtins returns everything that's predeclared in make.fx files: the standard builtins, and everything that's been registered.
+// (It doesn't include the Builtins of any particular Project's Options.)
+// The result is a fresh copy, which the caller may modify.
+func Builtins() starlark.StringDict {
+	registry.Lock()
+	defer registry.Unlock()
+	res := make(starlark.StringDict, len(predef)+len(registry.values))
+	for k, v := range predef {
+		res[k] = v
+	}
+	for k, v := range registry.values {
+		res[k] = v
+	}
+	return res
+}
+
+func isIdent(name string) bool {
+	expr, err := syntax.ParseExpr("", name, 0)
+	if err != nil {
+		return false
+	}
+	_, ok := expr.(*syntax.Ident)
+	return ok
+}
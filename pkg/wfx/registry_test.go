@@ -0,0 +1,92 @@
+package wfx
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/starlark"
+
+	"github.com/warptools/wfx/pkg/action"
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+func init() {
+	// An action: copies stdin to stdout, in upper case.
+	Register("test_shout", action.NewPlanConstructor("test_shout", func(thread *starlark.Thread, args starlark.Tuple, kwargs []starlark.Tuple) (*action.ActionPlan, error) {
+		var suffix string
+		if err := action.UnpackArgs("test_shout", args, kwargs, "suffix?", &suffix); err != nil {
+			return nil, err
+		}
+		ap := &action.ActionPlan{Details: suffix}
+		ap.Run = func(ctx context.Context) error {
+			streams := ap.Streams(thread)
+			defer streams.Close()
+			bs, err := io.ReadAll(streams.Stdin)
+			if err != nil {
+				return action.Error("test-shout-failed", "shout", err)
+			}
+			_, err = io.WriteString(streams.Stdout, strings.ToUpper(string(bs))+suffix)
+			return err
+		}
+		return ap, nil
+	}))
+	// A controller: runs each of its actions the given number of times.
+	Register("test_repeat", action.NewControllerConstructor("test_repeat", func(thread *starlark.Thread, inner []*action.ActionPlan, kwargs []starlark.Tuple) (*action.ActionPlan, error) {
+		var times int
+		if err := action.UnpackArgs("test_repeat", nil, kwargs, "times", &times); err != nil {
+			return nil, err
+		}
+		ap := &action.ActionPlan{}
+		ap.Run = func(ctx context.Context) error {
+			for i := 0; i < times; i++ {
+				for _, act := range inner {
+					act.Stdout, act.Stderr = ap.Stdout, ap.Stderr
+					if err := act.Execute(ctx, thread); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		return ap, nil
+	}))
+}
+
+func TestRegistered(t *testing.T) {
+	var stdout bytes.Buffer
+	proj, err := LoadSource("make.fx", `
+def loud(fx):
+	pipe(cmd("echo hello"), test_shout(suffix="!\n"))
+
+def again(fx):
+	test_repeat(cmd("echo again"), times=3)
+
+def wrong(fx):
+	test_shout(42)
+`, Options{Dir: t.TempDir(), Stdout: &stdout, Verbosity: action.VerbosityVerbose})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+
+	qt.Assert(t, prog.Run(context.Background(), []string{"loud"}), qt.IsNil)
+	qt.Assert(t, stdout.String(), qt.Equals, "[loud] test_shout(!...): HELLO\n[loud] test_shout(!...): !\n")
+
+	stdout.Reset()
+	qt.Assert(t, prog.Run(context.Background(), []string{"again"}), qt.IsNil)
+	qt.Assert(t, stdout.String(), qt.Equals, strings.Repeat("[again] cmd(echo again): again\n", 3))
+
+	err = prog.Run(context.Background(), []string{"wrong"})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+}
+
+func TestRegisterConflicts(t *testing.T) {
+	qt.Assert(t, func() { Register("cmd", starlark.None) }, qt.PanicMatches, `.*already a standard builtin`)
+	qt.Assert(t, func() { Register("test_shout", starlark.None) }, qt.PanicMatches, `.*called twice.*`)
+	qt.Assert(t, func() { Register("not-an-ident", starlark.None) }, qt.PanicMatches, `.*not a valid identifier`)
+	qt.Assert(t, Builtins()["test_repeat"], qt.IsNotNil)
+}
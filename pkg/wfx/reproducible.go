@@ -0,0 +1,165 @@
+package wfx
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// VerifyReproducible runs the named targets (and their dependencies) as Run does,
+// and then runs just the named targets again -- after removing their declared outputs (their "fx_files"), so they can't just be left as they are --
+// and checks that the outputs came out exactly the same both times.
+// (Outputs that are directories are compared by everything within them.)
+//
+// This is most useful in hermetic mode (see Options.Hermetic), which removes the most common reasons for outputs to differ.
+//
+// Errors:
+//
+//   - wfx-not-reproducible -- if any of a target's outputs differ (the first such target is reported).
+//   - wfx-script-invalid -- if a name isn't a target (or a path a target owns), or a target declares no outputs, so there's nothing to compare,
+//     or declares one that isn't within the project directory (which won't be removed, to be safe).  These are checked before anything runs.
+//   - wfx-action-error-remove -- if an output can't be removed before the second run.
+//   - anything Run returns.
+func (prog *Program) VerifyReproducible(ctx context.Context, targetNames []string) error {
+	fxFile := prog.project.fxFile
+	var targets []*Target
+	for _, name := range targetNames {
+		t := fxFile.TargetByName(name)
+		if t == nil {
+			t = fxFile.TargetByFile(name)
+		}
+		if t == nil {
+			return serum.Error(wfxapi.EcodeScriptInvalid,
+				serum.WithMessageTemplate("there is no target named {{target|q}}"),
+				serum.WithDetail("target", name),
+			)
+		}
+		for _, f := range t.Files() {
+			if err := checkRemovable(t, f, "removed to run it again"); err != nil {
+				return err
+			}
+		}
+		if len(t.Files()) == 0 {
+			return serum.Error(wfxapi.EcodeScriptInvalid,
+				serum.WithMessageTemplate("target {{target|q}} declares no outputs (with \"fx_files\"), so there's nothing to verify"),
+				serum.WithDetail("target", t.Name()),
+			)
+		}
+		targets = append(targets, t)
+	}
+
+	if err := prog.Run(ctx, targetNames); err != nil {
+		return err
+	}
+	dir := prog.project.opts.Dir
+	first := make([]map[string]string, len(targets))
+	for i, t := range targets {
+		first[i] = snapshot(dir, t.Files())
+	}
+	for _, t := range targets {
+		for _, path := range t.Files() {
+			if err := os.RemoveAll(filepath.Join(dir, path)); err != nil {
+				return serum.Error(wfxapi.EcodeActionRemove,
+					serum.WithMessageTemplate("removing output {{path|q}} of target {{target|q}}, to run it again, failed: {{reason}}"),
+					serum.WithDetail("path", path),
+					serum.WithDetail("target", t.Name()),
+					serum.WithDetail("reason", reason(err)),
+				)
+			}
+		}
+	}
+	var again []string
+	for _, t := range targets {
+		again = append(again, t.Name())
+	}
+	if err := prog.Execute(ctx, again); err != nil {
+		return err
+	}
+	for i, t := range targets {
+		if differ := compareSnapshots(first[i], snapshot(dir, t.Files())); len(differ) > 0 {
+			return serum.Error(wfxapi.EcodeNotReproducible,
+				serum.WithMessageTemplate("target {{target|q}} is not reproducible: these outputs differed the second time: {{paths}}"),
+				serum.WithDetail("target", t.Name()),
+				serum.WithDetail("paths", strings.Join(differ, ",")),
+			)
+		}
+	}
+	return nil
+}
+
+// snapshot describes what's at the given paths (relative to dir), and everything within any that are directories:
+// the result maps each path (relative to dir, slash-separated) to a digest of what's there.
+// Files are digested by their content (sha256), symlinks by where they point, and directories just as being directories.
+// Paths that don't exist are absent; anything that can't be read is digested as the reason why, which is unlikely to match.
+func snapshot(dir string, paths []string) map[string]string {
+	res := map[string]string{}
+	for _, path := range paths {
+		root := filepath.Join(dir, path)
+		filepath.WalkDir(root, func(file string, d fs.DirEntry, err error) error {
+			rel, _ := filepath.Rel(dir, file)
+			rel = filepath.ToSlash(rel)
+			if dir == "" {
+				rel = filepath.ToSlash(file)
+			}
+			switch {
+			case err != nil && os.IsNotExist(err) && file == root:
+				// Not there at all.
+			case err != nil:
+				res[rel] = "unreadable: " + err.Error()
+			case d.IsDir():
+				res[rel] = "dir"
+			case d.Type()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(file)
+				if err != nil {
+					res[rel] = "unreadable: " + err.Error()
+				} else {
+					res[rel] = "symlink: " + target
+				}
+			default:
+				res[rel] = digestFile(file)
+			}
+			return nil
+		})
+	}
+	return res
+}
+
+func digestFile(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return "unreadable: " + err.Error()
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "unreadable: " + err.Error()
+	}
+	return "sha256: " + hex.EncodeToString(h.Sum(nil))
+}
+
+// compareSnapshots returns the paths (sorted) that are in only one of the snapshots, or differ between them.
+func compareSnapshots(a, b map[string]string) []string {
+	var res []string
+	for path, digest := range a {
+		if b[path] != digest {
+			res = append(res, path)
+		}
+	}
+	for path := range b {
+		if _, ok := a[path]; !ok {
+			res = append(res, path)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
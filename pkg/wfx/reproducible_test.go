@@ -0,0 +1,81 @@
+package wfx
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const reproducibleFx = `
+def stable(fx, fx_files=["out"]):
+	mkdir("out/sub")
+	cmd("echo same > out/sub/file; ln -sf sub/file out/link")
+
+def counter(fx, fx_files=["count"]):
+	cmd("echo x >> tally; wc -l < tally > count")
+
+def stale(fx, fx_files=["gone"]):
+	cmd("test -e marker || touch gone; touch marker")
+
+def nothing(fx):
+	pass
+`
+
+func TestVerifyReproducible(t *testing.T) {
+	proj, err := LoadSource("make.fx", reproducibleFx, Options{Dir: t.TempDir()})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+
+	qt.Check(t, prog.VerifyReproducible(context.Background(), []string{"stable"}), qt.IsNil)
+
+	err = prog.VerifyReproducible(context.Background(), []string{"counter"})
+	qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeNotReproducible)
+	qt.Check(t, serum.Detail(err, "target"), qt.Equals, "counter")
+	qt.Check(t, serum.Detail(err, "paths"), qt.Equals, "count")
+
+	// Outputs that are missing the second time count as differing too.
+	err = prog.VerifyReproducible(context.Background(), []string{"gone"})
+	qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeNotReproducible)
+	qt.Check(t, serum.Detail(err, "target"), qt.Equals, "stale")
+
+	err = prog.VerifyReproducible(context.Background(), []string{"nothing"})
+	qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+}
+
+func TestVerifyReproducibleOutsideProject(t *testing.T) {
+	for _, owned := range []string{".", "../sibling.txt"} {
+		t.Run(owned, func(t *testing.T) {
+			parent := t.TempDir()
+			dir := filepath.Join(parent, "proj")
+			qt.Assert(t, os.Mkdir(dir, 0755), qt.IsNil)
+			qt.Assert(t, os.WriteFile(filepath.Join(parent, "sibling.txt"), []byte("keep me"), 0644), qt.IsNil)
+			qt.Assert(t, os.WriteFile(filepath.Join(dir, "precious.txt"), []byte("keep me"), 0644), qt.IsNil)
+			proj, err := LoadSource("make.fx", `
+def out(fx, fx_files=["`+owned+`"]):
+	write_file("ran", "")
+`, Options{Dir: dir})
+			qt.Assert(t, err, qt.IsNil)
+			prog, err := proj.Compile()
+			qt.Assert(t, err, qt.IsNil)
+
+			err = prog.VerifyReproducible(context.Background(), []string{"out"})
+			qt.Check(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+			qt.Check(t, serum.Detail(err, "path"), qt.Equals, owned)
+			// Nothing ran, and nothing was removed.
+			_, err = os.Stat(filepath.Join(dir, "ran"))
+			qt.Check(t, os.IsNotExist(err), qt.IsTrue)
+			for _, file := range []string{filepath.Join(parent, "sibling.txt"), filepath.Join(dir, "precious.txt")} {
+				body, err := os.ReadFile(file)
+				qt.Check(t, err, qt.IsNil)
+				qt.Check(t, string(body), qt.Equals, "keep me")
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package wfx
+
+import (
+	"context"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+// position returns the details of an error that say where it came from.
+func position(err error) [4]string {
+	return [4]string{serum.Detail(err, "file"), serum.Detail(err, "line"), serum.Detail(err, "col"), serum.Detail(err, "stack")}
+}
+
+func TestErrorPositions(t *testing.T) {
+	t.Run("syntax", func(t *testing.T) {
+		_, err := LoadSource("make.fx", "def a(fx):\n\tcmd(\"true\"\n", Options{})
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptParsefail)
+		qt.Assert(t, serum.Message(err), qt.Equals, "got outdent, want ','")
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "3", "1", ""})
+	})
+	t.Run("resolve", func(t *testing.T) {
+		proj, err := LoadSource("make.fx", "def a(fx):\n\tnope()\n\tnope_either()\n", Options{})
+		qt.Assert(t, err, qt.IsNil)
+		_, err = proj.Compile()
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptParsefail)
+		qt.Assert(t, serum.Message(err), qt.Equals, "undefined: nope (and 1 more error)")
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "2", "2", ""})
+	})
+	t.Run("declaration", func(t *testing.T) {
+		_, err := LoadSource("make.fx", "def a(fx, depends_on=[b]):\n\tpass\n", Options{})
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "1", "22", ""})
+	})
+	t.Run("init", func(t *testing.T) {
+		proj, err := LoadSource("make.fx", "X = 1\nY = X // 0\n", Options{})
+		qt.Assert(t, err, qt.IsNil)
+		_, err = proj.Compile()
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeEvalError)
+		qt.Assert(t, serum.Message(err), qt.Equals, "floored division by zero")
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "2", "7", "make.fx:2:7: in <toplevel>"})
+	})
+	t.Run("fail", func(t *testing.T) {
+		proj, err := LoadSource("make.fx", "def check(n):\n\tif n > 1:\n\t\tfail(\"too big\")\n\ndef a(fx):\n\tcheck(2)\n", Options{})
+		qt.Assert(t, err, qt.IsNil)
+		prog, err := proj.Compile()
+		qt.Assert(t, err, qt.IsNil)
+		err = prog.Run(context.Background(), []string{"a"})
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeEvalError)
+		qt.Assert(t, serum.Message(err), qt.Equals, "fail: too big")
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "3", "7", "make.fx:6:7: in a\nmake.fx:3:7: in check"})
+	})
+	t.Run("action", func(t *testing.T) {
+		proj, err := LoadSource("make.fx", "def a(fx):\n\tpass\n\tremove(\"not-there\")\n", Options{Dir: t.TempDir()})
+		qt.Assert(t, err, qt.IsNil)
+		prog, err := proj.Compile()
+		qt.Assert(t, err, qt.IsNil)
+		err = prog.Run(context.Background(), []string{"a"})
+		qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeActionRemove)
+		qt.Assert(t, serum.Detail(err, "path"), qt.Equals, "not-there")
+		qt.Assert(t, position(err), qt.Equals, [4]string{"make.fx", "3", "8", "make.fx:3:8: in a"})
+	})
+}
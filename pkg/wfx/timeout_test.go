@@ -0,0 +1,86 @@
+package wfx
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/serum-errors/go-serum"
+
+	"github.com/warptools/wfx/pkg/wfxapi"
+)
+
+const timeoutFx = `
+def by_target(fx, timeout="100ms"):
+	cmd("sleep 60")
+
+def by_kwarg(fx):
+	cmd("sleep 60", timeout="100ms")
+
+quick_cmd = cmd.customize(timeout="100ms")
+
+def by_customize(fx):
+	quick_cmd("sleep 60")
+
+def by_controller(fx):
+	timeout(cmd("sleep 60 | cat"), "100ms")
+
+def spin():
+	for _ in range(1000000000):
+		pass
+
+def by_controller_of_starlark(fx):
+	timeout(action(spin), "100ms")
+
+def in_time(fx, timeout="1m"):
+	cmd("true", timeout="1m")
+`
+
+func TestTimeouts(t *testing.T) {
+	proj, err := LoadSource("make.fx", timeoutFx, Options{})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+
+	for _, tc := range []struct {
+		target string
+		detail string
+		expect string
+	}{
+		{"by_target", "cmd", "sleep 60"},
+		{"by_kwarg", "cmd", "sleep 60"},
+		{"by_customize", "cmd", "sleep 60"},
+		{"by_controller", "cmd", "sleep 60 | cat"},
+		{"by_controller_of_starlark", "action", "ActionPlanAction{spin}"},
+	} {
+		t.Run(tc.target, func(t *testing.T) {
+			start := time.Now()
+			err := prog.Run(context.Background(), []string{tc.target})
+			qt.Assert(t, time.Since(start) < 10*time.Second, qt.IsTrue)
+			var serr serum.ErrorInterface
+			qt.Assert(t, errors.As(err, &serr), qt.IsTrue)
+			qt.Assert(t, serum.Code(serr), qt.Equals, wfxapi.EcodeTimeout)
+			qt.Assert(t, serum.Detail(serr, tc.detail), qt.Equals, tc.expect)
+			elapsed, err := time.ParseDuration(serum.Detail(serr, "elapsed"))
+			qt.Assert(t, err, qt.IsNil)
+			qt.Assert(t, elapsed >= 100*time.Millisecond, qt.IsTrue)
+		})
+	}
+
+	qt.Assert(t, prog.Run(context.Background(), []string{"in_time"}), qt.IsNil)
+	qt.Assert(t, proj.FxFile().TargetByName("in_time").Timeout(), qt.Equals, time.Minute)
+}
+
+func TestTimeoutInvalid(t *testing.T) {
+	_, err := LoadSource("make.fx", "def a(fx, timeout=\"soon\"):\n\tpass\n", Options{})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+
+	proj, err := LoadSource("make.fx", "def a(fx):\n\tcmd(\"true\", timeout=\"-1s\")\n", Options{})
+	qt.Assert(t, err, qt.IsNil)
+	prog, err := proj.Compile()
+	qt.Assert(t, err, qt.IsNil)
+	err = prog.Run(context.Background(), []string{"a"})
+	qt.Assert(t, serum.Code(err), qt.Equals, wfxapi.EcodeScriptInvalid)
+}
@@ -1,29 +1,60 @@
 package wfxapi
 
-import (
-	"github.com/serum-errors/go-serum"
-)
-
 const (
 	// Errors that are wfx going wrong somehow:
-	// (none yet)
+	EcodeWatchUnsupported = "wfx-watch-unsupported" // For when watch mode is requested on a platform where we can't watch files.
+	EcodeWatchFailed      = "wfx-watch-failed"      // For when the platform's file watching mechanism fails on us.
+
+	// Errors that are about the circumstances wfx was run in:
+	EcodeProjectUnreadable = "wfx-project-unreadable" // For when the make.fx file can't be read.
+	EcodeInterrupted       = "wfx-interrupted"        // For when execution is stopped early, because its context was cancelled.
+	EcodeDotEnvInvalid     = "wfx-dotenv-invalid"     // For when the project's .env file has a line that can't be parsed.  Details say where ("file" and "line").
 
 	// Errors that are the script author's problem:
+	// (These, and any other errors that come from script code, say where in the script they came from; see WithScriptPosition.)
 	EcodeScriptParsefail = "wfx-script-parsefail" // For syntax errors that starlark itself will reject -- before we even get to wfx-specific features.
 	EcodeScriptInvalid   = "wfx-script-invalid"   // Generally, for things being used wrong.  Whereas parse errors are "wfx-script-unparsable".  Appear at runtime, but in scenarios where we feel the error is almost certainly static errors of usage.
+	EcodeEvalError       = "wfx-eval-error"       // For when starlark code fails while running: a call to `fail`, or a runtime error like dividing by zero.
+
+	EcodeOwnershipConflict = "wfx-ownership-conflict" // For when two targets claim the same path in their "fx_files" (or one claims a path within another's).  Details say which ("target", "other", and "path").
 
 	// Errors that appear at runtime:
 	EcodeActionCmdExit = "wfx-action-error-cmdexit" // For when subprocesses exit nonzero.
-)
+	EcodeTimeout       = "wfx-timeout"              // For when an action or target runs longer than its time limit.  Details say how long it ran ("elapsed"), and what was running (e.g. "cmd").
+	EcodeActionMkdir   = "wfx-action-error-mkdir"   // For when the mkdir action fails.
+	EcodeActionCopy    = "wfx-action-error-copy"    // For when the copy action fails.
+	EcodeActionMove    = "wfx-action-error-move"    // For when the move action fails.
+	EcodeActionRemove  = "wfx-action-error-remove"  // For when the remove action fails.
+	EcodeActionSymlink = "wfx-action-error-symlink" // For when the symlink action fails.
+
+	EcodeActionWriteFile = "wfx-action-error-writefile" // For when the write_file action fails.
+	EcodeActionTemplate  = "wfx-action-error-template"  // For when the template action fails (including errors in the template itself).
+
+	EcodeActionFetch             = "wfx-action-error-fetch"              // For when the fetch action can't get the content from anywhere (or can't put it in place).
+	EcodeActionFetchHashMismatch = "wfx-action-error-fetch-hashmismatch" // For when the fetch action got content, but not the content with the hash that was asked for.
+	EcodeActionUnpack            = "wfx-action-error-unpack"             // For when the unpack action can't read the archive or write the destination.
+	EcodeActionUnpackUnsafe      = "wfx-action-error-unpack-unsafe"      // For when the unpack action refuses an archive because an entry would land outside of the destination (or is otherwise unsafe).
 
-// ErrorFxfileParse is an error constructor.
-//
-// Errors:
-//
-//   - wfx-script-parsefail -- always this.
-func ErrorScriptParsefail(cause error, phase string) error {
-	return serum.Error(EcodeScriptParsefail,
-		serum.WithCause(cause),
-		serum.WithDetail("phase", phase),
-	)
-}
+	EcodeActionWarpforge = "wfx-action-error-warpforge" // For when the warpforge binary can't be run, fails, or says something we can't understand.
+
+	EcodeActionStarlark = "wfx-action-error-starlark" // For when the starlark function of an action made with `action(fn)` fails.
+
+	EcodeActionRead = "wfx-action-error-read" // For when read_file, read_json, or hashing.sha256_file can't read a file (or read_json can't parse it), or glob can't list a directory.
+
+	EcodeSandboxViolation   = "wfx-sandbox-violation"   // For when a sandboxed process fails, and what it said suggests that's because it tried to do something its sandbox doesn't allow (like write somewhere undeclared).  Details say what ("problem").
+	EcodeSandboxUnavailable = "wfx-sandbox-unavailable" // For when a sandbox can't be set up (e.g. not on Linux, or the kernel doesn't allow unprivileged user namespaces).
+
+	EcodeNotReproducible = "wfx-not-reproducible" // For when verifying reproducibility finds that a target's outputs came out differently the second time.  Details say which target ("target"), and which of its outputs differed ("paths", comma-separated).
+
+	// Codes for warnings, which don't stop anything.  They're in the same style as errors, and appear as such in events (see EventTargetWarn).
+	EcodeUnownedWrite = "wfx-unowned-write" // For when a target changed a path that it didn't declare it owns (in "fx_files").  Details say which target ("target"), the path ("path"), and which target does own it, if any ("owner").
+
+	// Codes for findings of `wfx lint`.  These aren't errors that anything returns; they're in the same style so they can be looked up the same way.
+	// (Lint also reports wfx-script-parsefail, for anything starlark itself rejects.)
+	EcodeLintShadowedBuiltin     = "wfx-lint-shadowed-builtin"      // For a target named after a builtin, or a call to a parameter that hides a builtin of the same name.
+	EcodeLintUnknownDependency   = "wfx-lint-unknown-dependency"    // For a depends_on entry that isn't the name of a target.
+	EcodeLintNonliteralDependsOn = "wfx-lint-nonliteral-depends-on" // For a depends_on that isn't a string literal, or a list of them.
+	EcodeLintUnusedHelper        = "wfx-lint-unused-helper"         // For a function that isn't a target, and isn't used.
+	EcodeLintUnexecutedPlan      = "wfx-lint-unexecuted-plan"       // For an action plan that's assigned to a variable, but never executed.
+	EcodeLintToplevelPrint       = "wfx-lint-toplevel-print"        // For a print at the top level of make.fx, which only happens during exploratory evaluation.
+)
@@ -0,0 +1,127 @@
+package wfxapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/serum-errors/go-serum"
+)
+
+// Event types, as they appear in the "type" field of an Event.
+const (
+	EventTargetStart  = "target.start"
+	EventTargetFinish = "target.finish"
+	EventTargetSkip   = "target.skip"
+	EventTargetWarn   = "target.warning" // For something a target did that wasn't an error, but probably wasn't right; the "warning" says what.
+	EventActionStart  = "action.start"
+	EventActionFinish = "action.finish"
+	EventError        = "error" // For errors that happen outside of any target, such as while loading the script.
+)
+
+// Event is one entry in wfx's machine-readable stream of lifecycle events.
+// Fields that don't apply to an event type are omitted.
+type Event struct {
+	Type     string          `json:"type"`
+	Time     time.Time       `json:"time"`
+	Target   string          `json:"target,omitempty"`
+	Action   string          `json:"action,omitempty"`   // The name of the action (e.g. "Cmd"), for action events.
+	Label    string          `json:"label,omitempty"`    // The user's label for the action, if they gave one.
+	Cmd      string          `json:"cmd,omitempty"`      // The command, for actions that run one.
+	ExitCode *int            `json:"exitcode,omitempty"` // For action.finish on actions that run a process, if it exited with a code.
+	Duration *float64        `json:"duration_ms,omitempty"`
+	UserTime *float64        `json:"user_ms,omitempty"` // CPU time in user mode, for action.finish on actions that ran a process.
+	SysTime  *float64        `json:"sys_ms,omitempty"`  // CPU time in kernel mode, for action.finish on actions that ran a process.
+	Reason   string          `json:"reason,omitempty"`  // For target.skip.
+	Error    *EventErrorInfo `json:"error,omitempty"`
+	Warning  *EventErrorInfo `json:"warning,omitempty"` // For target.warning.
+}
+
+// EventErrorInfo is the rendering of a serum error in an Event.
+type EventErrorInfo struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message,omitempty"`
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// NewEventErrorInfo renders an error for inclusion in an Event.
+// If the error isn't itself serum-styled, the first serum-styled error in its chain of causes is used
+// (errors from starlark often wrap ours); if there's none at all, a code is guessed (see serum.Code).
+// Returns nil for a nil error.
+func NewEventErrorInfo(err error) *EventErrorInfo {
+	if err == nil {
+		return nil
+	}
+	var se serum.ErrorInterface
+	if !errors.As(err, &se) {
+		return &EventErrorInfo{Code: serum.Code(err), Message: err.Error()}
+	}
+	ee := &EventErrorInfo{
+		Code:    se.Code(),
+		Message: serum.Message(se),
+		Details: serum.DetailsMap(se),
+	}
+	if len(ee.Details) == 0 {
+		ee.Details = nil
+	}
+	return ee
+}
+
+// DurationMillis is a helper for filling Event.Duration.
+func DurationMillis(d time.Duration) *float64 {
+	ms := float64(d) / float64(time.Millisecond)
+	return &ms
+}
+
+// EventSink receives events.
+// Implementations must be safe for concurrent use, since actions may run in parallel (e.g. in a pipe).
+type EventSink interface {
+	Emit(Event)
+}
+
+// TeeEventSink returns an EventSink that passes every event along to each of the given sinks, in order.
+// Nil sinks are skipped.
+func TeeEventSink(sinks ...EventSink) EventSink {
+	var nonNil teeEventSink
+	for _, s := range sinks {
+		if s != nil {
+			nonNil = append(nonNil, s)
+		}
+	}
+	return nonNil
+}
+
+type teeEventSink []EventSink
+
+func (t teeEventSink) Emit(ev Event) {
+	for _, s := range t {
+		s.Emit(ev)
+	}
+}
+
+// NewJSONLEventSink returns an EventSink that writes each event as a line of JSON.
+// Write errors are ignored: losing the event stream shouldn't stop the work it's reporting on.
+func NewJSONLEventSink(w io.Writer) EventSink {
+	return &jsonlEventSink{w: w}
+}
+
+type jsonlEventSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *jsonlEventSink) Emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	bs, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	bs = append(bs, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = s.w.Write(bs)
+}
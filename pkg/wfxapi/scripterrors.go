@@ -0,0 +1,123 @@
+package wfxapi
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/serum-errors/go-serum"
+	"go.starlark.net/resolve"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// Errors that come from script code say where in the script they came from, with these details:
+//
+//   - "file", "line", and "col" -- the position.  Line and col are one-based, and col counts characters (not bytes), as starlark does.
+//   - "stack" -- for errors at runtime, the starlark call stack, outermost call first: one "file:line:col: in function" per line.
+//
+// The position is that of the innermost call in script code (builtins don't have positions),
+// so it's also the last line of the stack.
+
+// ErrorScriptParsefail is an error constructor.
+// If the cause is a syntax error, or an error from resolving names, its message and position are used
+// (and if there were several, the first is used, and the message says how many more there were);
+// otherwise, the cause is just wrapped.
+//
+// Errors:
+//
+//   - wfx-script-parsefail -- always this.
+func ErrorScriptParsefail(cause error, phase string) error {
+	var syntaxErr syntax.Error
+	var resolveErrs resolve.ErrorList
+	switch {
+	case errors.As(cause, &syntaxErr):
+		return WithScriptPosition(serum.Error(EcodeScriptParsefail,
+			serum.WithMessageLiteral(syntaxErr.Msg),
+			serum.WithDetail("phase", phase),
+		), syntaxErr.Pos, "")
+	case errors.As(cause, &resolveErrs) && len(resolveErrs) > 0:
+		msg := resolveErrs[0].Msg
+		if more := len(resolveErrs) - 1; more == 1 {
+			msg += " (and 1 more error)"
+		} else if more > 1 {
+			msg += fmt.Sprintf(" (and %d more errors)", more)
+		}
+		return WithScriptPosition(serum.Error(EcodeScriptParsefail,
+			serum.WithMessageLiteral(msg),
+			serum.WithDetail("phase", phase),
+		), resolveErrs[0].Pos, "")
+	}
+	return serum.Error(EcodeScriptParsefail,
+		serum.WithCause(cause),
+		serum.WithDetail("phase", phase),
+	)
+}
+
+// WithScriptPosition returns an error just like err, but with details saying where in the script it came from
+// (and the call stack, if stack isn't empty; see above for the format).
+// If err already says where it came from, or the position isn't valid, err is returned unchanged:
+// the innermost position is the one that's most useful.
+//
+// Errors that aren't serum-styled are converted with serum.Standardize; this is meant for ones that are.
+func WithScriptPosition(err error, pos syntax.Position, stack string) error {
+	if err == nil || pos.Line < 1 || serum.Detail(err, "file") != "" {
+		return err
+	}
+	std := serum.Standardize(err).(*serum.ErrorValue)
+	res := &serum.ErrorValue{Data: std.Data}
+	res.Data.Details = append(append([][2]string{}, std.Data.Details...),
+		[2]string{"file", pos.Filename()},
+		[2]string{"line", strconv.Itoa(int(pos.Line))},
+		[2]string{"col", strconv.Itoa(int(pos.Col))},
+	)
+	if stack != "" {
+		res.Data.Details = append(res.Data.Details, [2]string{"stack", stack})
+	}
+	return res
+}
+
+// WithStarlarkBacktrace converts an error from evaluating starlark, so that it says where it came from.
+//
+// If err is a *starlark.EvalError, the result is the first serum-styled error it wraps (typically, from an action that failed),
+// or if there isn't one, a wfx-eval-error with its message (e.g. from `fail`, or a starlark runtime error like dividing by zero);
+// and either way, with the position of the innermost call in script code, and the call stack (see WithScriptPosition).
+// Any other error is returned unchanged.
+//
+// Errors:
+//
+//   - wfx-eval-error -- if the starlark code itself failed.
+//   - any other code -- from whatever the starlark code called that failed.
+func WithStarlarkBacktrace(err error) error {
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		return err
+	}
+	var res error = serum.Error(EcodeEvalError, serum.WithMessageLiteral(evalErr.Msg))
+	var se serum.ErrorInterface
+	if errors.As(evalErr.Unwrap(), &se) {
+		res = se
+	}
+	pos, stack := Backtrace(evalErr)
+	return WithScriptPosition(res, pos, stack)
+}
+
+// Backtrace returns the position of the innermost call in script code, and the call stack (formatted as described for WithScriptPosition),
+// for an error from evaluating starlark.
+// If err isn't a *starlark.EvalError, there's no backtrace, and the position isn't valid.
+func Backtrace(err error) (pos syntax.Position, stack string) {
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		return pos, ""
+	}
+	var frames []string
+	for _, fr := range evalErr.CallStack {
+		if fr.Pos.Line < 1 {
+			continue // Builtins have no position.  What failed in them is already in the message.
+		}
+		pos = fr.Pos
+		frames = append(frames, fmt.Sprintf("%s: in %s", fr.Pos, fr.Name))
+	}
+	return pos, strings.Join(frames, "\n")
+}